@@ -0,0 +1,28 @@
+// Let files be dragged and dropped anywhere on a .dropzone container
+// instead of only on its file input.
+document.addEventListener("DOMContentLoaded", function() {
+    var zones = document.querySelectorAll(".dropzone");
+    for (var i=0; i < zones.length; i++) {
+        initDropzone(zones[i]);
+    }
+});
+
+function initDropzone(zone) {
+    var input = zone.querySelector("input[type=file]");
+    if (input == null) {
+        return;
+    }
+
+    zone.addEventListener("dragover", function(e) {
+        e.preventDefault();
+        zone.classList.add("bg-gray-200");
+    });
+    zone.addEventListener("dragleave", function(e) {
+        zone.classList.remove("bg-gray-200");
+    });
+    zone.addEventListener("drop", function(e) {
+        e.preventDefault();
+        zone.classList.remove("bg-gray-200");
+        input.files = e.dataTransfer.files;
+    });
+}
@@ -1,20 +1,49 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
 	"database/sql"
+	"embed"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"html"
+	"html/template"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/alecthomas/chroma"
+	chromahtml "github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/alecthomas/chroma/styles"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/microcosm-cc/bluemonday"
 	"github.com/shurcooL/github_flavored_markdown"
+	"github.com/shurcooL/sanitized_anchor_name"
+	"gopkg.in/yaml.v3"
 )
 
 type User struct {
@@ -24,23 +53,89 @@ type User struct {
 	Email    string
 }
 type Site struct {
-	Siteid   int64
-	Sitename string
-	Desc     string
+	Siteid      int64
+	Sitename    string
+	Desc        string
+	Quota       int64
+	Istemplate  bool
+	Theme       string
+	Css         string
+	Header      string
+	Footer      string
+	Nav         string
+	Navonly     bool
+	Toc         bool
+	Iframehosts string
 }
 type Page struct {
-	Pageid int64
-	Title  string
-	Body   string
+	Pageid   int64
+	Title    string
+	Body     string
+	Createdt time.Time
+	Updatedt time.Time
+	Summary  string // from front matter
+	Layout   string // from front matter
 }
 type File struct {
 	Fileid   int64
 	Filename string
 	Bytes    []byte
+	Size     int64
+	Hash     string
+	Ctype    string
+	Userid   int64
+	Desc     string
+	Alt      string
+	Createdt time.Time
+	Updatedt time.Time
+}
+type FileVersion struct {
+	Versionid int64
+	Fileid    int64
+	Size      int64
+	Hash      string
+	Ctype     string
+	Userid    int64
+	Username  string
+	Updatedt  time.Time
 }
 
 var _loremipsum, _loremipsum2 string
 
+// Sample page shown when previewing a site theme.
+var _themePreview = `## Heading
+
+Some *text* with a [link](#) and ` + "`inline code`" + `.
+
+- List item one
+- List item two
+
+> A blockquote.
+
+    Preformatted code block
+`
+
+// Upload limits, in bytes. Set from command line switches.
+// _maxUploadSize limits each file, _maxUploadRequest all files uploaded
+// together. A site's quota setting of 0 means use _defaultSiteQuota.
+var _maxUploadSize int64 = 32 * 1024 * 1024
+var _maxUploadRequest int64 = 256 * 1024 * 1024
+var _defaultSiteQuota int64 = 512 * 1024 * 1024
+
+// How long deleted sites, pages and files stay in the trash.
+var _trashRetention = 30 * 24 * time.Hour
+
+// Custom domains mapped to sites, cached from the site_domain table so that
+// url functions can look them up without a db handle.
+var _siteDomains = struct {
+	sync.RWMutex
+	bySitename map[string]string
+	byDomain   map[string]string
+}{bySitename: map[string]string{}, byDomain: map[string]string{}}
+
+// Host name serving path-based sites. Set from command line switch.
+var _mainHost string
+
 func init() {
 	_loremipsum = `<p>Lorem ipsum dolor sit amet, consectetur adipiscing elit. Etiam mattis volutpat libero a sodales. Sed a sagittis est. Sed eros nunc, maximus id lectus nec, tempor tincidunt felis. Cras viverra arcu ut tellus sagittis, et pharetra arcu ornare. Cras euismod turpis id auctor posuere. Nunc euismod molestie est, nec congue velit vestibulum rutrum. Etiam vitae consectetur mauris.</p>
 <blockquote>
@@ -55,7 +150,7 @@ type PrintFunc func(format string, a ...interface{}) (n int, err error)
 func createTables(newfile string) {
 	if fileExists(newfile) {
 		s := fmt.Sprintf("File '%s' already exists. Can't initialize it.\n", newfile)
-		fmt.Printf(s)
+		fmt.Print(s)
 		os.Exit(1)
 	}
 
@@ -67,7 +162,10 @@ func createTables(newfile string) {
 
 	ss := []string{
 		"CREATE TABLE user (user_id INTEGER PRIMARY KEY NOT NULL, username TEXT UNIQUE, password TEXT, active INTEGER NOT NULL, email TEXT);",
-		"CREATE TABLE site (site_id INTEGER PRIMARY KEY NOT NULL, sitename TEXT UNIQUE, desc TEXT);",
+		"CREATE TABLE site (site_id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL, sitename TEXT UNIQUE, desc TEXT, quota INTEGER NOT NULL DEFAULT 0, istemplate INTEGER NOT NULL DEFAULT 0, theme TEXT NOT NULL DEFAULT '', css TEXT NOT NULL DEFAULT '', header TEXT NOT NULL DEFAULT '', footer TEXT NOT NULL DEFAULT '', nav TEXT NOT NULL DEFAULT '', navonly INTEGER NOT NULL DEFAULT 0, toc INTEGER NOT NULL DEFAULT 0, iframehosts TEXT NOT NULL DEFAULT '');",
+		"CREATE TABLE sitetrash (site_id INTEGER PRIMARY KEY NOT NULL, sitename TEXT, desc TEXT, quota INTEGER NOT NULL DEFAULT 0, istemplate INTEGER NOT NULL DEFAULT 0, theme TEXT NOT NULL DEFAULT '', css TEXT NOT NULL DEFAULT '', header TEXT NOT NULL DEFAULT '', footer TEXT NOT NULL DEFAULT '', nav TEXT NOT NULL DEFAULT '', navonly INTEGER NOT NULL DEFAULT 0, toc INTEGER NOT NULL DEFAULT 0, iframehosts TEXT NOT NULL DEFAULT '', trashdt TEXT NOT NULL, trashed_by INTEGER NOT NULL);",
+		"CREATE TABLE sitealias (alias TEXT PRIMARY KEY NOT NULL, site_id INTEGER NOT NULL);",
+		"CREATE TABLE site_domain (domain TEXT PRIMARY KEY NOT NULL, site_id INTEGER UNIQUE NOT NULL);",
 		"INSERT INTO user (user_id, username, password, active, email) VALUES (1, 'admin', '', 1, '');",
 	}
 
@@ -101,1102 +199,6037 @@ func createTables(newfile string) {
 	}
 }
 
-func main() {
-	os.Args = os.Args[1:]
-	sw, parms := parseArgs(os.Args)
+//*** Database migration ***
+
+// Databases made by older versions of t2 are brought up to date at startup.
+// Each step checks for the tables and columns it adds, so all steps run on
+// every startup, in order, whatever version the database is from.
+var _migrations = []struct {
+	Desc string
+	Fn   func(tx *sql.Tx) error
+}{
+	{"file hashes", migrateFileHash},
+	{"file content types", migrateFileContentType},
+	{"site quotas", migrateSiteQuota},
+	{"file versions", migrateFileVersions},
+	{"thumbnail cache", migrateThumbs},
+	{"page links", migrateLinks},
+	{"file info", migrateFileInfo},
+	{"trash", migrateTrash},
+	{"site templates", migrateSiteTemplates},
+	{"site aliases", migrateSiteAliases},
+	{"site domains", migrateSiteDomains},
+	{"site themes", migrateSiteThemes},
+	{"site header, footer and nav", migrateSiteNav},
+	{"site iframe hosts", migrateSiteIframeHosts},
+	{"page dates", migratePageDates},
+	{"site table of contents", migrateSiteToc},
+	{"page front matter", migrateFrontMatter},
+	{"unique ids", migrateAutoincrement},
+}
 
-	// [-i new_file]  Create and initialize db file
-	if sw["i"] != "" {
-		dbfile := sw["i"]
-		if fileExists(dbfile) {
-			s := fmt.Sprintf("File '%s' already exists. Can't initialize it.\n", dbfile)
-			fmt.Printf(s)
-			os.Exit(1)
+func migrateDB(db *sql.DB) error {
+	for _, m := range _migrations {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		err = m.Fn(tx)
+		if handleTxErr(tx, err) {
+			return fmt.Errorf("%s: %s", m.Desc, err)
+		}
+		err = tx.Commit()
+		if handleTxErr(tx, err) {
+			return fmt.Errorf("%s: %s", m.Desc, err)
 		}
-		createTables(dbfile)
-		os.Exit(0)
-	}
-
-	// Need to specify a db file as first parameter.
-	if len(parms) == 0 {
-		s := `Usage:
-
-Start webservice using database file:
-	t2 <sites.db>
-
-Initialize new database file:
-	t2 -i <sites.db>
-`
-		fmt.Printf(s)
-		os.Exit(0)
-	}
-
-	// Exit if db file doesn't exist.
-	dbfile := parms[0]
-	if !fileExists(dbfile) {
-		s := fmt.Sprintf(`Sites database file '%s' doesn't exist. Create one using:
-	wb -i <notes.db>
-`, dbfile)
-		fmt.Printf(s)
-		os.Exit(1)
-	}
-
-	db, err := sql.Open("sqlite3", dbfile)
-	if err != nil {
-		fmt.Printf("Error opening '%s' (%s)\n", dbfile, err)
-		os.Exit(1)
 	}
-
-	http.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) { http.ServeFile(w, r, "./static/coffee.ico") })
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))))
-	http.HandleFunc("/", indexHandler(db))
-	http.HandleFunc("/createsite/", createsiteHandler(db))
-	http.HandleFunc("/editsite/", editsiteHandler(db))
-	http.HandleFunc("/delsite/", delsiteHandler(db))
-	http.HandleFunc("/createpage/", createpageHandler(db))
-	http.HandleFunc("/editpage/", editpageHandler(db))
-	http.HandleFunc("/delpage/", delpageHandler(db))
-	http.HandleFunc("/uploadfile/", uploadfileHandler(db))
-	http.HandleFunc("/delfile/", delfileHandler(db))
-
-	port := "8000"
-	fmt.Printf("Listening on %s...\n", port)
-	err = http.ListenAndServe(fmt.Sprintf(":%s", port), nil)
-	log.Fatal(err)
+	return nil
 }
 
-//*** DB functions ***
-func sqlstmt(db *sql.DB, s string) *sql.Stmt {
-	stmt, err := db.Prepare(s)
-	if err != nil {
-		log.Fatalf("db.Prepare() sql: '%s'\nerror: '%s'", s, err)
-	}
-	return stmt
-}
-func sqlexec(db *sql.DB, s string, pp ...interface{}) (sql.Result, error) {
-	stmt := sqlstmt(db, s)
-	defer stmt.Close()
-	return stmt.Exec(pp...)
+func tableExists(tx *sql.Tx, table string) (bool, error) {
+	var n int
+	err := tx.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&n)
+	return n > 0, err
 }
-func txstmt(tx *sql.Tx, s string) *sql.Stmt {
-	stmt, err := tx.Prepare(s)
-	if err != nil {
-		log.Fatalf("tx.Prepare() sql: '%s'\nerror: '%s'", s, err)
+
+// Create table if it doesn't exist, returns whether it was created.
+func migrateTable(tx *sql.Tx, table, cols string) (bool, error) {
+	exists, err := tableExists(tx, table)
+	if err != nil || exists {
+		return false, err
 	}
-	return stmt
-}
-func txexec(tx *sql.Tx, s string, pp ...interface{}) (sql.Result, error) {
-	stmt := txstmt(tx, s)
-	defer stmt.Close()
-	return stmt.Exec(pp...)
+	_, err = txexec(tx, fmt.Sprintf("CREATE TABLE %s (%s)", table, cols))
+	return err == nil, err
 }
 
-func queryUserById(db *sql.DB, userid int64) *User {
-	var u User
-	s := "SELECT user_id, username, active, email FROM user WHERE user_id = ?"
-	row := db.QueryRow(s, userid)
-	err := row.Scan(&u.Userid, &u.Username, &u.Active, &u.Email)
-	if err == sql.ErrNoRows {
-		return nil
+// Add column to table if the table exists and doesn't have the column yet,
+// returns whether it was added.
+func migrateColumn(tx *sql.Tx, table, col, coldef string) (bool, error) {
+	exists, err := tableExists(tx, table)
+	if err != nil || !exists {
+		return false, err
 	}
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
 	if err != nil {
-		fmt.Printf("queryUser() db error (%s)\n", err)
-		return nil
+		return false, err
 	}
-	return &u
-}
-func querySiteById(db *sql.DB, siteid int64) *Site {
-	var site Site
-	s := "SELECT site_id, sitename, desc FROM site WHERE site_id = ?"
-	row := db.QueryRow(s, siteid)
-	err := row.Scan(&site.Siteid, &site.Sitename, &site.Desc)
-	if err == sql.ErrNoRows {
-		return nil
+	found := false
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, ctype string
+		var dflt sql.NullString
+		err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk)
+		if err != nil {
+			rows.Close()
+			return false, err
+		}
+		if name == col {
+			found = true
+		}
 	}
-	if err != nil {
-		fmt.Printf("querySiteById() db error (%s)\n", err)
-		return nil
+	rows.Close()
+	if found {
+		return false, nil
 	}
-	return &site
+	_, err = txexec(tx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, col, coldef))
+	return err == nil, err
 }
-func querySiteBySitename(db *sql.DB, sitename string) *Site {
-	var site Site
-	s := "SELECT site_id, sitename, desc FROM site WHERE sitename = ?"
-	row := db.QueryRow(s, sitename)
-	err := row.Scan(&site.Siteid, &site.Sitename, &site.Desc)
-	if err == sql.ErrNoRows {
-		return nil
-	}
+
+// Ids of all sites with tables, including sites in the trash.
+func migrateSiteIds(tx *sql.Tx) ([]int64, error) {
+	s := "SELECT site_id FROM site"
+	exists, err := tableExists(tx, "sitetrash")
 	if err != nil {
-		fmt.Printf("querySiteBySitename() db error (%s)\n", err)
-		return nil
-	}
-	return &site
-}
-func pagetblName(siteid int64) string {
-	return fmt.Sprintf("pages_%d", siteid)
-}
-func filetblName(siteid int64) string {
-	return fmt.Sprintf("files_%d", siteid)
-}
-func queryPageById(db *sql.DB, siteid int64, pageid int64) *Page {
-	var p Page
-	pagetbl := pagetblName(siteid)
-	s := fmt.Sprintf("SELECT page_id, title, body FROM %s WHERE page_id = ?", pagetbl)
-	row := db.QueryRow(s, pageid)
-	err := row.Scan(&p.Pageid, &p.Title, &p.Body)
-	if err == sql.ErrNoRows {
-		return nil
+		return nil, err
 	}
-	if err != nil {
-		fmt.Printf("queryPageById() db error (%s)\n", err)
-		return nil
+	if exists {
+		s += " UNION SELECT site_id FROM sitetrash"
 	}
-	return &p
+	return queryTxIds(tx, s)
 }
-func queryPageByTitle(db *sql.DB, siteid int64, title string) *Page {
-	var p Page
-	pagetbl := pagetblName(siteid)
-	s := fmt.Sprintf("SELECT page_id, title, body FROM %s WHERE title = ?", pagetbl)
-	row := db.QueryRow(s, title)
-	err := row.Scan(&p.Pageid, &p.Title, &p.Body)
-	if err == sql.ErrNoRows {
-		return nil
-	}
+func queryTxIds(tx *sql.Tx, s string, pp ...interface{}) ([]int64, error) {
+	rows, err := tx.Query(s, pp...)
 	if err != nil {
-		fmt.Printf("queryPageByTitle() db error (%s)\n", err)
-		return nil
-	}
-	return &p
-}
-func queryFileByFilename(db *sql.DB, siteid int64, filename string) *File {
-	var file File
-	filetbl := filetblName(siteid)
-	s := fmt.Sprintf("SELECT filename, bytes FROM %s WHERE filename = ?", filetbl)
-	row := db.QueryRow(s, filename)
-	err := row.Scan(&file.Filename, &file.Bytes)
-	if err == sql.ErrNoRows {
-		return nil
+		return nil, err
 	}
-	if err != nil {
-		fmt.Printf("queryFileByFilename() db error (%s)\n", err)
-		return nil
+	defer rows.Close()
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
 	}
-	return &file
+	return ids, rows.Err()
 }
-func createSite(db *sql.DB, site *Site) (int64, error) {
-	tx, err := db.Begin()
+
+// Files have a content hash for ETags and an updated date.
+func migrateFileHash(tx *sql.Tx) error {
+	siteids, err := migrateSiteIds(tx)
 	if err != nil {
-		return 0, err
-	}
-	s := "INSERT INTO site (sitename, desc) VALUES (?, ?)"
-	result, err := txexec(tx, s, site.Sitename, site.Desc)
-	if handleTxErr(tx, err) {
-		return 0, err
-	}
-	site.Siteid, err = result.LastInsertId()
-	if handleTxErr(tx, err) {
-		return 0, err
+		return err
 	}
+	for _, siteid := range siteids {
+		filetbl := filetblName(siteid)
+		_, err := migrateColumn(tx, filetbl, "hash", "TEXT NOT NULL DEFAULT ''")
+		if err != nil {
+			return err
+		}
+		_, err = migrateColumn(tx, filetbl, "updatedt", "TEXT NOT NULL DEFAULT ''")
+		if err != nil {
+			return err
+		}
 
-	pagetbl := pagetblName(site.Siteid)
-	s = fmt.Sprintf("CREATE TABLE %s (page_id INTEGER PRIMARY KEY NOT NULL, title TEXT UNIQUE, body TEXT)", pagetbl)
-	_, err = txexec(tx, s)
-	if handleTxErr(tx, err) {
-		return 0, err
+		fileids, err := queryTxIds(tx, fmt.Sprintf("SELECT file_id FROM %s WHERE hash = ''", filetbl))
+		if err != nil {
+			return err
+		}
+		for _, fileid := range fileids {
+			var bs []byte
+			s := fmt.Sprintf("SELECT bytes FROM %s WHERE file_id = ?", filetbl)
+			err := tx.QueryRow(s, fileid).Scan(&bs)
+			if err != nil {
+				return err
+			}
+			s = fmt.Sprintf("UPDATE %s SET hash = ? WHERE file_id = ?", filetbl)
+			_, err = txexec(tx, s, hashBytes(bs), fileid)
+			if err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
 
-	filetbl := filetblName(site.Siteid)
-	s = fmt.Sprintf("CREATE TABLE %s (file_id INTEGER PRIMARY KEY NOT NULL, filename TEXT UNIQUE, bytes BLOB)", filetbl)
-	_, err = txexec(tx, s)
-	if handleTxErr(tx, err) {
-		return 0, err
+// Files have a stored content type.
+func migrateFileContentType(tx *sql.Tx) error {
+	siteids, err := migrateSiteIds(tx)
+	if err != nil {
+		return err
 	}
+	for _, siteid := range siteids {
+		filetbl := filetblName(siteid)
+		_, err := migrateColumn(tx, filetbl, "content_type", "TEXT NOT NULL DEFAULT ''")
+		if err != nil {
+			return err
+		}
 
-	err = tx.Commit()
-	if handleTxErr(tx, err) {
-		return 0, err
+		fileids, err := queryTxIds(tx, fmt.Sprintf("SELECT file_id FROM %s WHERE content_type = ''", filetbl))
+		if err != nil {
+			return err
+		}
+		for _, fileid := range fileids {
+			var filename string
+			var bs []byte
+			s := fmt.Sprintf("SELECT filename, bytes FROM %s WHERE file_id = ?", filetbl)
+			err := tx.QueryRow(s, fileid).Scan(&filename, &bs)
+			if err != nil {
+				return err
+			}
+			s = fmt.Sprintf("UPDATE %s SET content_type = ? WHERE file_id = ?", filetbl)
+			_, err = txexec(tx, s, detectContentType(filename, bs), fileid)
+			if err != nil {
+				return err
+			}
+		}
 	}
-	return site.Siteid, nil
+	return nil
 }
-func createPage(db *sql.DB, site *Site, p *Page) (int64, error) {
-	s := fmt.Sprintf("INSERT INTO %s (title, body) VALUES (?, ?)", pagetblName(site.Siteid))
-	result, err := sqlexec(db, s, p.Title, p.Body)
+
+// Sites have a storage quota, 0 for the default.
+func migrateSiteQuota(tx *sql.Tx) error {
+	_, err := migrateColumn(tx, "site", "quota", "INTEGER NOT NULL DEFAULT 0")
+	return err
+}
+
+// Files record who uploaded them and keep their previous versions.
+func migrateFileVersions(tx *sql.Tx) error {
+	siteids, err := migrateSiteIds(tx)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	pageid, err := result.LastInsertId()
-	if err != nil {
-		return 0, err
+	for _, siteid := range siteids {
+		_, err := migrateColumn(tx, filetblName(siteid), "user_id", "INTEGER NOT NULL DEFAULT 0")
+		if err != nil {
+			return err
+		}
+		_, err = migrateTable(tx, fileversiontblName(siteid), "version_id INTEGER PRIMARY KEY NOT NULL, file_id INTEGER NOT NULL, bytes BLOB, hash TEXT NOT NULL DEFAULT '', content_type TEXT NOT NULL DEFAULT '', user_id INTEGER NOT NULL DEFAULT 0, updatedt TEXT NOT NULL DEFAULT ''")
+		if err != nil {
+			return err
+		}
 	}
-	return pageid, nil
+	return nil
 }
-func createIndexPage(db *sql.DB, site *Site, p *Page) error {
-	// Create page_id 1 to serve as starting page of site.
-	s := fmt.Sprintf("INSERT INTO %s (page_id, title, body) VALUES (?, ?, ?)", pagetblName(site.Siteid))
-	_, err := sqlexec(db, s, 1, p.Title, p.Body)
+
+// Resized images are cached per site.
+func migrateThumbs(tx *sql.Tx) error {
+	siteids, err := migrateSiteIds(tx)
 	if err != nil {
 		return err
 	}
+	for _, siteid := range siteids {
+		_, err := migrateTable(tx, thumbtblName(siteid), "hash TEXT NOT NULL, width INTEGER NOT NULL, bytes BLOB, content_type TEXT NOT NULL DEFAULT '', PRIMARY KEY (hash, width)")
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-//*** Helper functions ***
-func listContains(ss []string, v string) bool {
-	for _, s := range ss {
-		if v == s {
-			return true
+// Each page's links to other pages and files are kept in a links table.
+func migrateLinks(tx *sql.Tx) error {
+	siteids, err := migrateSiteIds(tx)
+	if err != nil {
+		return err
+	}
+	for _, siteid := range siteids {
+		linktbl := linktblName(siteid)
+		created, err := migrateTable(tx, linktbl, "page_id INTEGER NOT NULL, kind TEXT NOT NULL, target TEXT NOT NULL")
+		if err != nil {
+			return err
+		}
+		if !created {
+			continue
+		}
+		_, err = txexec(tx, fmt.Sprintf("CREATE INDEX %s_target ON %s (kind, target)", linktbl, linktbl))
+		if err != nil {
+			return err
+		}
+		err = migratePageLinks(tx, siteid)
+		if err != nil {
+			return err
 		}
 	}
-	return false
+	return nil
 }
-func fileExists(file string) bool {
-	_, err := os.Stat(file)
-	if err != nil && os.IsNotExist(err) {
-		return false
+
+// Reparse the links of all of a site's pages.
+func migratePageLinks(tx *sql.Tx, siteid int64) error {
+	pageids, err := queryTxIds(tx, fmt.Sprintf("SELECT page_id FROM %s", pagetblName(siteid)))
+	if err != nil {
+		return err
 	}
-	return true
+	for _, pageid := range pageids {
+		var body string
+		s := fmt.Sprintf("SELECT body FROM %s WHERE page_id = ?", pagetblName(siteid))
+		err := tx.QueryRow(s, pageid).Scan(&body)
+		if err != nil {
+			return err
+		}
+		err = updatePageLinksTx(tx, siteid, pageid, body)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
-func makePrintFunc(w io.Writer) func(format string, a ...interface{}) (n int, err error) {
-	// Return closure enclosing io.Writer.
-	return func(format string, a ...interface{}) (n int, err error) {
-		return fmt.Fprintf(w, format, a...)
+
+// Files have a description, alt text and created date.
+func migrateFileInfo(tx *sql.Tx) error {
+	siteids, err := migrateSiteIds(tx)
+	if err != nil {
+		return err
+	}
+	for _, siteid := range siteids {
+		for _, col := range []string{"desc", "alt", "createdt"} {
+			_, err := migrateColumn(tx, filetblName(siteid), col, "TEXT NOT NULL DEFAULT ''")
+			if err != nil {
+				return err
+			}
+		}
 	}
+	return nil
 }
-func atoi(s string) int {
-	if s == "" {
-		return 0
+
+// Deleted sites, pages and files go to trash tables.
+func migrateTrash(tx *sql.Tx) error {
+	_, err := migrateTable(tx, "sitetrash", "site_id INTEGER PRIMARY KEY NOT NULL, sitename TEXT, desc TEXT, quota INTEGER NOT NULL DEFAULT 0, trashdt TEXT NOT NULL, trashed_by INTEGER NOT NULL")
+	if err != nil {
+		return err
 	}
-	n, err := strconv.Atoi(s)
+	siteids, err := migrateSiteIds(tx)
 	if err != nil {
-		return 0
+		return err
 	}
-	return n
+	for _, siteid := range siteids {
+		_, err := migrateTable(tx, pagetrashtblName(siteid), "page_id INTEGER PRIMARY KEY NOT NULL, title TEXT, body TEXT, trashdt TEXT NOT NULL, trashed_by INTEGER NOT NULL")
+		if err != nil {
+			return err
+		}
+		_, err = migrateTable(tx, filetrashtblName(siteid), "file_id INTEGER PRIMARY KEY NOT NULL, filename TEXT, bytes BLOB, hash TEXT NOT NULL DEFAULT '', content_type TEXT NOT NULL DEFAULT '', user_id INTEGER NOT NULL DEFAULT 0, desc TEXT NOT NULL DEFAULT '', alt TEXT NOT NULL DEFAULT '', createdt TEXT NOT NULL DEFAULT '', updatedt TEXT NOT NULL DEFAULT '', trashdt TEXT NOT NULL, trashed_by INTEGER NOT NULL")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
-func idtoi(sid string) int64 {
-	return int64(atoi(sid))
+
+// Add column to both site and sitetrash.
+func migrateSiteColumn(tx *sql.Tx, col, coldef string) error {
+	for _, table := range []string{"site", "sitetrash"} {
+		_, err := migrateColumn(tx, table, col, coldef)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
-func itoa(n int64) string {
-	return strconv.FormatInt(n, 10)
+
+// Sites can be marked as templates for new sites.
+func migrateSiteTemplates(tx *sql.Tx) error {
+	return migrateSiteColumn(tx, "istemplate", "INTEGER NOT NULL DEFAULT 0")
 }
 
-func parseArgs(args []string) (map[string]string, []string) {
-	switches := map[string]string{}
-	parms := []string{}
+// Old names of renamed sites redirect to the site.
+func migrateSiteAliases(tx *sql.Tx) error {
+	_, err := migrateTable(tx, "sitealias", "alias TEXT PRIMARY KEY NOT NULL, site_id INTEGER NOT NULL")
+	return err
+}
 
-	standaloneSwitches := []string{}
-	definitionSwitches := []string{"i", "import"}
-	fNoMoreSwitches := false
-	curKey := ""
+// Sites can be served on their own domain.
+func migrateSiteDomains(tx *sql.Tx) error {
+	_, err := migrateTable(tx, "site_domain", "domain TEXT PRIMARY KEY NOT NULL, site_id INTEGER UNIQUE NOT NULL")
+	return err
+}
 
-	for _, arg := range args {
-		if fNoMoreSwitches {
-			// any arg after "--" is a standalone parameter
-			parms = append(parms, arg)
-		} else if arg == "--" {
-			// "--" means no more switches to come
-			fNoMoreSwitches = true
-		} else if strings.HasPrefix(arg, "--") {
-			switches[arg[2:]] = "y"
-			curKey = ""
-		} else if strings.HasPrefix(arg, "-") {
-			if listContains(definitionSwitches, arg[1:]) {
-				// -a "val"
-				curKey = arg[1:]
-				continue
-			}
-			for _, ch := range arg[1:] {
-				// -a, -b, -ab
-				sch := string(ch)
-				if listContains(standaloneSwitches, sch) {
-					switches[sch] = "y"
-				}
-			}
-		} else if curKey != "" {
-			switches[curKey] = arg
-			curKey = ""
-		} else {
-			// standalone parameter
-			parms = append(parms, arg)
+// Sites have a theme and custom css.
+func migrateSiteThemes(tx *sql.Tx) error {
+	for _, col := range []string{"theme", "css"} {
+		err := migrateSiteColumn(tx, col, "TEXT NOT NULL DEFAULT ''")
+		if err != nil {
+			return err
 		}
 	}
-
-	return switches, parms
+	return nil
 }
 
-func unescape(s string) string {
-	s2, err := url.QueryUnescape(s)
-	if err != nil {
-		return s
+// Sites have a custom header, footer and nav bar.
+func migrateSiteNav(tx *sql.Tx) error {
+	for _, col := range []string{"header", "footer", "nav"} {
+		err := migrateSiteColumn(tx, col, "TEXT NOT NULL DEFAULT ''")
+		if err != nil {
+			return err
+		}
 	}
-	return s2
-}
-func escape(s string) string {
-	return url.QueryEscape(s)
+	return migrateSiteColumn(tx, "navonly", "INTEGER NOT NULL DEFAULT 0")
 }
 
-func parsePageUrl(r *http.Request) (string, string) {
-	surl := strings.Trim(r.URL.Path, "/")
-	ss := strings.Split(surl, "/")
-	sslen := len(ss)
-	if sslen == 0 {
-		return "", ""
-	} else if sslen == 1 {
-		return unescape(ss[0]), ""
-	}
-	return unescape(ss[0]), unescape(ss[1])
+// Sites can allow iframes from listed hosts.
+func migrateSiteIframeHosts(tx *sql.Tx) error {
+	return migrateSiteColumn(tx, "iframehosts", "TEXT NOT NULL DEFAULT ''")
 }
-func pageUrl(sitename, title string) string {
-	if sitename == "" && title == "" {
-		return "/"
+
+// Pages have created and updated dates.
+func migratePageDates(tx *sql.Tx) error {
+	siteids, err := migrateSiteIds(tx)
+	if err != nil {
+		return err
 	}
-	if title == "" {
-		return fmt.Sprintf("/%s", escape(sitename))
+	for _, siteid := range siteids {
+		for _, table := range []string{pagetblName(siteid), pagetrashtblName(siteid)} {
+			for _, col := range []string{"createdt", "updatedt"} {
+				_, err := migrateColumn(tx, table, col, "TEXT NOT NULL DEFAULT ''")
+				if err != nil {
+					return err
+				}
+			}
+		}
 	}
-	return fmt.Sprintf("/%s/%s", escape(sitename), escape(title))
+	return nil
 }
-func isFileUrl(r *http.Request) bool {
-	ss := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
-	if len(ss) >= 3 && ss[1] == "~file" {
-		return true
-	}
-	return false
+
+// Sites can show a table of contents for each page.
+func migrateSiteToc(tx *sql.Tx) error {
+	return migrateSiteColumn(tx, "toc", "INTEGER NOT NULL DEFAULT 0")
 }
-func parseFileUrl(r *http.Request) (string, string) {
-	// file url takes the form "/<sitename>/~file/<filename>"
-	surl := strings.Trim(r.URL.Path, "/")
-	ss := strings.Split(surl, "/")
-	sslen := len(ss)
-	if sslen == 0 {
-		return "", ""
-	} else if sslen == 1 || sslen == 2 {
-		return unescape(ss[0]), ""
+
+// Pages have a summary and layout from their front matter, and front
+// matter tags and aliases are kept in the links table.
+func migrateFrontMatter(tx *sql.Tx) error {
+	siteids, err := migrateSiteIds(tx)
+	if err != nil {
+		return err
 	}
-	return unescape(ss[0]), unescape(ss[2])
+	for _, siteid := range siteids {
+		pagetbl := pagetblName(siteid)
+		added, err := migrateColumn(tx, pagetbl, "summary", "TEXT NOT NULL DEFAULT ''")
+		if err != nil {
+			return err
+		}
+		_, err = migrateColumn(tx, pagetbl, "layout", "TEXT NOT NULL DEFAULT ''")
+		if err != nil {
+			return err
+		}
+		for _, col := range []string{"summary", "layout"} {
+			_, err := migrateColumn(tx, pagetrashtblName(siteid), col, "TEXT NOT NULL DEFAULT ''")
+			if err != nil {
+				return err
+			}
+		}
+		if !added {
+			continue
+		}
+
+		pageids, err := queryTxIds(tx, fmt.Sprintf("SELECT page_id FROM %s", pagetbl))
+		if err != nil {
+			return err
+		}
+		for _, pageid := range pageids {
+			var p Page
+			s := fmt.Sprintf("SELECT body FROM %s WHERE page_id = ?", pagetbl)
+			err := tx.QueryRow(s, pageid).Scan(&p.Body)
+			if err != nil {
+				return err
+			}
+			setPageMeta(&p)
+			s = fmt.Sprintf("UPDATE %s SET summary = ?, layout = ? WHERE page_id = ?", pagetbl)
+			_, err = txexec(tx, s, p.Summary, p.Layout, pageid)
+			if err != nil {
+				return err
+			}
+		}
+		err = migratePageLinks(tx, siteid)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
-func fileUrl(sitename, filename string) string {
-	if sitename == "" && filename == "" {
-		return "/"
+
+// Trashed sites, pages and files keep their ids, so ids must never be
+// reused. Older databases have plain INTEGER PRIMARY KEY ids which reuse
+// the highest id after it's deleted.
+func migrateAutoincrement(tx *sql.Tx) error {
+	err := migrateAutoincrementTable(tx, "site", "site_id", "sitetrash")
+	if err != nil {
+		return err
 	}
-	if filename == "" {
-		return fmt.Sprintf("/%s", escape(sitename))
+	siteids, err := migrateSiteIds(tx)
+	if err != nil {
+		return err
+	}
+	for _, siteid := range siteids {
+		err := migrateAutoincrementTable(tx, pagetblName(siteid), "page_id", pagetrashtblName(siteid))
+		if err != nil {
+			return err
+		}
+		err = migrateAutoincrementTable(tx, filetblName(siteid), "file_id", filetrashtblName(siteid))
+		if err != nil {
+			return err
+		}
 	}
-	return fmt.Sprintf("/%s/~file/%s", escape(sitename), escape(filename))
+	return nil
 }
 
-func getLoginUser(r *http.Request, db *sql.DB) *User {
-	c, err := r.Cookie("userid")
-	if err != nil {
+// Rebuild table with an AUTOINCREMENT id column, and start the id
+// sequence after the ids in the table's trash.
+func migrateAutoincrementTable(tx *sql.Tx, table, idcol, trashtbl string) error {
+	var createsql string
+	err := tx.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&createsql)
+	if err == sql.ErrNoRows {
 		return nil
 	}
-	userid := idtoi(c.Value)
-	if userid == 0 {
+	if err != nil {
+		return err
+	}
+	if strings.Contains(strings.ToUpper(createsql), "AUTOINCREMENT") {
 		return nil
 	}
-	return queryUserById(db, userid)
-}
 
-func validateLogin(w http.ResponseWriter, login *User) bool {
-	if login.Userid == -1 {
-		http.Error(w, "Not logged in.", 401)
-		return false
+	pk := idcol + " INTEGER PRIMARY KEY"
+	i := strings.Index(createsql, "(")
+	if i == -1 || !strings.Contains(createsql, pk) {
+		return fmt.Errorf("table %s has no %s primary key", table, idcol)
 	}
-	if !login.Active {
-		http.Error(w, "Not an active user.", 401)
-		return false
+	newtbl := table + "_autoinc"
+	createsql = fmt.Sprintf("CREATE TABLE %s %s", newtbl, strings.Replace(createsql[i:], pk, pk+" AUTOINCREMENT", 1))
+	ss := []string{
+		createsql,
+		fmt.Sprintf("INSERT INTO %s SELECT * FROM %s", newtbl, table),
+		fmt.Sprintf("DROP TABLE %s", table),
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", newtbl, table),
 	}
-	return true
-}
-func handleDbErr(w http.ResponseWriter, err error, sfunc string) bool {
-	if err == sql.ErrNoRows {
-		http.Error(w, "Not found.", 404)
-		return true
+	for _, s := range ss {
+		_, err := txexec(tx, s)
+		if err != nil {
+			return err
+		}
 	}
-	if err != nil {
-		log.Printf("%s: database error (%s)\n", sfunc, err)
-		http.Error(w, "Server database error.", 500)
-		return true
+
+	exists, err := tableExists(tx, trashtbl)
+	if err != nil || !exists {
+		return err
 	}
-	return false
-}
-func handleTxErr(tx *sql.Tx, err error) bool {
+	var maxid sql.NullInt64
+	s := fmt.Sprintf("SELECT MAX(%s) FROM (SELECT %s FROM %s UNION SELECT %s FROM %s)", idcol, idcol, table, idcol, trashtbl)
+	err = tx.QueryRow(s).Scan(&maxid)
+	if err != nil || !maxid.Valid {
+		return err
+	}
+	_, err = txexec(tx, "DELETE FROM sqlite_sequence WHERE name = ?", table)
 	if err != nil {
-		tx.Rollback()
-		return true
+		return err
 	}
-	return false
-}
-func parseMarkdown(s string) string {
-	s = strings.ReplaceAll(s, "%", "%%")
-	return string(github_flavored_markdown.Markdown([]byte(s)))
-}
-func normalizeText(s string) string {
-	s = strings.ReplaceAll(s, "\r", "") // CRLF => CR
-	return s
+	_, err = txexec(tx, "INSERT INTO sqlite_sequence (name, seq) VALUES (?, ?)", table, maxid.Int64)
+	return err
 }
 
-//*** Html menu template functions ***
-func printSectionMenuHead(P PrintFunc, site *Site, login *User) {
-	P("<section class=\"col-menu flex flex-col text-xs px-4\">\n")
-	P("  <div class=\"flex flex-col mb-4\">\n")
-	P("    <p class=\"italic\">\n")
-	P("      <a class=\"\" href=\"/\">Home</a>\n")
-	if site != nil {
-		P("      &gt; <a class=\"\" href=\"/%s\">%s</a>\n", escape(site.Sitename), site.Sitename)
+func main() {
+	os.Args = os.Args[1:]
+	sw, parms := parseArgs(os.Args)
+
+	// [-i new_file]  Create and initialize db file
+	if sw["i"] != "" {
+		dbfile := sw["i"]
+		if fileExists(dbfile) {
+			s := fmt.Sprintf("File '%s' already exists. Can't initialize it.\n", dbfile)
+			fmt.Print(s)
+			os.Exit(1)
+		}
+		createTables(dbfile)
+		os.Exit(0)
 	}
-	P("    </p>\n")
 
-	P("    <div class=\"\">\n")
-	if login != nil {
-		P("      <a class=\"pill mr-1\" href=\"#\">%s</a>\n", login.Username)
-		P("      <a class=\"text-blue-900\" href=\"/logout\">logout</a>\n")
-	} else {
-		P("      <a class=\"text-blue-900\" href=\"/login\">login</a>\n")
+	// [-maxupload MB]  Max size of a single upload
+	if sw["maxupload"] != "" {
+		_maxUploadSize = int64(atoi(sw["maxupload"])) * 1024 * 1024
 	}
-	P("    </div>\n")
-	P("  </div>\n")
-}
-func printSectionMenuFoot(P PrintFunc) {
-	P("  </section>\n")
-}
-func printMenuHead(P PrintFunc, title string) {
-	P("<ul class=\"list-none mb-2\">\n")
-	if title != "" {
-		P("  <li><p class=\"border-b mb-1\">%s</p></li>\n", title)
+	// [-maxrequest MB]  Max size of all files uploaded together
+	if sw["maxrequest"] != "" {
+		_maxUploadRequest = int64(atoi(sw["maxrequest"])) * 1024 * 1024
+	}
+	if _maxUploadRequest < _maxUploadSize {
+		_maxUploadRequest = _maxUploadSize
+	}
+	// [-quota MB]  Default storage quota of each site
+	if sw["quota"] != "" {
+		_defaultSiteQuota = int64(atoi(sw["quota"])) * 1024 * 1024
 	}
-}
-func printMenuFoot(P PrintFunc) {
-	P("</ul>\n")
-}
-func printMenuLine(P PrintFunc, href, text string) {
-	P("  <li><a class=\"text-blue-900\" href=\"%s\">%s</a></li>\n", href, text)
-}
-func printMenuText(P PrintFunc, text string) {
-	P("  <li>%s</li>\n", text)
-}
 
-//*** Html form template functions ***
-func printFormHead(P PrintFunc, action string) {
-	P("<form class=\"max-w-2xl\" method=\"post\" action=\"%s\">\n", action)
+	// [-trashdays days]  Days to keep deleted items in trash
+	if sw["trashdays"] != "" {
+		_trashRetention = time.Duration(atoi(sw["trashdays"])) * 24 * time.Hour
+	}
+
+	// [-templates dir]  Read html templates from dir instead of the built-in ones
+	err := loadTemplates(sw["templates"])
+	if err != nil {
+		fmt.Printf("Error loading templates (%s)\n", err)
+		os.Exit(1)
+	}
+
+	// [-host hostname]  Main host serving sites without a custom domain
+	if sw["host"] != "" {
+		_mainHost = cleanDomain(sw["host"])
+	}
+
+	// Need to specify a db file as first parameter.
+	if len(parms) == 0 {
+		s := `Usage:
+
+Start webservice using database file:
+	t2 [-maxupload <MB>] [-maxrequest <MB>] [-quota <MB>] [-trashdays <days>] [-host <hostname>] [-templates <dir>] <sites.db>
+
+	-maxupload  max size of a single upload (default 32 MB)
+	-maxrequest max size of all files uploaded together (default 256 MB)
+	-quota      default storage quota per site (default 512 MB)
+	-trashdays  days to keep deleted items in trash (default 30)
+	-host       main host name, used to link back from sites on their own domain
+	-templates  directory of html templates to use instead of the built-in ones
+
+Initialize new database file:
+	t2 -i <sites.db>
+`
+		fmt.Print(s)
+		os.Exit(0)
+	}
+
+	// Exit if db file doesn't exist.
+	dbfile := parms[0]
+	if !fileExists(dbfile) {
+		s := fmt.Sprintf(`Sites database file '%s' doesn't exist. Create one using:
+	wb -i <notes.db>
+`, dbfile)
+		fmt.Print(s)
+		os.Exit(1)
+	}
+
+	db, err := sql.Open("sqlite3", dbfile)
+	if err != nil {
+		fmt.Printf("Error opening '%s' (%s)\n", dbfile, err)
+		os.Exit(1)
+	}
+
+	err = migrateDB(db)
+	if err != nil {
+		fmt.Printf("Error updating database '%s' (%s)\n", dbfile, err)
+		os.Exit(1)
+	}
+
+	err = loadSiteDomains(db)
+	if err != nil {
+		fmt.Printf("Error reading site domains (%s)\n", err)
+		os.Exit(1)
+	}
+
+	go purgeTrashLoop(db)
+
+	http.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) { http.ServeFile(w, r, "./static/coffee.ico") })
+	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))))
+	http.HandleFunc("/", indexHandler(db))
+	http.HandleFunc("/createsite/", createsiteHandler(db))
+	http.HandleFunc("/clonesite/", createsiteHandler(db))
+	http.HandleFunc("/editsite/", editsiteHandler(db))
+	http.HandleFunc("/delsite/", delsiteHandler(db))
+	http.HandleFunc("/createpage/", createpageHandler(db))
+	http.HandleFunc("/editpage/", editpageHandler(db))
+	http.HandleFunc("/delpage/", delpageHandler(db))
+	http.HandleFunc("/movepage/", movepageHandler(db))
+	http.HandleFunc("/uploadfile/", uploadfileHandler(db))
+	http.HandleFunc("/delfile/", delfileHandler(db))
+	http.HandleFunc("/filehistory/", filehistoryHandler(db))
+	http.HandleFunc("/renamefile/", renamefileHandler(db))
+	http.HandleFunc("/editfile/", editfileHandler(db))
+	http.HandleFunc("/trash/", trashHandler(db))
+	http.HandleFunc("/sitecss/", sitecssHandler(db))
+
+	port := "8000"
+	fmt.Printf("Listening on %s...\n", port)
+	err = http.ListenAndServe(fmt.Sprintf(":%s", port), nil)
+	log.Fatal(err)
 }
-func printFormHeadMultipart(P PrintFunc, action string) {
-	P("<form class=\"max-w-2xl\" method=\"post\" action=\"%s\" enctype=\"multipart/form-data\">\n", action)
+
+//*** DB functions ***
+func sqlstmt(db *sql.DB, s string) *sql.Stmt {
+	stmt, err := db.Prepare(s)
+	if err != nil {
+		log.Fatalf("db.Prepare() sql: '%s'\nerror: '%s'", s, err)
+	}
+	return stmt
 }
-func printFormFoot(P PrintFunc) {
-	P("</form>\n")
+func sqlexec(db *sql.DB, s string, pp ...interface{}) (sql.Result, error) {
+	stmt := sqlstmt(db, s)
+	defer stmt.Close()
+	return stmt.Exec(pp...)
 }
-func printFormTitle(P PrintFunc, title string) {
-	//P("<h1 class=\"border-b border-gray-500 pb-1 mb-4\">%s</h1>\n", title)
-	P("<h1 class=\"font-bold mb-4\">%s</h1>\n", title)
+func txstmt(tx *sql.Tx, s string) *sql.Stmt {
+	stmt, err := tx.Prepare(s)
+	if err != nil {
+		log.Fatalf("tx.Prepare() sql: '%s'\nerror: '%s'", s, err)
+	}
+	return stmt
 }
-func printFormControlHead(P PrintFunc) {
-	P("<div class=\"mb-2\">\n")
+func txexec(tx *sql.Tx, s string, pp ...interface{}) (sql.Result, error) {
+	stmt := txstmt(tx, s)
+	defer stmt.Close()
+	return stmt.Exec(pp...)
 }
-func printFormControlHeadFlexBetween(P PrintFunc) {
-	P("<div class=\"flex flex-row justify-between mb-2\">\n")
+
+func queryUserById(db *sql.DB, userid int64) *User {
+	var u User
+	s := "SELECT user_id, username, active, email FROM user WHERE user_id = ?"
+	row := db.QueryRow(s, userid)
+	err := row.Scan(&u.Userid, &u.Username, &u.Active, &u.Email)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		fmt.Printf("queryUser() db error (%s)\n", err)
+		return nil
+	}
+	return &u
 }
-func printFormControlFoot(P PrintFunc) {
-	P("</div>\n")
+func querySiteById(db *sql.DB, siteid int64) *Site {
+	var site Site
+	s := "SELECT site_id, sitename, desc, quota, istemplate, theme, css, header, footer, nav, navonly, toc, iframehosts FROM site WHERE site_id = ?"
+	row := db.QueryRow(s, siteid)
+	err := row.Scan(&site.Siteid, &site.Sitename, &site.Desc, &site.Quota, &site.Istemplate, &site.Theme, &site.Css, &site.Header, &site.Footer, &site.Nav, &site.Navonly, &site.Toc, &site.Iframehosts)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		fmt.Printf("querySiteById() db error (%s)\n", err)
+		return nil
+	}
+	return &site
 }
-func printFormLabel(P PrintFunc, sfor, lbl string) {
-	P("<label class=\"lbl\" for=\"%s\">%s</label>\n", sfor, lbl)
+func querySiteBySitename(db *sql.DB, sitename string) *Site {
+	var site Site
+	s := "SELECT site_id, sitename, desc, quota, istemplate, theme, css, header, footer, nav, navonly, toc, iframehosts FROM site WHERE sitename = ?"
+	row := db.QueryRow(s, sitename)
+	err := row.Scan(&site.Siteid, &site.Sitename, &site.Desc, &site.Quota, &site.Istemplate, &site.Theme, &site.Css, &site.Header, &site.Footer, &site.Nav, &site.Navonly, &site.Toc, &site.Iframehosts)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		fmt.Printf("querySiteBySitename() db error (%s)\n", err)
+		return nil
+	}
+	return &site
 }
-func printFormInput(P PrintFunc, sid, val string, size int) {
-	P("<input class=\"input w-full\" id=\"%s\" name=\"%s\" type=\"text\" size=\"%d\" value=\"%s\">\n", sid, sid, size, val)
+
+// Look up site by a previous sitename it was renamed from.
+func querySiteByAlias(db *sql.DB, alias string) *Site {
+	var site Site
+	s := "SELECT site.site_id, sitename, desc, quota, istemplate, theme, css, header, footer, nav, navonly, toc, iframehosts FROM sitealias INNER JOIN site ON sitealias.site_id = site.site_id WHERE alias = ?"
+	row := db.QueryRow(s, alias)
+	err := row.Scan(&site.Siteid, &site.Sitename, &site.Desc, &site.Quota, &site.Istemplate, &site.Theme, &site.Css, &site.Header, &site.Footer, &site.Nav, &site.Navonly, &site.Toc, &site.Iframehosts)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		fmt.Printf("querySiteByAlias() db error (%s)\n", err)
+		return nil
+	}
+	return &site
 }
-func printFormFile(P PrintFunc, sid string) {
-	P("<input class=\"input w-full\" id=\"%s\" name=\"%s\" type=\"file\">\n", sid, sid)
+func querySites(db *sql.DB, templatesOnly bool) ([]*Site, error) {
+	s := "SELECT site_id, sitename, desc, quota, istemplate, theme, css, header, footer, nav, navonly, toc, iframehosts FROM site WHERE istemplate = 1 OR ? = 0 ORDER BY sitename"
+	rows, err := db.Query(s, templatesOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sites := []*Site{}
+	for rows.Next() {
+		var site Site
+		err := rows.Scan(&site.Siteid, &site.Sitename, &site.Desc, &site.Quota, &site.Istemplate, &site.Theme, &site.Css, &site.Header, &site.Footer, &site.Nav, &site.Navonly, &site.Toc, &site.Iframehosts)
+		if err != nil {
+			return nil, err
+		}
+		sites = append(sites, &site)
+	}
+	return sites, rows.Err()
 }
-func printFormTextarea(P PrintFunc, sid, val string, rows int) {
-	P("<textarea class=\"input w-full\" id=\"%s\" name=\"%s\" rows=\"%d\">%s</textarea>\n", sid, sid, rows, val)
+func querySiteByDomain(db *sql.DB, domain string) *Site {
+	var site Site
+	s := "SELECT site.site_id, sitename, desc, quota, istemplate, theme, css, header, footer, nav, navonly, toc, iframehosts FROM site_domain INNER JOIN site ON site_domain.site_id = site.site_id WHERE domain = ?"
+	row := db.QueryRow(s, domain)
+	err := row.Scan(&site.Siteid, &site.Sitename, &site.Desc, &site.Quota, &site.Istemplate, &site.Theme, &site.Css, &site.Header, &site.Footer, &site.Nav, &site.Navonly, &site.Toc, &site.Iframehosts)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		fmt.Printf("querySiteByDomain() db error (%s)\n", err)
+		return nil
+	}
+	return &site
 }
-func printFormButton(P PrintFunc, sid, lbl, stype string) {
-	P("<button class=\"btn\" id=\"%s\" name=\"%s\" type=\"%s\">%s</button>\n", sid, sid, stype, lbl)
+func loadSiteDomains(db *sql.DB) error {
+	s := "SELECT domain, sitename FROM site_domain INNER JOIN site ON site_domain.site_id = site.site_id"
+	rows, err := db.Query(s)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	bySitename := map[string]string{}
+	byDomain := map[string]string{}
+	for rows.Next() {
+		var domain, sitename string
+		err := rows.Scan(&domain, &sitename)
+		if err != nil {
+			return err
+		}
+		bySitename[sitename] = domain
+		byDomain[domain] = sitename
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_siteDomains.Lock()
+	_siteDomains.bySitename = bySitename
+	_siteDomains.byDomain = byDomain
+	_siteDomains.Unlock()
+	return nil
 }
-func printFormSubmitButton(P PrintFunc, sid, lbl string) {
-	printFormButton(P, sid, lbl, "submit")
+func reloadSiteDomains(db *sql.DB) {
+	err := loadSiteDomains(db)
+	if err != nil {
+		log.Printf("reloadSiteDomains() db error (%s)\n", err)
+	}
 }
-func printFormControlError(P PrintFunc, errmsg string) {
-	if errmsg != "" {
-		printFormControlHead(P)
-		P("<p class=\"text-red-500 italic\">%s</p>\n", errmsg)
-		printFormControlFoot(P)
+func setSiteDomain(db *sql.DB, siteid int64, domain string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	s := "DELETE FROM site_domain WHERE site_id = ?"
+	_, err = txexec(tx, s, siteid)
+	if handleTxErr(tx, err) {
+		return err
+	}
+	if domain != "" {
+		// Take over the domain from any site in the trash.
+		s = "DELETE FROM site_domain WHERE domain = ?"
+		_, err = txexec(tx, s, domain)
+		if handleTxErr(tx, err) {
+			return err
+		}
+		s = "INSERT INTO site_domain (domain, site_id) VALUES (?, ?)"
+		_, err = txexec(tx, s, domain, siteid)
+		if handleTxErr(tx, err) {
+			return err
+		}
+	}
+	err = tx.Commit()
+	if handleTxErr(tx, err) {
+		return err
 	}
+	reloadSiteDomains(db)
+	return nil
 }
-func printFormControlInput(P PrintFunc, sid, lbl, val string, size int) {
-	printFormControlHead(P)
-	printFormLabel(P, sid, lbl)
-	printFormInput(P, sid, val, size)
-	printFormControlFoot(P)
+func pagetblName(siteid int64) string {
+	return fmt.Sprintf("pages_%d", siteid)
 }
-func printFormControlFile(P PrintFunc, sid, lbl string) {
-	printFormControlHead(P)
-	printFormLabel(P, sid, lbl)
-	printFormFile(P, sid)
-	printFormControlFoot(P)
+func filetblName(siteid int64) string {
+	return fmt.Sprintf("files_%d", siteid)
 }
-func printFormControlTextarea(P PrintFunc, sid, lbl, val string, rows int) {
-	printFormControlHead(P)
-	printFormLabel(P, sid, lbl)
-	printFormTextarea(P, sid, val, rows)
-	printFormControlFoot(P)
+func fileversiontblName(siteid int64) string {
+	return fmt.Sprintf("fileversions_%d", siteid)
 }
-func printFormControlButton(P PrintFunc, sid, lbl, stype string) {
-	printFormControlHead(P)
-	printFormButton(P, sid, lbl, stype)
-	printFormControlFoot(P)
+func linktblName(siteid int64) string {
+	return fmt.Sprintf("links_%d", siteid)
 }
-func printFormControlSubmitButton(P PrintFunc, sid, lbl string) {
-	printFormControlButton(P, sid, lbl, "submit")
+func pagetrashtblName(siteid int64) string {
+	return fmt.Sprintf("pagetrash_%d", siteid)
+}
+func filetrashtblName(siteid int64) string {
+	return fmt.Sprintf("filetrash_%d", siteid)
 }
 
-//*** Other html template functions ***
-func printHead(P PrintFunc, jsurls []string, cssurls []string, title string) {
-	P("<!DOCTYPE html>\n")
-	P("<html>\n")
-	P("<head>\n")
-	P("<meta charset=\"utf-8\">\n")
-	P("<meta name=\"viewport\" content=\"width=device-width, initial-scale=1\">\n")
-	P("<title>%s</title>\n", title)
-	P("<link rel=\"stylesheet\" type=\"text/css\" href=\"/static/style.css\">\n")
-	for _, cssurl := range cssurls {
-		P("<link rel=\"stylesheet\" type=\"text/css\" href=\"%s\">\n", cssurl)
+// Names of all of a site's tables.
+func sitetblNames(siteid int64) []string {
+	return []string{
+		pagetblName(siteid),
+		filetblName(siteid),
+		fileversiontblName(siteid),
+		linktblName(siteid),
+		pagetrashtblName(siteid),
+		filetrashtblName(siteid),
+		thumbtblName(siteid),
 	}
-	for _, jsurl := range jsurls {
-		P("<script src=\"%s\" defer></script>\n", jsurl)
-	}
-	P("</head>\n")
-	P("<body class=\"text-black bg-white text-sm\">\n")
-	P("  <section class=\"flex flex-row py-4 mx-auto\">\n")
-}
-func printFoot(P PrintFunc) {
-	P("  </section>\n")
-	P("</body>\n")
-	P("</html>\n")
-}
-func printSidebar(P PrintFunc, db *sql.DB) {
-	P("<section class=\"col-sidebar flex flex-col text-xs px-8\">\n")
-	printSitesMenu(P, db)
-	//printContentDiv(P, _loremipsum)
-	P("</section>\n")
 }
-func printFooter(P PrintFunc) {
-	P("<div class=\"footer flex flex-row justify-center text-xs p-1\">\n")
-	P("  <p class=\"\">Made with <a class=\"text-blue-900 underline\" href=\"https://github.com/robdelacruz/t2\">t2</a>.</p>\n")
-	P("</div>\n")
-}
-func printMainHead(P PrintFunc) {
-	P("<section class=\"col-content flex-grow flex flex-col px-8\">\n")
+func thumbtblName(siteid int64) string {
+	return fmt.Sprintf("thumbs_%d", siteid)
 }
-func printMainFoot(P PrintFunc) {
-	P("</section>\n")
+func queryPageById(db *sql.DB, siteid int64, pageid int64) *Page {
+	var p Page
+	pagetbl := pagetblName(siteid)
+	s := fmt.Sprintf("SELECT page_id, title, body, createdt, updatedt, summary, layout FROM %s WHERE page_id = ?", pagetbl)
+	row := db.QueryRow(s, pageid)
+	var createdt, updatedt string
+	err := row.Scan(&p.Pageid, &p.Title, &p.Body, &createdt, &updatedt, &p.Summary, &p.Layout)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		fmt.Printf("queryPageById() db error (%s)\n", err)
+		return nil
+	}
+	p.Createdt = parseIsoDate(createdt)
+	p.Updatedt = parseIsoDate(updatedt)
+	return &p
 }
-func printContentDiv(P PrintFunc, markup string) {
-	// Print html markup wrapped in a <div class="content"> container.
-	P("<div class=\"content\">\n")
-	P(markup)
-	P("</div>\n")
+
+// A site's page titles and aliases and its files' alt text, for looking
+// up the links in a page without a query per link.
+type SiteIndex struct {
+	Pages map[string]bool   // page titles and aliases
+	Files map[string]string // filename => alt text
 }
 
-func printPageNav(P PrintFunc, pageTitle string) {
-	if pageTitle == "" {
-		return
-	}
+func querySiteIndex(db *sql.DB, siteid int64) (*SiteIndex, error) {
+	idx := SiteIndex{Pages: map[string]bool{}, Files: map[string]string{}}
+	s := fmt.Sprintf("SELECT title FROM %s UNION SELECT target FROM %s WHERE kind = 'alias'", pagetblName(siteid), linktblName(siteid))
+	rows, err := db.Query(s)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var title string
+		err := rows.Scan(&title)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		idx.Pages[title] = true
+	}
+	rows.Close()
+
+	s = fmt.Sprintf("SELECT filename, alt FROM %s", filetblName(siteid))
+	rows, err = db.Query(s)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var filename, alt string
+		err := rows.Scan(&filename, &alt)
+		if err != nil {
+			return nil, err
+		}
+		idx.Files[filename] = alt
+	}
+	return &idx, rows.Err()
+}
+func queryPageByTitle(db *sql.DB, siteid int64, title string) *Page {
+	var p Page
+	pagetbl := pagetblName(siteid)
+	s := fmt.Sprintf("SELECT page_id, title, body, createdt, updatedt, summary, layout FROM %s WHERE title = ?", pagetbl)
+	row := db.QueryRow(s, title)
+	var createdt, updatedt string
+	err := row.Scan(&p.Pageid, &p.Title, &p.Body, &createdt, &updatedt, &p.Summary, &p.Layout)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		fmt.Printf("queryPageByTitle() db error (%s)\n", err)
+		return nil
+	}
+	p.Createdt = parseIsoDate(createdt)
+	p.Updatedt = parseIsoDate(updatedt)
+	return &p
+}
+
+// Page that has title as one of its front matter aliases.
+func queryPageByAlias(db *sql.DB, siteid int64, alias string) *Page {
+	var title string
+	s := fmt.Sprintf("SELECT p.title FROM %s l INNER JOIN %s p ON l.page_id = p.page_id WHERE l.kind = 'alias' AND l.target = ?", linktblName(siteid), pagetblName(siteid))
+	err := db.QueryRow(s, alias).Scan(&title)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		fmt.Printf("queryPageByAlias() db error (%s)\n", err)
+		return nil
+	}
+	return queryPageByTitle(db, siteid, title)
+}
+
+// Pages of a site without their bodies, ordered by "title" or "updatedt"
+// (most recent first). limit 0 returns all pages.
+func queryPages(db *sql.DB, siteid int64, orderby string, limit int) ([]*Page, error) {
+	sorder := "title"
+	if orderby == "updatedt" {
+		sorder = "updatedt DESC, title"
+	}
+	s := fmt.Sprintf("SELECT page_id, title, createdt, updatedt FROM %s ORDER BY %s", pagetblName(siteid), sorder)
+	if limit > 0 {
+		s += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	rows, err := db.Query(s)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pp := []*Page{}
+	for rows.Next() {
+		var p Page
+		var createdt, updatedt string
+		err := rows.Scan(&p.Pageid, &p.Title, &createdt, &updatedt)
+		if err != nil {
+			return nil, err
+		}
+		p.Createdt = parseIsoDate(createdt)
+		p.Updatedt = parseIsoDate(updatedt)
+		pp = append(pp, &p)
+	}
+	return pp, rows.Err()
+}
+func queryFiles(db *sql.DB, siteid int64) ([]*File, error) {
+	s := fmt.Sprintf("SELECT file_id, filename, length(bytes), content_type, updatedt FROM %s ORDER BY filename", filetblName(siteid))
+	rows, err := db.Query(s)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := []*File{}
+	for rows.Next() {
+		var file File
+		var updatedt string
+		err := rows.Scan(&file.Fileid, &file.Filename, &file.Size, &file.Ctype, &updatedt)
+		if err != nil {
+			return nil, err
+		}
+		file.Updatedt = parseIsoDate(updatedt)
+		files = append(files, &file)
+	}
+	return files, rows.Err()
+}
+
+// A tag and the number of pages that have it.
+type TagCount struct {
+	Tag   string
+	Count int
+}
+
+func querySiteTags(db *sql.DB, siteid int64) ([]TagCount, error) {
+	s := fmt.Sprintf("SELECT target, COUNT(DISTINCT page_id) FROM %s WHERE kind = 'tag' GROUP BY target ORDER BY target", linktblName(siteid))
+	rows, err := db.Query(s)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []TagCount{}
+	for rows.Next() {
+		var tc TagCount
+		err := rows.Scan(&tc.Tag, &tc.Count)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tc)
+	}
+	return tags, rows.Err()
+}
+
+// Tags of all sites take a query per site, so they're cached for a while.
+var _allTags = struct {
+	sync.Mutex
+	tags []TagCount
+	t    time.Time
+}{}
+
+const allTagsTTL = time.Minute
+
+// Tags of all sites, with page counts added up across sites.
+func queryAllTags(db *sql.DB) ([]TagCount, error) {
+	_allTags.Lock()
+	defer _allTags.Unlock()
+	if _allTags.tags != nil && time.Since(_allTags.t) < allTagsTTL {
+		return _allTags.tags, nil
+	}
+
+	sites, err := querySites(db, false)
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int{}
+	for _, site := range sites {
+		tags, err := querySiteTags(db, site.Siteid)
+		if err != nil {
+			return nil, err
+		}
+		for _, tc := range tags {
+			counts[tc.Tag] += tc.Count
+		}
+	}
+	tags := []TagCount{}
+	for tag, n := range counts {
+		tags = append(tags, TagCount{tag, n})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Tag < tags[j].Tag
+	})
+	_allTags.tags, _allTags.t = tags, time.Now()
+	return tags, nil
+}
+
+// Tags of a page, in order.
+func queryPageTags(db *sql.DB, siteid int64, pageid int64) ([]string, error) {
+	s := fmt.Sprintf("SELECT DISTINCT target FROM %s WHERE page_id = ? AND kind = 'tag' ORDER BY target", linktblName(siteid))
+	rows, err := db.Query(s, pageid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []string{}
+	for rows.Next() {
+		var tag string
+		err := rows.Scan(&tag)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// Pages whose title or body contains q and that have tag, ordered by title.
+// An empty q or tag matches all pages.
+func searchPages(db *sql.DB, siteid int64, q, tag string) ([]*Page, error) {
+	var args []interface{}
+	s := fmt.Sprintf("SELECT page_id, title, summary, updatedt FROM %s WHERE 1 = 1", pagetblName(siteid))
+	if q != "" {
+		like := "%" + likeEscaper.Replace(q) + "%"
+		s += " AND (title LIKE ? ESCAPE '\\' OR body LIKE ? ESCAPE '\\')"
+		args = append(args, like, like)
+	}
+	if tag != "" {
+		s += fmt.Sprintf(" AND page_id IN (SELECT page_id FROM %s WHERE kind = 'tag' AND target = ?)", linktblName(siteid))
+		args = append(args, tag)
+	}
+	s += " ORDER BY title"
+	rows, err := db.Query(s, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pp := []*Page{}
+	for rows.Next() {
+		var p Page
+		var updatedt string
+		err := rows.Scan(&p.Pageid, &p.Title, &p.Summary, &updatedt)
+		if err != nil {
+			return nil, err
+		}
+		p.Updatedt = parseIsoDate(updatedt)
+		pp = append(pp, &p)
+	}
+	return pp, rows.Err()
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func queryFileByFilename(db *sql.DB, siteid int64, filename string) *File {
+	var file File
+	filetbl := filetblName(siteid)
+	s := fmt.Sprintf("SELECT filename, bytes FROM %s WHERE filename = ?", filetbl)
+	row := db.QueryRow(s, filename)
+	err := row.Scan(&file.Filename, &file.Bytes)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		fmt.Printf("queryFileByFilename() db error (%s)\n", err)
+		return nil
+	}
+	return &file
+}
+func queryFileInfoByFilename(db *sql.DB, siteid int64, filename string) *File {
+	// Same as queryFileByFilename() but without reading the file contents.
+	var file File
+	var createdt, updatedt string
+	filetbl := filetblName(siteid)
+	s := fmt.Sprintf("SELECT file_id, filename, length(bytes), hash, content_type, user_id, desc, alt, createdt, updatedt FROM %s WHERE filename = ?", filetbl)
+	row := db.QueryRow(s, filename)
+	err := row.Scan(&file.Fileid, &file.Filename, &file.Size, &file.Hash, &file.Ctype, &file.Userid, &file.Desc, &file.Alt, &createdt, &updatedt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		fmt.Printf("queryFileInfoByFilename() db error (%s)\n", err)
+		return nil
+	}
+	file.Createdt = parseIsoDate(createdt)
+	file.Updatedt = parseIsoDate(updatedt)
+	return &file
+}
+func queryFileInfoById(db *sql.DB, siteid int64, fileid int64) *File {
+	var file File
+	var createdt, updatedt string
+	filetbl := filetblName(siteid)
+	s := fmt.Sprintf("SELECT file_id, filename, length(bytes), hash, content_type, user_id, desc, alt, createdt, updatedt FROM %s WHERE file_id = ?", filetbl)
+	row := db.QueryRow(s, fileid)
+	err := row.Scan(&file.Fileid, &file.Filename, &file.Size, &file.Hash, &file.Ctype, &file.Userid, &file.Desc, &file.Alt, &createdt, &updatedt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		fmt.Printf("queryFileInfoById() db error (%s)\n", err)
+		return nil
+	}
+	file.Createdt = parseIsoDate(createdt)
+	file.Updatedt = parseIsoDate(updatedt)
+	return &file
+}
+func queryFileVersion(db *sql.DB, siteid int64, versionid int64) *FileVersion {
+	var fv FileVersion
+	var updatedt string
+	s := fmt.Sprintf("SELECT v.version_id, v.file_id, length(v.bytes), v.hash, v.content_type, v.user_id, IFNULL(u.username, ''), v.updatedt FROM %s v LEFT OUTER JOIN user u ON v.user_id = u.user_id WHERE v.version_id = ?", fileversiontblName(siteid))
+	row := db.QueryRow(s, versionid)
+	err := row.Scan(&fv.Versionid, &fv.Fileid, &fv.Size, &fv.Hash, &fv.Ctype, &fv.Userid, &fv.Username, &updatedt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		fmt.Printf("queryFileVersion() db error (%s)\n", err)
+		return nil
+	}
+	fv.Updatedt = parseIsoDate(updatedt)
+	return &fv
+}
+func queryFileVersions(db *sql.DB, siteid int64, fileid int64) ([]*FileVersion, error) {
+	s := fmt.Sprintf("SELECT v.version_id, v.file_id, length(v.bytes), v.hash, v.content_type, v.user_id, IFNULL(u.username, ''), v.updatedt FROM %s v LEFT OUTER JOIN user u ON v.user_id = u.user_id WHERE v.file_id = ? ORDER BY v.version_id DESC", fileversiontblName(siteid))
+	rows, err := db.Query(s, fileid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fvs := []*FileVersion{}
+	for rows.Next() {
+		var fv FileVersion
+		var updatedt string
+		err := rows.Scan(&fv.Versionid, &fv.Fileid, &fv.Size, &fv.Hash, &fv.Ctype, &fv.Userid, &fv.Username, &updatedt)
+		if err != nil {
+			return nil, err
+		}
+		fv.Updatedt = parseIsoDate(updatedt)
+		fvs = append(fvs, &fv)
+	}
+	return fvs, rows.Err()
+}
+func querySiteUsage(db *sql.DB, siteid int64) int64 {
+	var usage int64
+	err := db.QueryRow(siteUsageSql(siteid)).Scan(&usage)
+	if err != nil {
+		fmt.Printf("querySiteUsage() db error (%s)\n", err)
+		return 0
+	}
+	return usage
+}
+func querySiteUsageTx(tx *sql.Tx, siteid int64) (int64, error) {
+	var usage int64
+	err := tx.QueryRow(siteUsageSql(siteid)).Scan(&usage)
+	return usage, err
+}
+func siteUsageSql(siteid int64) string {
+	// Previous versions of files, files in the trash and cached thumbs
+	// count towards storage used.
+	s := "SELECT 0"
+	for _, tbl := range []string{filetblName(siteid), fileversiontblName(siteid), filetrashtblName(siteid), thumbtblName(siteid)} {
+		s += fmt.Sprintf(" + (SELECT IFNULL(SUM(length(bytes)), 0) FROM %s)", tbl)
+	}
+	return s
+}
+func siteQuota(site *Site) int64 {
+	if site.Quota > 0 {
+		return site.Quota
+	}
+	return _defaultSiteQuota
+}
+func createSite(db *sql.DB, site *Site) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	_, err = createSiteTx(tx, site)
+	if handleTxErr(tx, err) {
+		return 0, err
+	}
+	err = tx.Commit()
+	if handleTxErr(tx, err) {
+		return 0, err
+	}
+	return site.Siteid, nil
+}
+
+// Update site settings. If the sitename changed, the old sitename is kept as
+// an alias so that existing links to it can be redirected.
+func updateSite(db *sql.DB, site *Site, oldsitename string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	s := "UPDATE site SET sitename = ?, desc = ?, quota = ?, istemplate = ?, theme = ?, css = ?, header = ?, footer = ?, nav = ?, navonly = ?, toc = ?, iframehosts = ? WHERE site_id = ?"
+	_, err = txexec(tx, s, site.Sitename, site.Desc, site.Quota, site.Istemplate, site.Theme, site.Css, site.Header, site.Footer, site.Nav, site.Navonly, site.Toc, site.Iframehosts, site.Siteid)
+	if handleTxErr(tx, err) {
+		return err
+	}
+	if site.Sitename != oldsitename {
+		s = "DELETE FROM sitealias WHERE alias = ?"
+		_, err = txexec(tx, s, site.Sitename)
+		if handleTxErr(tx, err) {
+			return err
+		}
+		s = "INSERT OR REPLACE INTO sitealias (alias, site_id) VALUES (?, ?)"
+		_, err = txexec(tx, s, oldsitename, site.Siteid)
+		if handleTxErr(tx, err) {
+			return err
+		}
+	}
+	err = tx.Commit()
+	if handleTxErr(tx, err) {
+		return err
+	}
+	reloadSiteDomains(db)
+	return nil
+}
+
+// Create new site with a copy of all of srcsite's pages and files.
+func cloneSite(db *sql.DB, srcsite *Site, site *Site) (int64, error) {
+	site.Theme = srcsite.Theme
+	site.Css = srcsite.Css
+	site.Header = srcsite.Header
+	site.Footer = srcsite.Footer
+	site.Nav = srcsite.Nav
+	site.Navonly = srcsite.Navonly
+	site.Toc = srcsite.Toc
+	site.Iframehosts = srcsite.Iframehosts
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	_, err = createSiteTx(tx, site)
+	if handleTxErr(tx, err) {
+		return 0, err
+	}
+
+	ss := []string{
+		fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s", pagetblName(site.Siteid), pageCols, pageCols, pagetblName(srcsite.Siteid)),
+		fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s", filetblName(site.Siteid), fileCols, fileCols, filetblName(srcsite.Siteid)),
+		fmt.Sprintf("INSERT INTO %s (page_id, kind, target) SELECT page_id, kind, target FROM %s", linktblName(site.Siteid), linktblName(srcsite.Siteid)),
+	}
+	for _, s := range ss {
+		_, err = txexec(tx, s)
+		if handleTxErr(tx, err) {
+			return 0, err
+		}
+	}
+
+	// Only the current version of each file is copied.
+	var usage int64
+	s := fmt.Sprintf("SELECT IFNULL(SUM(length(bytes)), 0) FROM %s", filetblName(site.Siteid))
+	err = tx.QueryRow(s).Scan(&usage)
+	if handleTxErr(tx, err) {
+		return 0, err
+	}
+	if usage > siteQuota(site) {
+		tx.Rollback()
+		return 0, errQuotaExceeded
+	}
+
+	err = tx.Commit()
+	if handleTxErr(tx, err) {
+		return 0, err
+	}
+	return site.Siteid, nil
+}
+
+func createSiteTx(tx *sql.Tx, site *Site) (int64, error) {
+	s := "INSERT INTO site (sitename, desc, theme, css, header, footer, nav, navonly, toc, iframehosts) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	result, err := txexec(tx, s, site.Sitename, site.Desc, site.Theme, site.Css, site.Header, site.Footer, site.Nav, site.Navonly, site.Toc, site.Iframehosts)
+	if err != nil {
+		return 0, err
+	}
+	site.Siteid, err = result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	// A new site takes over any old sitename alias of the same name.
+	s = "DELETE FROM sitealias WHERE alias = ?"
+	_, err = txexec(tx, s, site.Sitename)
+	if err != nil {
+		return 0, err
+	}
+
+	pagetbl := pagetblName(site.Siteid)
+	s = fmt.Sprintf("CREATE TABLE %s (page_id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL, title TEXT UNIQUE, body TEXT, createdt TEXT NOT NULL DEFAULT '', updatedt TEXT NOT NULL DEFAULT '', summary TEXT NOT NULL DEFAULT '', layout TEXT NOT NULL DEFAULT '')", pagetbl)
+	_, err = txexec(tx, s)
+	if err != nil {
+		return 0, err
+	}
+
+	filetbl := filetblName(site.Siteid)
+	s = fmt.Sprintf("CREATE TABLE %s (file_id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL, filename TEXT UNIQUE, bytes BLOB, hash TEXT NOT NULL DEFAULT '', content_type TEXT NOT NULL DEFAULT '', user_id INTEGER NOT NULL DEFAULT 0, desc TEXT NOT NULL DEFAULT '', alt TEXT NOT NULL DEFAULT '', createdt TEXT NOT NULL DEFAULT '', updatedt TEXT NOT NULL DEFAULT '')", filetbl)
+	_, err = txexec(tx, s)
+	if err != nil {
+		return 0, err
+	}
+
+	// Previous contents of replaced files.
+	fileversiontbl := fileversiontblName(site.Siteid)
+	s = fmt.Sprintf("CREATE TABLE %s (version_id INTEGER PRIMARY KEY NOT NULL, file_id INTEGER NOT NULL, bytes BLOB, hash TEXT NOT NULL DEFAULT '', content_type TEXT NOT NULL DEFAULT '', user_id INTEGER NOT NULL DEFAULT 0, updatedt TEXT NOT NULL DEFAULT '')", fileversiontbl)
+	_, err = txexec(tx, s)
+	if err != nil {
+		return 0, err
+	}
+
+	// Pages and files that each page links to, for finding pages that
+	// use a file. Also holds the tags and aliases from each page's
+	// front matter.
+	linktbl := linktblName(site.Siteid)
+	s = fmt.Sprintf("CREATE TABLE %s (page_id INTEGER NOT NULL, kind TEXT NOT NULL, target TEXT NOT NULL)", linktbl)
+	_, err = txexec(tx, s)
+	if err != nil {
+		return 0, err
+	}
+	s = fmt.Sprintf("CREATE INDEX %s_target ON %s (kind, target)", linktbl, linktbl)
+	_, err = txexec(tx, s)
+	if err != nil {
+		return 0, err
+	}
+
+	// Deleted pages and files, with when and by whom they were deleted.
+	pagetrashtbl := pagetrashtblName(site.Siteid)
+	s = fmt.Sprintf("CREATE TABLE %s (page_id INTEGER PRIMARY KEY NOT NULL, title TEXT, body TEXT, createdt TEXT NOT NULL DEFAULT '', updatedt TEXT NOT NULL DEFAULT '', summary TEXT NOT NULL DEFAULT '', layout TEXT NOT NULL DEFAULT '', trashdt TEXT NOT NULL, trashed_by INTEGER NOT NULL)", pagetrashtbl)
+	_, err = txexec(tx, s)
+	if err != nil {
+		return 0, err
+	}
+	filetrashtbl := filetrashtblName(site.Siteid)
+	s = fmt.Sprintf("CREATE TABLE %s (file_id INTEGER PRIMARY KEY NOT NULL, filename TEXT, bytes BLOB, hash TEXT NOT NULL DEFAULT '', content_type TEXT NOT NULL DEFAULT '', user_id INTEGER NOT NULL DEFAULT 0, desc TEXT NOT NULL DEFAULT '', alt TEXT NOT NULL DEFAULT '', createdt TEXT NOT NULL DEFAULT '', updatedt TEXT NOT NULL DEFAULT '', trashdt TEXT NOT NULL, trashed_by INTEGER NOT NULL)", filetrashtbl)
+	_, err = txexec(tx, s)
+	if err != nil {
+		return 0, err
+	}
+
+	// Cached resized images, keyed by file contents hash and width.
+	thumbtbl := thumbtblName(site.Siteid)
+	s = fmt.Sprintf("CREATE TABLE %s (hash TEXT NOT NULL, width INTEGER NOT NULL, bytes BLOB, content_type TEXT NOT NULL DEFAULT '', PRIMARY KEY (hash, width))", thumbtbl)
+	_, err = txexec(tx, s)
+	if err != nil {
+		return 0, err
+	}
+
+	return site.Siteid, nil
+}
+func createPage(db *sql.DB, site *Site, p *Page) (int64, error) {
+	setPageMeta(p)
+	now := isodate(time.Now())
+	s := fmt.Sprintf("INSERT INTO %s (title, body, createdt, updatedt, summary, layout) VALUES (?, ?, ?, ?, ?, ?)", pagetblName(site.Siteid))
+	result, err := sqlexec(db, s, p.Title, p.Body, now, now, p.Summary, p.Layout)
+	if err != nil {
+		return 0, err
+	}
+	pageid, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	err = updatePageLinks(db, site.Siteid, pageid, p.Body)
+	if err != nil {
+		return 0, err
+	}
+	return pageid, nil
+}
+func updatePage(db *sql.DB, site *Site, p *Page) error {
+	setPageMeta(p)
+	s := fmt.Sprintf("UPDATE %s SET title = ?, body = ?, updatedt = ?, summary = ?, layout = ? WHERE page_id = ?", pagetblName(site.Siteid))
+	_, err := sqlexec(db, s, p.Title, p.Body, isodate(time.Now()), p.Summary, p.Layout, p.Pageid)
+	if err != nil {
+		return err
+	}
+	return updatePageLinks(db, site.Siteid, p.Pageid, p.Body)
+}
+
+// Titles containing '/' are child pages of the title before the last '/',
+// so each part of the title must be non-empty. Returns an error message if
+// title can't be used, or "" if it's valid.
+func validateTitle(title string) string {
+	ss := strings.Split(title, "/")
+	for _, s := range ss {
+		if strings.TrimSpace(s) == "" {
+			return "Page titles can't start or end with '/' or contain '//'."
+		}
+	}
+	for _, s := range ss {
+		if strings.HasPrefix(strings.TrimSpace(s), "~") {
+			return "Page titles can't start with '~' or contain '/~', those urls are for special pages."
+		}
+	}
+	if listContains(_reservedPaths, ss[0]) {
+		return fmt.Sprintf("Page titles can't start with '%s', it's reserved for site urls.", ss[0])
+	}
+	return ""
+}
+
+// Top level url paths handled by t2 itself. A site on a custom domain has
+// its pages at "/<title>", so page titles can't start with these.
+var _reservedPaths = []string{"favicon.ico", "static", "login", "createsite", "clonesite", "editsite", "delsite", "createpage", "editpage", "delpage", "movepage", "uploadfile", "delfile", "filehistory", "renamefile", "editfile", "trash", "sitecss"}
+
+// Page metadata in a yaml block at the start of the body:
+//
+//	---
+//	tags: [go, databases]
+//	aliases: [Old Title]
+//	summary: One line description for lists and search.
+//	layout: wide
+//	---
+type FrontMatter struct {
+	Tags    stringList `yaml:"tags"`
+	Aliases stringList `yaml:"aliases"`
+	Summary string     `yaml:"summary"`
+	Layout  string     `yaml:"layout"`
+}
+
+// A yaml list of strings that can also be written as "a, b, c".
+type stringList []string
+
+func (sl *stringList) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*sl = nil
+		for _, s := range strings.Split(node.Value, ",") {
+			s = strings.TrimSpace(s)
+			if s != "" {
+				*sl = append(*sl, s)
+			}
+		}
+		return nil
+	}
+	var ss []string
+	err := node.Decode(&ss)
+	if err != nil {
+		return err
+	}
+	*sl = nil
+	for _, s := range ss {
+		s = strings.TrimSpace(s)
+		if s != "" {
+			*sl = append(*sl, s)
+		}
+	}
+	return nil
+}
+
+var frontMatterRe = regexp.MustCompile(`(?s)^---[ \t]*\n(.*?\n)?---[ \t]*(?:\n|$)`)
+
+// Split the front matter from the rest of a page body. A body without
+// front matter returns an empty FrontMatter and the whole body.
+func parseFrontMatter(body string) (FrontMatter, string, error) {
+	var fm FrontMatter
+	loc := frontMatterRe.FindStringSubmatchIndex(body)
+	if loc == nil {
+		return fm, body, nil
+	}
+	rest := body[loc[1]:]
+	if loc[2] == -1 {
+		return fm, rest, nil
+	}
+	err := yaml.Unmarshal([]byte(body[loc[2]:loc[3]]), &fm)
+	if err != nil {
+		return FrontMatter{}, rest, err
+	}
+	fm.Summary = strings.TrimSpace(fm.Summary)
+	fm.Layout = strings.TrimSpace(fm.Layout)
+	return fm, rest, nil
+}
+
+// Add alias to the aliases in a page body's front matter, adding front
+// matter if the body has none.
+func addPageAlias(body, alias string) (string, error) {
+	fm, rest, err := parseFrontMatter(body)
+	if err != nil {
+		return body, err
+	}
+	if listContains(fm.Aliases, alias) {
+		return body, nil
+	}
+
+	// Edit the yaml nodes to keep the other front matter keys as they are.
+	var doc yaml.Node
+	if loc := frontMatterRe.FindStringSubmatchIndex(body); loc != nil && loc[2] != -1 {
+		err := yaml.Unmarshal([]byte(body[loc[2]:loc[3]]), &doc)
+		if err != nil {
+			return body, err
+		}
+	}
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	m := doc.Content[0]
+	if m.Kind != yaml.MappingNode {
+		return body, fmt.Errorf("front matter isn't a mapping")
+	}
+	var aliases *yaml.Node
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == "aliases" {
+			aliases = m.Content[i+1]
+		}
+	}
+	if aliases == nil {
+		aliases = &yaml.Node{}
+		m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: "aliases"}, aliases)
+	}
+	// Rewrite as a list, aliases may have been written as "a, b".
+	*aliases = yaml.Node{Kind: yaml.SequenceNode, Style: yaml.FlowStyle}
+	for _, a := range append(fm.Aliases, alias) {
+		aliases.Content = append(aliases.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: a})
+	}
+
+	bs, err := yaml.Marshal(&doc)
+	if err != nil {
+		return body, err
+	}
+	return "---\n" + string(bs) + "---\n" + rest, nil
+}
+
+// Page body without its front matter.
+func pageContent(p *Page) string {
+	_, body, _ := parseFrontMatter(p.Body)
+	return body
+}
+
+// Set the page fields stored from the front matter. Invalid front matter is
+// ignored here, see validatePageMeta().
+func setPageMeta(p *Page) {
+	fm, _, _ := parseFrontMatter(p.Body)
+	p.Summary = fm.Summary
+	p.Layout = fm.Layout
+	if !isLayout(p.Layout) {
+		p.Layout = ""
+	}
+}
+
+// Check a page's front matter before saving, returns an error message to
+// show in the form.
+func validatePageMeta(db *sql.DB, site *Site, p *Page) string {
+	fm, _, err := parseFrontMatter(p.Body)
+	if err != nil {
+		return fmt.Sprintf("Front matter is not valid yaml (%s).", err)
+	}
+	if !isLayout(fm.Layout) {
+		return fmt.Sprintf("Unknown layout '%s', use one of: wide, full.", fm.Layout)
+	}
+	if op := queryPageByAlias(db, site.Siteid, p.Title); op != nil && op.Pageid != p.Pageid {
+		return fmt.Sprintf("Title '%s' is an alias of page '%s'.", p.Title, op.Title)
+	}
+	for _, alias := range fm.Aliases {
+		if alias == p.Title {
+			continue
+		}
+		if op := queryPageByTitle(db, site.Siteid, alias); op != nil && op.Pageid != p.Pageid {
+			return fmt.Sprintf("Alias '%s' is the title of another page.", alias)
+		}
+		if op := queryPageByAlias(db, site.Siteid, alias); op != nil && op.Pageid != p.Pageid {
+			return fmt.Sprintf("Alias '%s' is already used by page '%s'.", alias, op.Title)
+		}
+	}
+	return ""
+}
+
+const _frontMatterHelp = "Optional front matter at the start of the body, between --- lines: tags, aliases (other titles that lead to this page), summary, and layout (wide or full)."
+
+// Page layouts set in front matter.
+var _layouts = [][2]string{
+	{"", "Default"},
+	{"wide", "Without the sites sidebar"},
+	{"full", "Page content only, without menus"},
+}
+
+func isLayout(layout string) bool {
+	for _, l := range _layouts {
+		if l[0] == layout {
+			return true
+		}
+	}
+	return false
+}
+
+// A [[link]] or ![[embed]] in a page body, or a tag or alias in its front
+// matter.
+type PageLink struct {
+	Kind   string // "page", "file", "include", "tag" or "alias"
+	Target string
+}
+
+var wikilinkRe = regexp.MustCompile(`(!?)\[\[(.+?)\]\]`)
+
+// Return the pages and files that a page body links to, the pages it
+// includes, and its tags and aliases. Links and includes written in code
+// are examples, not uses.
+func parsePageLinks(body string) []PageLink {
+	links := []PageLink{}
+	fm, body, _ := parseFrontMatter(body)
+	for _, tag := range fm.Tags {
+		links = append(links, PageLink{"tag", strings.ToLower(tag)})
+	}
+	for _, alias := range fm.Aliases {
+		links = append(links, PageLink{"alias", alias})
+	}
+	masked, _ := maskCode(body)
+	for _, matches := range macroRe.FindAllStringSubmatch(masked, -1) {
+		if matches[1] == "include" {
+			links = append(links, PageLink{"include", matches[2]})
+		}
+	}
+	for _, matches := range wikilinkRe.FindAllStringSubmatch(masked, -1) {
+		target := matches[2]
+		if i := strings.IndexAny(target, "|#"); i != -1 {
+			target = target[:i]
+		}
+		target = strings.TrimSpace(target)
+		if target == "" {
+			continue
+		}
+		if matches[1] == "!" {
+			links = append(links, PageLink{"file", target})
+		} else if strings.HasPrefix(target, "~file/") {
+			links = append(links, PageLink{"file", strings.TrimPrefix(target, "~file/")})
+		} else {
+			links = append(links, PageLink{"page", target})
+		}
+	}
+	return links
+}
+
+// Replace a page's rows in the links table with the links in body.
+func updatePageLinks(db *sql.DB, siteid int64, pageid int64, body string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	err = updatePageLinksTx(tx, siteid, pageid, body)
+	if handleTxErr(tx, err) {
+		return err
+	}
+	err = tx.Commit()
+	if handleTxErr(tx, err) {
+		return err
+	}
+	return nil
+}
+func updatePageLinksTx(tx *sql.Tx, siteid int64, pageid int64, body string) error {
+	linktbl := linktblName(siteid)
+	s := fmt.Sprintf("DELETE FROM %s WHERE page_id = ?", linktbl)
+	_, err := txexec(tx, s, pageid)
+	if err != nil {
+		return err
+	}
+	s = fmt.Sprintf("INSERT INTO %s (page_id, kind, target) VALUES (?, ?, ?)", linktbl)
+	for _, link := range parsePageLinks(body) {
+		_, err = txexec(tx, s, pageid, link.Kind, link.Target)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return pages that link to target, ordered by title.
+func queryLinkingPages(db *sql.DB, siteid int64, kind, target string) ([]*Page, error) {
+	s := fmt.Sprintf("SELECT DISTINCT p.page_id, p.title FROM %s l INNER JOIN %s p ON l.page_id = p.page_id WHERE l.kind = ? AND l.target = ? ORDER BY p.title", linktblName(siteid), pagetblName(siteid))
+	rows, err := db.Query(s, kind, target)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pp := []*Page{}
+	for rows.Next() {
+		var p Page
+		err := rows.Scan(&p.Pageid, &p.Title)
+		if err != nil {
+			return nil, err
+		}
+		pp = append(pp, &p)
+	}
+	return pp, rows.Err()
+}
+
+// Rename a file, optionally rewriting ![[oldname]] and [[~file/oldname]]
+// references in pages to the new filename.
+func renameFile(db *sql.DB, siteid int64, fileid int64, oldname, newname string, rewriteRefs bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	s := fmt.Sprintf("UPDATE %s SET filename = ? WHERE file_id = ?", filetblName(siteid))
+	_, err = txexec(tx, s, newname, fileid)
+	if handleTxErr(tx, err) {
+		return err
+	}
+
+	if rewriteRefs {
+		s = fmt.Sprintf("SELECT p.page_id, p.body FROM %s p WHERE p.page_id IN (SELECT page_id FROM %s WHERE kind = 'file' AND target = ?)", pagetblName(siteid), linktblName(siteid))
+		rows, err := tx.Query(s, oldname)
+		if handleTxErr(tx, err) {
+			return err
+		}
+		pp := []*Page{}
+		for rows.Next() {
+			var p Page
+			err = rows.Scan(&p.Pageid, &p.Body)
+			if err != nil {
+				break
+			}
+			pp = append(pp, &p)
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		rows.Close()
+		if handleTxErr(tx, err) {
+			return err
+		}
+
+		for _, p := range pp {
+			p.Body = rewriteFileRefs(p.Body, oldname, newname)
+			s = fmt.Sprintf("UPDATE %s SET body = ? WHERE page_id = ?", pagetblName(siteid))
+			_, err = txexec(tx, s, p.Body, p.Pageid)
+			if handleTxErr(tx, err) {
+				return err
+			}
+			err = updatePageLinksTx(tx, siteid, p.Pageid, p.Body)
+			if handleTxErr(tx, err) {
+				return err
+			}
+		}
+	}
+
+	err = tx.Commit()
+	if handleTxErr(tx, err) {
+		return err
+	}
+	return nil
+}
+func rewriteFileRefs(body, oldname, newname string) string {
+	body, unmask := maskCode(body)
+	re := regexp.MustCompile(`(!\[\[\s*|\[\[\s*~file/)` + regexp.QuoteMeta(oldname) + `(\s*[\]|#])`)
+	body = re.ReplaceAllStringFunc(body, func(smatch string) string {
+		matches := re.FindStringSubmatch(smatch)
+		return matches[1] + newname + matches[2]
+	})
+	return unmask(body)
+}
+
+// A page and its child pages ("Title/..."), ordered by title.
+func queryPageSubtree(db *sql.DB, siteid int64, title string) ([]*Page, error) {
+	s := fmt.Sprintf("SELECT page_id, title FROM %s WHERE title = ? OR title LIKE ? ESCAPE '\\' ORDER BY title", pagetblName(siteid))
+	rows, err := db.Query(s, title, likeEscaper.Replace(title)+"/%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pp := []*Page{}
+	for rows.Next() {
+		var p Page
+		err := rows.Scan(&p.Pageid, &p.Title)
+		if err != nil {
+			return nil, err
+		}
+		pp = append(pp, &p)
+	}
+	return pp, rows.Err()
+}
+
+// Move page oldtitle and its child pages under newtitle in one transaction,
+// optionally rewriting [[links]] and includes of the moved pages, in the
+// site and as "[[sitename:Title]]" in other sites. If keepAliases is set,
+// the old titles are added to the moved pages' aliases so that old urls
+// keep working.
+func movePage(db *sql.DB, site *Site, oldtitle, newtitle string, rewriteRefs, keepAliases bool) error {
+	pp, err := queryPageSubtree(db, site.Siteid, oldtitle)
+	if err != nil {
+		return err
+	}
+	sites, err := querySites(db, false)
+	if err != nil {
+		return err
+	}
+
+	now := isodate(time.Now())
+	pagetbl := pagetblName(site.Siteid)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, p := range pp {
+		s := fmt.Sprintf("SELECT body FROM %s WHERE page_id = ?", pagetbl)
+		err = tx.QueryRow(s, p.Pageid).Scan(&p.Body)
+		if handleTxErr(tx, err) {
+			return err
+		}
+		body := p.Body
+		if keepAliases {
+			body, err = addPageAlias(p.Body, p.Title)
+			if err != nil {
+				log.Printf("movePage: can't add alias to '%s' (%s)\n", p.Title, err)
+				body = p.Body
+			}
+		}
+		s = fmt.Sprintf("UPDATE %s SET title = ?, body = ?, updatedt = ? WHERE page_id = ?", pagetbl)
+		_, err = txexec(tx, s, newtitle+strings.TrimPrefix(p.Title, oldtitle), body, now, p.Pageid)
+		if handleTxErr(tx, err) {
+			return err
+		}
+		err = updatePageLinksTx(tx, site.Siteid, p.Pageid, body)
+		if handleTxErr(tx, err) {
+			return err
+		}
+	}
+
+	if rewriteRefs {
+		err = rewritePageRefsTx(tx, site.Siteid, oldtitle, newtitle, now)
+		if handleTxErr(tx, err) {
+			return err
+		}
+		for _, othersite := range sites {
+			err = rewritePageRefsTx(tx, othersite.Siteid, site.Sitename+":"+oldtitle, site.Sitename+":"+newtitle, now)
+			if handleTxErr(tx, err) {
+				return err
+			}
+		}
+	}
+
+	err = tx.Commit()
+	if handleTxErr(tx, err) {
+		return err
+	}
+	return nil
+}
+
+// Rewrite references to oldtitle in the pages of a site that link to or
+// include it.
+func rewritePageRefsTx(tx *sql.Tx, siteid int64, oldtitle, newtitle, now string) error {
+	s := fmt.Sprintf("SELECT p.page_id, p.body FROM %s p WHERE p.page_id IN (SELECT page_id FROM %s WHERE kind IN ('page', 'include') AND (target = ? OR target LIKE ? ESCAPE '\\'))", pagetblName(siteid), linktblName(siteid))
+	rows, err := tx.Query(s, oldtitle, likeEscaper.Replace(oldtitle)+"/%")
+	if err != nil {
+		return err
+	}
+	pp := []*Page{}
+	for rows.Next() {
+		var p Page
+		err := rows.Scan(&p.Pageid, &p.Body)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		pp = append(pp, &p)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range pp {
+		body := rewritePageRefs(p.Body, oldtitle, newtitle)
+		if body == p.Body {
+			continue
+		}
+		s = fmt.Sprintf("UPDATE %s SET body = ?, updatedt = ? WHERE page_id = ?", pagetblName(siteid))
+		_, err = txexec(tx, s, body, now, p.Pageid)
+		if err != nil {
+			return err
+		}
+		err = updatePageLinksTx(tx, siteid, p.Pageid, body)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rewrite [[oldtitle...]] links and {{include: oldtitle...}} to newtitle,
+// including links to child pages of oldtitle.
+func rewritePageRefs(body, oldtitle, newtitle string) string {
+	linkre := regexp.MustCompile(`(^|[^!])(\[\[\s*)` + regexp.QuoteMeta(oldtitle) + `((?:/[^\]|#]*)?\s*[\]|#])`)
+	body = linkre.ReplaceAllStringFunc(body, func(smatch string) string {
+		matches := linkre.FindStringSubmatch(smatch)
+		return matches[1] + matches[2] + newtitle + matches[3]
+	})
+	includere := regexp.MustCompile(`(\{\{\s*include:?\s*)` + regexp.QuoteMeta(oldtitle) + `((?:/[^}]*?)?\s*\}\})`)
+	return includere.ReplaceAllStringFunc(body, func(smatch string) string {
+		matches := includere.FindStringSubmatch(smatch)
+		return matches[1] + newtitle + matches[2]
+	})
+}
+func createIndexPage(db *sql.DB, site *Site, p *Page) error {
+	// Create page_id 1 to serve as starting page of site.
+	setPageMeta(p)
+	now := isodate(time.Now())
+	s := fmt.Sprintf("INSERT INTO %s (page_id, title, body, createdt, updatedt, summary, layout) VALUES (?, ?, ?, ?, ?, ?, ?)", pagetblName(site.Siteid))
+	_, err := sqlexec(db, s, 1, p.Title, p.Body, now, now, p.Summary, p.Layout)
+	if err != nil {
+		return err
+	}
+	return updatePageLinks(db, site.Siteid, 1, p.Body)
+}
+
+var errSkipped = errors.New("already exists")
+var errQuotaExceeded = errors.New("storage quota exceeded")
+var errStartPageInTrash = errors.New("an earlier start page is in the trash")
+
+// Save file contents under filename and return the filename that was saved.
+// If a file with the same name exists, onconflict "replace" replaces its
+// contents, "keepboth" saves under a new numbered filename, ex. "file-1.png",
+// and anything else skips the file and returns errSkipped.
+// Replaced file contents are kept as a previous version of the file.
+func saveFile(db *sql.DB, site *Site, filename string, bs []byte, onconflict string, userid int64) (string, error) {
+	filetbl := filetblName(site.Siteid)
+	existing := queryFileInfoByFilename(db, site.Siteid, filename)
+	if existing != nil {
+		if onconflict == "keepboth" {
+			filename = nextAvailableFilename(db, site.Siteid, filename)
+			existing = nil
+		} else if onconflict != "replace" {
+			return filename, errSkipped
+		}
+	}
+
+	// The quota is checked in the same transaction as the write so that
+	// parallel uploads can't all pass it. A replaced file's current contents
+	// are kept as a previous version, so they still count towards storage used.
+	ctype := detectContentType(filename, bs)
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("saveFile: DB error starting transaction: %s\n", err)
+		return filename, fmt.Errorf("server database error")
+	}
+	if existing != nil {
+		err = replaceFileTx(tx, site.Siteid, existing.Fileid, bs, ctype, userid)
+	} else {
+		now := isodate(time.Now())
+		s := fmt.Sprintf("INSERT INTO %s (filename, bytes, hash, content_type, user_id, createdt, updatedt) VALUES (?, ?, ?, ?, ?, ?, ?);", filetbl)
+		_, err = txexec(tx, s, filename, bs, hashBytes(bs), ctype, userid, now, now)
+	}
+	if handleTxErr(tx, err) {
+		log.Printf("saveFile: DB error saving file contents: %s\n", err)
+		return filename, fmt.Errorf("server database error")
+	}
+	usage, err := querySiteUsageTx(tx, site.Siteid)
+	if handleTxErr(tx, err) {
+		log.Printf("saveFile: DB error reading storage used: %s\n", err)
+		return filename, fmt.Errorf("server database error")
+	}
+	if usage > siteQuota(site) {
+		tx.Rollback()
+		return filename, errQuotaExceeded
+	}
+	err = tx.Commit()
+	if handleTxErr(tx, err) {
+		log.Printf("saveFile: DB error saving file contents: %s\n", err)
+		return filename, fmt.Errorf("server database error")
+	}
+	return filename, nil
+}
+
+// Replace file contents, keeping the current contents as a previous version.
+func replaceFileTx(tx *sql.Tx, siteid int64, fileid int64, bs []byte, ctype string, userid int64) error {
+	err := archiveFileTx(tx, siteid, fileid)
+	if err != nil {
+		return err
+	}
+	s := fmt.Sprintf("UPDATE %s SET bytes = ?, hash = ?, content_type = ?, user_id = ?, updatedt = ? WHERE file_id = ?", filetblName(siteid))
+	_, err = txexec(tx, s, bs, hashBytes(bs), ctype, userid, isodate(time.Now()), fileid)
+	return err
+}
+
+// Make a previous version of file contents the current version.
+// The current contents are kept as another previous version.
+func restoreFileVersion(db *sql.DB, siteid int64, fileid int64, versionid int64, userid int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	err = archiveFileTx(tx, siteid, fileid)
+	if handleTxErr(tx, err) {
+		return err
+	}
+	s := fmt.Sprintf("UPDATE %s SET (bytes, hash, content_type) = (SELECT bytes, hash, content_type FROM %s WHERE version_id = ? AND file_id = ?), user_id = ?, updatedt = ? WHERE file_id = ?", filetblName(siteid), fileversiontblName(siteid))
+	_, err = txexec(tx, s, versionid, fileid, userid, isodate(time.Now()), fileid)
+	if handleTxErr(tx, err) {
+		return err
+	}
+	err = tx.Commit()
+	if handleTxErr(tx, err) {
+		return err
+	}
+	return nil
+}
+
+// Copy current file contents into the file versions table.
+func archiveFileTx(tx *sql.Tx, siteid int64, fileid int64) error {
+	s := fmt.Sprintf("INSERT INTO %s (file_id, bytes, hash, content_type, user_id, updatedt) SELECT file_id, bytes, hash, content_type, user_id, updatedt FROM %s WHERE file_id = ?", fileversiontblName(siteid), filetblName(siteid))
+	_, err := txexec(tx, s, fileid)
+	return err
+}
+
+// Return "name-1.ext", "name-2.ext", ... whichever is not used yet.
+func nextAvailableFilename(db *sql.DB, siteid int64, filename string) string {
+	ext := path.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+	for i := 1; ; i++ {
+		newname := fmt.Sprintf("%s-%d%s", base, i, ext)
+		if queryFileInfoByFilename(db, siteid, newname) == nil {
+			return newname
+		}
+	}
+}
+
+// Save page body under title and return the title that was saved.
+// onconflict works the same as in saveFile().
+func savePage(db *sql.DB, site *Site, title, body string, onconflict string) (string, error) {
+	if errmsg := validateTitle(title); errmsg != "" {
+		return title, errors.New(strings.TrimSuffix(errmsg, "."))
+	}
+	existing := queryPageByTitle(db, site.Siteid, title)
+	if existing != nil {
+		if onconflict == "keepboth" {
+			for i := 1; ; i++ {
+				newtitle := fmt.Sprintf("%s-%d", title, i)
+				if queryPageByTitle(db, site.Siteid, newtitle) == nil {
+					title = newtitle
+					break
+				}
+			}
+			existing = nil
+		} else if onconflict != "replace" {
+			return title, errSkipped
+		}
+	}
+
+	p := Page{Title: title, Body: body}
+	if existing != nil {
+		p.Pageid = existing.Pageid
+	}
+	if errmsg := validatePageMeta(db, site, &p); errmsg != "" {
+		return title, errors.New(strings.TrimSuffix(errmsg, "."))
+	}
+
+	if existing != nil {
+		existing.Body = body
+		err := updatePage(db, site, existing)
+		if err != nil {
+			log.Printf("savePage: DB error updating page: %s\n", err)
+			return title, fmt.Errorf("server database error")
+		}
+		return title, nil
+	}
+
+	_, err := createPage(db, site, &p)
+	if err != nil {
+		log.Printf("savePage: DB error creating page: %s\n", err)
+		return title, fmt.Errorf("server database error")
+	}
+	return title, nil
+}
+
+// Columns moved between a table and its trash table.
+const pageCols = "page_id, title, body, createdt, updatedt, summary, layout"
+const fileCols = "file_id, filename, bytes, hash, content_type, user_id, desc, alt, createdt, updatedt"
+const siteCols = "site_id, sitename, desc, quota, istemplate, theme, css, header, footer, nav, navonly, toc, iframehosts"
+
+// A deleted site, page or file in the trash.
+type TrashItem struct {
+	Id        int64
+	Name      string
+	Trashdt   time.Time
+	TrashedBy string
+}
+
+func trashPage(db *sql.DB, siteid int64, pageid int64, userid int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// The start page is recreated as page_id 1 after it's trashed, so
+	// only one trashed start page can be kept at a time.
+	if pageid == 1 {
+		var n int
+		s := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE page_id = 1", pagetrashtblName(siteid))
+		err = tx.QueryRow(s).Scan(&n)
+		if err == nil && n > 0 {
+			err = errStartPageInTrash
+		}
+		if handleTxErr(tx, err) {
+			return err
+		}
+	}
+	s := fmt.Sprintf("INSERT INTO %s (%s, trashdt, trashed_by) SELECT %s, ?, ? FROM %s WHERE page_id = ?", pagetrashtblName(siteid), pageCols, pageCols, pagetblName(siteid))
+	_, err = txexec(tx, s, isodate(time.Now()), userid, pageid)
+	if handleTxErr(tx, err) {
+		return err
+	}
+	s = fmt.Sprintf("DELETE FROM %s WHERE page_id = ?", pagetblName(siteid))
+	_, err = txexec(tx, s, pageid)
+	if handleTxErr(tx, err) {
+		return err
+	}
+	err = updatePageLinksTx(tx, siteid, pageid, "")
+	if handleTxErr(tx, err) {
+		return err
+	}
+	err = tx.Commit()
+	if handleTxErr(tx, err) {
+		return err
+	}
+	return nil
+}
+func trashFiles(db *sql.DB, siteid int64, fileids []int64, userid int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	now := isodate(time.Now())
+	for _, fileid := range fileids {
+		s := fmt.Sprintf("INSERT INTO %s (%s, trashdt, trashed_by) SELECT %s, ?, ? FROM %s WHERE file_id = ?", filetrashtblName(siteid), fileCols, fileCols, filetblName(siteid))
+		_, err = txexec(tx, s, now, userid, fileid)
+		if handleTxErr(tx, err) {
+			return err
+		}
+		s = fmt.Sprintf("DELETE FROM %s WHERE file_id = ?", filetblName(siteid))
+		_, err = txexec(tx, s, fileid)
+		if handleTxErr(tx, err) {
+			return err
+		}
+	}
+	err = tx.Commit()
+	if handleTxErr(tx, err) {
+		return err
+	}
+	return nil
+}
+
+// Move site to the trash. The site's tables are kept until it's purged.
+func trashSite(db *sql.DB, siteid int64, userid int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	s := fmt.Sprintf("INSERT INTO sitetrash (%s, trashdt, trashed_by) SELECT %s, ?, ? FROM site WHERE site_id = ?", siteCols, siteCols)
+	_, err = txexec(tx, s, isodate(time.Now()), userid, siteid)
+	if handleTxErr(tx, err) {
+		return err
+	}
+	s = "DELETE FROM site WHERE site_id = ?"
+	_, err = txexec(tx, s, siteid)
+	if handleTxErr(tx, err) {
+		return err
+	}
+	err = tx.Commit()
+	if handleTxErr(tx, err) {
+		return err
+	}
+	reloadSiteDomains(db)
+	return nil
+}
+
+func restorePage(db *sql.DB, site *Site, pageid int64) error {
+	siteid := site.Siteid
+	var p Page
+	s := fmt.Sprintf("SELECT page_id, title, body FROM %s WHERE page_id = ?", pagetrashtblName(siteid))
+	err := db.QueryRow(s, pageid).Scan(&p.Pageid, &p.Title, &p.Body)
+	if err != nil {
+		return err
+	}
+	if queryPageByTitle(db, siteid, p.Title) != nil {
+		return fmt.Errorf("a page titled '%s' already exists", p.Title)
+	}
+
+	// The start page (page_id 1) is recreated when missing, so a
+	// restored start page may need a new page_id.
+	newid := sql.NullInt64{Int64: p.Pageid, Valid: true}
+	if queryPageById(db, siteid, p.Pageid) != nil {
+		newid.Valid = false
+		p.Pageid = 0
+	}
+
+	// Pages saved since it was deleted may use its title or aliases.
+	if errmsg := validatePageMeta(db, site, &p); errmsg != "" {
+		return errors.New(strings.TrimSuffix(errmsg, "."))
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	s = fmt.Sprintf("INSERT INTO %s (%s) SELECT ?, title, body, createdt, updatedt, summary, layout FROM %s WHERE page_id = ?", pagetblName(siteid), pageCols, pagetrashtblName(siteid))
+	result, err := txexec(tx, s, newid, pageid)
+	if handleTxErr(tx, err) {
+		return err
+	}
+	p.Pageid, err = result.LastInsertId()
+	if handleTxErr(tx, err) {
+		return err
+	}
+	s = fmt.Sprintf("DELETE FROM %s WHERE page_id = ?", pagetrashtblName(siteid))
+	_, err = txexec(tx, s, pageid)
+	if handleTxErr(tx, err) {
+		return err
+	}
+	err = updatePageLinksTx(tx, siteid, p.Pageid, p.Body)
+	if handleTxErr(tx, err) {
+		return err
+	}
+	err = tx.Commit()
+	if handleTxErr(tx, err) {
+		return err
+	}
+	return nil
+}
+func restoreFile(db *sql.DB, siteid int64, fileid int64) error {
+	var filename string
+	s := fmt.Sprintf("SELECT filename FROM %s WHERE file_id = ?", filetrashtblName(siteid))
+	err := db.QueryRow(s, fileid).Scan(&filename)
+	if err != nil {
+		return err
+	}
+	if queryFileInfoByFilename(db, siteid, filename) != nil {
+		return fmt.Errorf("a file named '%s' already exists", filename)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	s = fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s WHERE file_id = ?", filetblName(siteid), fileCols, fileCols, filetrashtblName(siteid))
+	_, err = txexec(tx, s, fileid)
+	if handleTxErr(tx, err) {
+		return err
+	}
+	s = fmt.Sprintf("DELETE FROM %s WHERE file_id = ?", filetrashtblName(siteid))
+	_, err = txexec(tx, s, fileid)
+	if handleTxErr(tx, err) {
+		return err
+	}
+	err = tx.Commit()
+	if handleTxErr(tx, err) {
+		return err
+	}
+	return nil
+}
+func restoreSite(db *sql.DB, siteid int64) error {
+	var sitename string
+	s := "SELECT sitename FROM sitetrash WHERE site_id = ?"
+	err := db.QueryRow(s, siteid).Scan(&sitename)
+	if err != nil {
+		return err
+	}
+	if querySiteBySitename(db, sitename) != nil {
+		return fmt.Errorf("a site named '%s' already exists", sitename)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	s = fmt.Sprintf("INSERT INTO site (%s) SELECT %s FROM sitetrash WHERE site_id = ?", siteCols, siteCols)
+	_, err = txexec(tx, s, siteid)
+	if handleTxErr(tx, err) {
+		return err
+	}
+	s = "DELETE FROM sitetrash WHERE site_id = ?"
+	_, err = txexec(tx, s, siteid)
+	if handleTxErr(tx, err) {
+		return err
+	}
+	err = tx.Commit()
+	if handleTxErr(tx, err) {
+		return err
+	}
+	reloadSiteDomains(db)
+	return nil
+}
+
+// Delete from trash table, returns an error if the id isn't in the trash.
+// Live pages, files and sites have to be deleted into the trash first.
+func deleteFromTrashTx(tx *sql.Tx, trashtbl, idcol string, id int64) error {
+	s := fmt.Sprintf("DELETE FROM %s WHERE %s = ?", trashtbl, idcol)
+	result, err := txexec(tx, s, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("id %d is not in the trash", id)
+	}
+	return nil
+}
+
+func purgePage(db *sql.DB, siteid int64, pageid int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	err = deleteFromTrashTx(tx, pagetrashtblName(siteid), "page_id", pageid)
+	if handleTxErr(tx, err) {
+		return err
+	}
+	err = tx.Commit()
+	if handleTxErr(tx, err) {
+		return err
+	}
+	return nil
+}
+func purgeFile(db *sql.DB, siteid int64, fileid int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	err = deleteFromTrashTx(tx, filetrashtblName(siteid), "file_id", fileid)
+	if handleTxErr(tx, err) {
+		return err
+	}
+	s := fmt.Sprintf("DELETE FROM %s WHERE file_id = ?", fileversiontblName(siteid))
+	_, err = txexec(tx, s, fileid)
+	if handleTxErr(tx, err) {
+		return err
+	}
+	err = purgeThumbsTx(tx, siteid)
+	if handleTxErr(tx, err) {
+		return err
+	}
+	err = tx.Commit()
+	if handleTxErr(tx, err) {
+		return err
+	}
+	return nil
+}
+func purgeSite(db *sql.DB, siteid int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	err = deleteFromTrashTx(tx, "sitetrash", "site_id", siteid)
+	if handleTxErr(tx, err) {
+		return err
+	}
+	for _, tbl := range sitetblNames(siteid) {
+		s := fmt.Sprintf("DROP TABLE IF EXISTS %s", tbl)
+		_, err = txexec(tx, s)
+		if handleTxErr(tx, err) {
+			return err
+		}
+	}
+	s := "DELETE FROM sitealias WHERE site_id = ?"
+	_, err = txexec(tx, s, siteid)
+	if handleTxErr(tx, err) {
+		return err
+	}
+	s = "DELETE FROM site_domain WHERE site_id = ?"
+	_, err = txexec(tx, s, siteid)
+	if handleTxErr(tx, err) {
+		return err
+	}
+	err = tx.Commit()
+	if handleTxErr(tx, err) {
+		return err
+	}
+	reloadSiteDomains(db)
+	return nil
+}
+
+func queryTrashItems(db *sql.DB, s string, pp ...interface{}) ([]*TrashItem, error) {
+	rows, err := db.Query(s, pp...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []*TrashItem{}
+	for rows.Next() {
+		var item TrashItem
+		var trashdt string
+		err := rows.Scan(&item.Id, &item.Name, &trashdt, &item.TrashedBy)
+		if err != nil {
+			return nil, err
+		}
+		item.Trashdt = parseIsoDate(trashdt)
+		items = append(items, &item)
+	}
+	return items, rows.Err()
+}
+func queryTrashPages(db *sql.DB, siteid int64) ([]*TrashItem, error) {
+	s := fmt.Sprintf("SELECT t.page_id, t.title, t.trashdt, IFNULL(u.username, '') FROM %s t LEFT OUTER JOIN user u ON t.trashed_by = u.user_id ORDER BY t.trashdt DESC", pagetrashtblName(siteid))
+	return queryTrashItems(db, s)
+}
+func queryTrashFiles(db *sql.DB, siteid int64) ([]*TrashItem, error) {
+	s := fmt.Sprintf("SELECT t.file_id, t.filename, t.trashdt, IFNULL(u.username, '') FROM %s t LEFT OUTER JOIN user u ON t.trashed_by = u.user_id ORDER BY t.trashdt DESC", filetrashtblName(siteid))
+	return queryTrashItems(db, s)
+}
+func queryTrashSites(db *sql.DB) ([]*TrashItem, error) {
+	s := "SELECT t.site_id, t.sitename, t.trashdt, IFNULL(u.username, '') FROM sitetrash t LEFT OUTER JOIN user u ON t.trashed_by = u.user_id ORDER BY t.trashdt DESC"
+	return queryTrashItems(db, s)
+}
+
+func queryIds(db *sql.DB, s string, pp ...interface{}) ([]int64, error) {
+	rows, err := db.Query(s, pp...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Purge items that have been in the trash longer than _trashRetention.
+func purgeExpiredTrash(db *sql.DB) {
+	cutoff := isodate(time.Now().Add(-_trashRetention))
+
+	siteids, err := queryIds(db, "SELECT site_id FROM site UNION SELECT site_id FROM sitetrash")
+	if err != nil {
+		log.Printf("purgeExpiredTrash() db err (%s)\n", err)
+		return
+	}
+	for _, siteid := range siteids {
+		s := fmt.Sprintf("DELETE FROM %s WHERE trashdt < ?", pagetrashtblName(siteid))
+		_, err = sqlexec(db, s, cutoff)
+		if err != nil {
+			log.Printf("purgeExpiredTrash() db err (%s)\n", err)
+		}
+
+		s = fmt.Sprintf("SELECT file_id FROM %s WHERE trashdt < ?", filetrashtblName(siteid))
+		fileids, err := queryIds(db, s, cutoff)
+		if err != nil {
+			log.Printf("purgeExpiredTrash() db err (%s)\n", err)
+			continue
+		}
+		for _, fileid := range fileids {
+			err = purgeFile(db, siteid, fileid)
+			if err != nil {
+				log.Printf("purgeExpiredTrash() db err (%s)\n", err)
+			}
+		}
+	}
+
+	siteids, err = queryIds(db, "SELECT site_id FROM sitetrash WHERE trashdt < ?", cutoff)
+	if err != nil {
+		log.Printf("purgeExpiredTrash() db err (%s)\n", err)
+		return
+	}
+	for _, siteid := range siteids {
+		err = purgeSite(db, siteid)
+		if err != nil {
+			log.Printf("purgeExpiredTrash() db err (%s)\n", err)
+		}
+	}
+}
+func purgeTrashLoop(db *sql.DB) {
+	for {
+		purgeExpiredTrash(db)
+		time.Sleep(time.Hour)
+	}
+}
+
+//*** Helper functions ***
+func listContains(ss []string, v string) bool {
+	for _, s := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+func fileExists(file string) bool {
+	_, err := os.Stat(file)
+	if err != nil && os.IsNotExist(err) {
+		return false
+	}
+	return true
+}
+func makePrintFunc(w io.Writer) func(format string, a ...interface{}) (n int, err error) {
+	// Return closure enclosing io.Writer.
+	return func(format string, a ...interface{}) (n int, err error) {
+		return fmt.Fprintf(w, format, a...)
+	}
+}
+func atoi(s string) int {
+	if s == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+func isodate(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+func parseIsoDate(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+func formatSize(n int64) string {
+	const kb = 1024
+	const mb = 1024 * kb
+	const gb = 1024 * mb
+	if n >= gb {
+		return fmt.Sprintf("%.1f GB", float64(n)/gb)
+	} else if n >= mb {
+		return fmt.Sprintf("%.1f MB", float64(n)/mb)
+	} else if n >= kb {
+		return fmt.Sprintf("%.1f KB", float64(n)/kb)
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
+
+// Normalize a host name entered by the user ("https://Docs.Example.com/" =>
+// "docs.example.com").
+func cleanDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	domain = strings.TrimPrefix(domain, "http://")
+	domain = strings.TrimPrefix(domain, "https://")
+	return strings.TrimSuffix(domain, "/")
+}
+
+// Strip any directory part from an uploaded filename.
+func cleanFilename(filename string) string {
+	filename = strings.ReplaceAll(filename, "\\", "/")
+	filename = strings.TrimSpace(path.Base(filename))
+	if filename == "." || filename == "/" || filename == ".." {
+		return ""
+	}
+	return filename
+}
+func hashBytes(bs []byte) string {
+	sum := sha256.Sum256(bs)
+	return hex.EncodeToString(sum[:])
+}
+func idtoi(sid string) int64 {
+	return int64(atoi(sid))
+}
+func itoa(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
+
+func parseArgs(args []string) (map[string]string, []string) {
+	switches := map[string]string{}
+	parms := []string{}
+
+	standaloneSwitches := []string{}
+	definitionSwitches := []string{"i", "import", "maxupload", "maxrequest", "quota", "trashdays", "host", "templates"}
+	fNoMoreSwitches := false
+	curKey := ""
+
+	for _, arg := range args {
+		if fNoMoreSwitches {
+			// any arg after "--" is a standalone parameter
+			parms = append(parms, arg)
+		} else if arg == "--" {
+			// "--" means no more switches to come
+			fNoMoreSwitches = true
+		} else if strings.HasPrefix(arg, "--") {
+			switches[arg[2:]] = "y"
+			curKey = ""
+		} else if strings.HasPrefix(arg, "-") {
+			if listContains(definitionSwitches, arg[1:]) {
+				// -a "val"
+				curKey = arg[1:]
+				continue
+			}
+			for _, ch := range arg[1:] {
+				// -a, -b, -ab
+				sch := string(ch)
+				if listContains(standaloneSwitches, sch) {
+					switches[sch] = "y"
+				}
+			}
+		} else if curKey != "" {
+			switches[curKey] = arg
+			curKey = ""
+		} else {
+			// standalone parameter
+			parms = append(parms, arg)
+		}
+	}
+
+	return switches, parms
+}
+
+func unescape(s string) string {
+	s2, err := url.QueryUnescape(s)
+	if err != nil {
+		return s
+	}
+	return s2
+}
+func escape(s string) string {
+	return url.QueryEscape(s)
+}
+
+func parsePageUrl(r *http.Request) (string, string) {
+	surl := strings.Trim(r.URL.Path, "/")
+	if sitename := hostSitename(r); sitename != "" {
+		// page url takes the form "/<title>" on a site's custom domain
+		if surl == "" {
+			return sitename, ""
+		}
+		return sitename, unescape(surl)
+	}
+	// Page titles can contain '/' for child pages: "/<sitename>/Guide/Install"
+	ss := strings.SplitN(surl, "/", 2)
+	sslen := len(ss)
+	if sslen == 0 {
+		return "", ""
+	} else if sslen == 1 {
+		return unescape(ss[0]), ""
+	}
+	return unescape(ss[0]), unescape(ss[1])
+}
+
+// Returns the sitename mapped to the request's host, if any.
+func hostSitename(r *http.Request) string {
+	host := strings.ToLower(r.Host)
+	_siteDomains.RLock()
+	defer _siteDomains.RUnlock()
+	if sitename, ok := _siteDomains.byDomain[host]; ok {
+		return sitename
+	}
+	if i := strings.LastIndex(host, ":"); i != -1 {
+		return _siteDomains.byDomain[host[:i]]
+	}
+	return ""
+}
+func siteDomain(sitename string) string {
+	_siteDomains.RLock()
+	defer _siteDomains.RUnlock()
+	return _siteDomains.bySitename[sitename]
+}
+
+// Absolute link to a site's start page, for use from other sites.
+func siteUrl(sitename string) string {
+	if domain := siteDomain(sitename); domain != "" {
+		return fmt.Sprintf("//%s/", domain)
+	}
+	if _mainHost != "" {
+		return fmt.Sprintf("//%s/%s", _mainHost, escape(sitename))
+	}
+	return fmt.Sprintf("/%s", escape(sitename))
+}
+
+// Prefix of urls within a site. Sites with a custom domain are served at
+// the root of that domain, and linked with the domain so that links work
+// from the main host and other sites' domains too.
+func sitePrefix(sitename string) string {
+	if domain := siteDomain(sitename); domain != "" {
+		return fmt.Sprintf("//%s", domain)
+	}
+	return fmt.Sprintf("/%s", escape(sitename))
+}
+
+// Redirect a path-based site url ("/<sitename>/...") to the site's current
+// location, keeping the rest of the url path and query. Used for sites that
+// were renamed or mapped to a custom domain.
+func redirectSite(w http.ResponseWriter, r *http.Request, site *Site) {
+	surl := strings.TrimSuffix(siteUrl(site.Sitename), "/")
+	ss := strings.SplitN(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/", 2)
+	if len(ss) == 2 {
+		surl += "/" + ss[1]
+	} else if strings.HasPrefix(surl, "//") {
+		surl += "/"
+	}
+	if r.URL.RawQuery != "" {
+		surl += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, surl, http.StatusMovedPermanently)
+}
+func redirectSiteAlias(db *sql.DB, w http.ResponseWriter, r *http.Request, qsitename string) bool {
+	site := querySiteByAlias(db, qsitename)
+	if site == nil {
+		return false
+	}
+	redirectSite(w, r, site)
+	return true
+}
+
+// Path-based requests for a site with a custom domain are redirected there.
+func redirectSiteDomain(w http.ResponseWriter, r *http.Request, site *Site) bool {
+	if hostSitename(r) != "" || siteDomain(site.Sitename) == "" {
+		return false
+	}
+	redirectSite(w, r, site)
+	return true
+}
+func pageUrl(sitename, title string) string {
+	if sitename == "" && title == "" {
+		return "/"
+	}
+	prefix := sitePrefix(sitename)
+	if title == "" {
+		if strings.HasPrefix(prefix, "//") {
+			return prefix + "/"
+		}
+		return prefix
+	}
+	return fmt.Sprintf("%s/%s", prefix, escapeTitle(title))
+}
+
+// Escape each part of a "Parent/Child" page title for use in a url path.
+func escapeTitle(title string) string {
+	ss := strings.Split(title, "/")
+	for i := range ss {
+		ss[i] = escape(ss[i])
+	}
+	return strings.Join(ss, "/")
+}
+
+// Link to a page for use from other sites.
+func absPageUrl(sitename, title string) string {
+	href := siteUrl(sitename)
+	if title != "" {
+		href = strings.TrimSuffix(href, "/") + "/" + escapeTitle(title)
+	}
+	return href
+}
+
+// Special pages that aren't stored in the site have urls in the form
+// "/<sitename>/~<name>/<arg>", or "/~<name>/<arg>" on a site's custom domain.
+// On the main host, "/~<name>/<arg>" is a special page for all sites and
+// returns an empty sitename.
+func parseSpecialUrl(r *http.Request) (string, string, string, bool) {
+	ss := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	sitename := hostSitename(r)
+	if sitename == "" && !strings.HasPrefix(ss[0], "~") {
+		sitename = unescape(ss[0])
+		ss = ss[1:]
+	}
+	if len(ss) == 0 || len(ss[0]) < 2 || !strings.HasPrefix(ss[0], "~") {
+		return "", "", "", false
+	}
+	var arg string
+	if len(ss) > 1 {
+		arg = unescape(strings.Join(ss[1:], "/"))
+	}
+	return sitename, ss[0][1:], arg, true
+}
+
+// Page listing the pages with a tag, or the tag index if tag is "".
+// sitename "" is for all sites.
+func tagUrl(sitename, tag string) string {
+	if sitename == "" {
+		return fmt.Sprintf("/~tag/%s", escape(tag))
+	}
+	return fmt.Sprintf("%s/~tag/%s", sitePrefix(sitename), escape(tag))
+}
+func searchUrl(sitename string) string {
+	if sitename == "" {
+		return "/~search"
+	}
+	return fmt.Sprintf("%s/~search", sitePrefix(sitename))
+}
+
+func isFileUrl(r *http.Request) bool {
+	ss := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if hostSitename(r) != "" {
+		return len(ss) >= 2 && ss[0] == "~file"
+	}
+	if len(ss) >= 3 && ss[1] == "~file" {
+		return true
+	}
+	return false
+}
+func parseFileUrl(r *http.Request) (string, string) {
+	// file url takes the form "/<sitename>/~file/<filename>"
+	// or "/~file/<filename>" on a site's custom domain
+	surl := strings.Trim(r.URL.Path, "/")
+	ss := strings.Split(surl, "/")
+	if sitename := hostSitename(r); sitename != "" {
+		if len(ss) < 2 {
+			return sitename, ""
+		}
+		return sitename, unescape(ss[1])
+	}
+	sslen := len(ss)
+	if sslen == 0 {
+		return "", ""
+	} else if sslen == 1 || sslen == 2 {
+		return unescape(ss[0]), ""
+	}
+	return unescape(ss[0]), unescape(ss[2])
+}
+func fileUrl(sitename, filename string) string {
+	if sitename == "" && filename == "" {
+		return "/"
+	}
+	if filename == "" {
+		return pageUrl(sitename, "")
+	}
+	return fmt.Sprintf("%s/~file/%s", sitePrefix(sitename), escape(filename))
+}
+
+func getLoginUser(r *http.Request, db *sql.DB) *User {
+	c, err := r.Cookie("userid")
+	if err != nil {
+		return nil
+	}
+	userid := idtoi(c.Value)
+	if userid == 0 {
+		return nil
+	}
+	return queryUserById(db, userid)
+}
+
+func validateLogin(w http.ResponseWriter, login *User) bool {
+	if login.Userid == -1 {
+		http.Error(w, "Not logged in.", 401)
+		return false
+	}
+	if !login.Active {
+		http.Error(w, "Not an active user.", 401)
+		return false
+	}
+	return true
+}
+func handleDbErr(w http.ResponseWriter, err error, sfunc string) bool {
+	if err == sql.ErrNoRows {
+		http.Error(w, "Not found.", 404)
+		return true
+	}
+	if err != nil {
+		log.Printf("%s: database error (%s)\n", sfunc, err)
+		http.Error(w, "Server database error.", 500)
+		return true
+	}
+	return false
+}
+func handleTxErr(tx *sql.Tx, err error) bool {
+	if err != nil {
+		tx.Rollback()
+		return true
+	}
+	return false
+}
+
+// Render a page body or other site markdown to html: markdown, then wiki
+// links, then the site's html sanitizer policy.
+func renderMarkdown(db *sql.DB, site *Site, body string) string {
+	return renderBody(&MacroContext{DB: db, Site: site, Render: &RenderState{}}, body)
+}
+
+// Render a page's body and return it along with its headings. The page is
+// the start of the include chain so that it can't include itself.
+func renderPage(db *sql.DB, site *Site, p *Page) (string, []Heading) {
+	ctx := &MacroContext{
+		DB:       db,
+		Site:     site,
+		Page:     p,
+		Includes: []string{includeKey(site, p.Title)},
+		Render:   &RenderState{},
+	}
+	markup, headings := setHeadingIds(renderBody(ctx, pageContent(p)))
+	markup = strings.Replace(markup, _tocPlaceholder, tocHtml(headings), -1)
+	return markup, headings
+}
+
+type Heading struct {
+	Level int
+	Id    string
+	Text  string
+}
+
+var headingRe = regexp.MustCompile(`(?s)<h([1-6])(?:\s[^>]*)?>(.*?)</h[1-6]>`)
+var headingAnchorRe = regexp.MustCompile(`^\s*<a\s[^>]*class="anchor"[^>]*>.*?</a>\s*`)
+var tagRe = regexp.MustCompile(`<[^>]*>`)
+
+// Give every heading in rendered markup an id made from its text, so that
+// [[Page#Heading]] links and the table of contents can point to it. Repeated
+// headings get a numbered id: heading, heading-1, heading-2, ...
+// Runs after sanitizing, the ids are made only of letters, digits and dashes.
+func setHeadingIds(markup string) (string, []Heading) {
+	var headings []Heading
+	ids := map[string]bool{}
+	markup = headingRe.ReplaceAllStringFunc(markup, func(smatch string) string {
+		matches := headingRe.FindStringSubmatch(smatch)
+		level := atoi(matches[1])
+		inner := headingAnchorRe.ReplaceAllString(matches[2], "")
+		text := strings.TrimSpace(html.UnescapeString(tagRe.ReplaceAllString(inner, "")))
+
+		base := anchorName(text)
+		if base == "" {
+			base = "section"
+		}
+		id := base
+		for i := 1; ids[id]; i++ {
+			id = fmt.Sprintf("%s-%d", base, i)
+		}
+		ids[id] = true
+
+		headings = append(headings, Heading{level, id, text})
+		return fmt.Sprintf("<h%d id=\"%s\"><a class=\"anchor\" href=\"#%s\" aria-hidden=\"true\"><span class=\"octicon octicon-link\"></span></a>%s</h%d>", level, id, id, inner, level)
+	})
+	return markup, headings
+}
+
+// html nested list of links to headings.
+func tocHtml(headings []Heading) string {
+	if len(headings) == 0 {
+		return ""
+	}
+	minlevel := 6
+	for _, h := range headings {
+		if h.Level < minlevel {
+			minlevel = h.Level
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("<div class=\"toc\">\n")
+	depth := 0
+	for _, h := range headings {
+		level := h.Level - minlevel + 1
+		if level > depth {
+			for depth < level {
+				b.WriteString("<ul>\n")
+				depth++
+				if depth < level {
+					b.WriteString("<li>")
+				}
+			}
+		} else {
+			b.WriteString("</li>\n")
+			for depth > level {
+				b.WriteString("</ul>\n</li>\n")
+				depth--
+			}
+		}
+		fmt.Fprintf(&b, "<li><a href=\"#%s\">%s</a>", h.Id, html.EscapeString(h.Text))
+	}
+	b.WriteString("</li>\n")
+	for depth > 0 {
+		b.WriteString("</ul>\n")
+		depth--
+		if depth > 0 {
+			b.WriteString("</li>\n")
+		}
+	}
+	b.WriteString("</div>\n")
+	return b.String()
+}
+
+// Text swapped out while rendering is marked by placeholders delimited by
+// private-use runes. The runes are removed from page text first, so that
+// text written in a page can't be taken for a placeholder.
+const _placeholderStart = "\uE000"
+const _placeholderEnd = "\uE001"
+
+func placeholder(kind string, i int) string {
+	return fmt.Sprintf("%s%s%d%s", _placeholderStart, kind, i, _placeholderEnd)
+}
+
+var placeholderRunesRe = regexp.MustCompile(_placeholderStart + "|" + _placeholderEnd)
+
+func renderBody(ctx *MacroContext, body string) string {
+	site := ctx.Site
+	body = placeholderRunesRe.ReplaceAllString(body, "")
+
+	// Text inside code is left as it is for markdown to render.
+	body, unmask := maskCode(body)
+
+	// Markdown rendering strips all iframes, so iframes allowed by the site
+	// are swapped out for placeholders and put back before sanitizing.
+	var iframes []string
+	if site != nil && site.Iframehosts != "" {
+		body = iframeRe.ReplaceAllStringFunc(body, func(iframe string) string {
+			iframes = append(iframes, iframe)
+			return placeholder("IFRAME", len(iframes)-1)
+		})
+	}
+
+	// Macros output html, which is put back after markdown rendering.
+	var macros []string
+	if site != nil {
+		body = macroRe.ReplaceAllStringFunc(body, func(smatch string) string {
+			matches := macroRe.FindStringSubmatch(smatch)
+			fn, ok := _macros[matches[1]]
+			if !ok {
+				return smatch
+			}
+			macros = append(macros, fn(ctx, matches[2]))
+			return placeholder("MACRO", len(macros)-1)
+		})
+	}
+
+	markup := parseMarkdown(unmask(body))
+	markup = parseLinks(ctx.DB, ctx.Render, markup, site)
+	for i, iframe := range iframes {
+		markup = strings.Replace(markup, placeholder("IFRAME", i), iframe, 1)
+	}
+	for i, macro := range macros {
+		// A macro on its own line is a block, not part of a paragraph.
+		ph := placeholder("MACRO", i)
+		markup = strings.Replace(markup, "<p>"+ph+"</p>", macro, 1)
+		markup = strings.Replace(markup, ph, macro, 1)
+	}
+	return sanitizeHtml(site, markup)
+}
+
+//*** Macros ***
+
+// Page macros are written in a page body as {{name}} or {{name args}} or
+// {{name: args}}, and are replaced by the html that the macro returns.
+//
+// To add a macro, write a MacroFunc and register it in the init() below.
+// The macro receives the rest of the text after its name as args. Its html
+// output goes through the site's sanitizer along with the rest of the page.
+type MacroFunc func(ctx *MacroContext, args string) string
+
+// What a macro is rendering.
+type MacroContext struct {
+	DB       *sql.DB
+	Site     *Site
+	Page     *Page    // nil when rendering the site header or footer
+	Includes []string // chain of included pages, to detect cycles
+	Render   *RenderState
+}
+
+// State shared by all macro contexts of one render, including the contexts
+// of included pages.
+type RenderState struct {
+	NumIncludes int
+	Sites       map[int64]*SiteIndex // loaded as links to each site are rendered
+}
+
+// Return the index of a site's pages and files, loading it on first use in
+// the render. A db error returns an empty index.
+func renderSiteIndex(rs *RenderState, db *sql.DB, siteid int64) *SiteIndex {
+	if idx, ok := rs.Sites[siteid]; ok {
+		return idx
+	}
+	idx, err := querySiteIndex(db, siteid)
+	if err != nil {
+		log.Printf("renderSiteIndex() db err (%s)\n", err)
+		idx = &SiteIndex{Pages: map[string]bool{}, Files: map[string]string{}}
+	}
+	if rs.Sites == nil {
+		rs.Sites = map[int64]*SiteIndex{}
+	}
+	rs.Sites[siteid] = idx
+	return idx
+}
+
+var _macros = map[string]MacroFunc{}
+
+var macroRe = regexp.MustCompile(`\{\{\s*([a-z]+):?\s*(.*?)\s*\}\}`)
+
+func registerMacro(name string, fn MacroFunc) {
+	_macros[name] = fn
+}
+
+func init() {
+	registerMacro("include", macroInclude)
+	registerMacro("pages", macroPages)
+	registerMacro("recent", macroRecent)
+	registerMacro("children", macroChildren)
+	registerMacro("files", macroFiles)
+	registerMacro("toc", macroToc)
+	registerMacro("date", macroDate)
+}
+
+func macroError(msg, args string) string {
+	return fmt.Sprintf("<div class=\"macro-error\">(%s: %s)</div>", msg, html.EscapeString(args))
+}
+
+// html list of links to pages.
+func pageListHtml(site *Site, pp []*Page, showdate bool) string {
+	if len(pp) == 0 {
+		return "<p><em>(no pages)</em></p>\n"
+	}
+	var b strings.Builder
+	b.WriteString("<ul>\n")
+	for _, p := range pp {
+		fmt.Fprintf(&b, "<li><a href=\"%s\">%s</a>", html.EscapeString(pageUrl(site.Sitename, p.Title)), html.EscapeString(p.Title))
+		if showdate && !p.Updatedt.IsZero() {
+			fmt.Fprintf(&b, " <em>%s</em>", p.Updatedt.Format("2006-01-02"))
+		}
+		b.WriteString("</li>\n")
+	}
+	b.WriteString("</ul>\n")
+	return b.String()
+}
+
+// {{include: Title}} or {{include: othersite:Title}} inlines another page.
+// Includes are recorded in the including site's links table only, so
+// pages included from other sites don't show them in their backlinks.
+func macroInclude(ctx *MacroContext, target string) string {
+	incsite, title := resolvePageTarget(ctx.DB, ctx.Site, target)
+
+	p := queryPageByTitle(ctx.DB, incsite.Siteid, title)
+	if p == nil {
+		return macroError("include not found", target)
+	}
+	key := includeKey(incsite, title)
+	for _, k := range ctx.Includes {
+		if k == key {
+			return macroError("include cycle", target)
+		}
+	}
+	if len(ctx.Includes) >= _maxIncludeDepth {
+		return macroError("too many nested includes", target)
+	}
+	// Pages that include the same page more than once multiply at each
+	// level, so also limit the total.
+	if ctx.Render.NumIncludes >= _maxIncludes {
+		return macroError("too many includes", target)
+	}
+	ctx.Render.NumIncludes++
+
+	// Copy the chain so sibling includes don't share the appended slice.
+	inc := &MacroContext{
+		DB:       ctx.DB,
+		Site:     incsite,
+		Page:     p,
+		Includes: append(append([]string{}, ctx.Includes...), key),
+		Render:   ctx.Render,
+	}
+	return fmt.Sprintf("<div class=\"include\">\n%s</div>\n", renderBody(inc, pageContent(p)))
+}
+
+// Max number of nested includes, and of includes in one page render.
+const _maxIncludeDepth = 5
+const _maxIncludes = 50
+
+func includeKey(site *Site, title string) string {
+	return fmt.Sprintf("%d:%s", site.Siteid, title)
+}
+
+// {{pages}} lists all pages in the site.
+func macroPages(ctx *MacroContext, args string) string {
+	pp, err := queryPages(ctx.DB, ctx.Site.Siteid, "title", 0)
+	if err != nil {
+		log.Printf("macroPages() db err (%s)\n", err)
+		return macroError("pages", args)
+	}
+	return pageListHtml(ctx.Site, pp, false)
+}
+
+// {{recent N}} lists the N most recently updated pages (default 10).
+func macroRecent(ctx *MacroContext, args string) string {
+	n := 10
+	if args != "" {
+		n = atoi(args)
+		if n <= 0 {
+			return macroError("recent needs a number of pages", args)
+		}
+	}
+	pp, err := queryPages(ctx.DB, ctx.Site.Siteid, "updatedt", n)
+	if err != nil {
+		log.Printf("macroRecent() db err (%s)\n", err)
+		return macroError("recent", args)
+	}
+	return pageListHtml(ctx.Site, pp, true)
+}
+
+// {{children}} lists pages whose title starts with the current page's
+// title and a slash, ex. "Guide/Install" is a child of "Guide".
+func macroChildren(ctx *MacroContext, args string) string {
+	if ctx.Page == nil {
+		return ""
+	}
+	pp, err := queryPages(ctx.DB, ctx.Site.Siteid, "title", 0)
+	if err != nil {
+		log.Printf("macroChildren() db err (%s)\n", err)
+		return macroError("children", args)
+	}
+	prefix := ctx.Page.Title + "/"
+	var children []*Page
+	for _, p := range pp {
+		if strings.HasPrefix(p.Title, prefix) {
+			children = append(children, p)
+		}
+	}
+	return pageListHtml(ctx.Site, children, false)
+}
+
+// {{files}} lists all files in the site.
+func macroFiles(ctx *MacroContext, args string) string {
+	files, err := queryFiles(ctx.DB, ctx.Site.Siteid)
+	if err != nil {
+		log.Printf("macroFiles() db err (%s)\n", err)
+		return macroError("files", args)
+	}
+	if len(files) == 0 {
+		return "<p><em>(no files)</em></p>\n"
+	}
+	var b strings.Builder
+	b.WriteString("<ul>\n")
+	for _, file := range files {
+		fmt.Fprintf(&b, "<li><a href=\"%s\">%s</a> <em>%s</em></li>\n", html.EscapeString(fileUrl(ctx.Site.Sitename, file.Filename)), html.EscapeString(file.Filename), formatSize(file.Size))
+	}
+	b.WriteString("</ul>\n")
+	return b.String()
+}
+
+// {{toc}} lists the headings of the current page. The headings aren't
+// known until the page is rendered, so renderPage() fills in the list.
+func macroToc(ctx *MacroContext, args string) string {
+	// Only the page being shown gets a toc, not the pages it includes.
+	if ctx.Page == nil || len(ctx.Includes) > 1 {
+		return ""
+	}
+	return _tocPlaceholder
+}
+
+var _tocPlaceholder = placeholder("TOC", 0)
+
+// {{date}} is today's date. An optional Go time layout sets the format,
+// ex. {{date Jan 2, 2006}}.
+func macroDate(ctx *MacroContext, args string) string {
+	layout := "2006-01-02"
+	if args != "" {
+		layout = args
+	}
+	return html.EscapeString(time.Now().Format(layout))
+}
+
+// Split a link or include target into its site and page title. Targets of
+// the form "othersite:Title" refer to a page in another site.
+func resolvePageTarget(db *sql.DB, site *Site, target string) (*Site, string) {
+	if i := strings.Index(target, ":"); i != -1 {
+		if othersite := querySiteBySitename(db, target[:i]); othersite != nil {
+			return othersite, strings.TrimSpace(target[i+1:])
+		}
+	}
+	return site, target
+}
+
+var iframeRe = regexp.MustCompile(`(?is)<iframe\b[^>]*>.*?</iframe>`)
+
+// Sanitizer policies are cached by the site's allowed iframe hosts.
+var _policies = struct {
+	sync.Mutex
+	m map[string]*bluemonday.Policy
+}{m: map[string]*bluemonday.Policy{}}
+
+func sanitizeHtml(site *Site, markup string) string {
+	var iframehosts string
+	if site != nil {
+		iframehosts = site.Iframehosts
+	}
+	_policies.Lock()
+	policy, ok := _policies.m[iframehosts]
+	if !ok {
+		policy = sitePolicy(parseIframeHosts(iframehosts))
+		_policies.m[iframehosts] = policy
+	}
+	_policies.Unlock()
+	return policy.Sanitize(markup)
+}
+
+// Same allow-list as the markdown renderer, plus iframes from the given hosts.
+func sitePolicy(iframehosts []string) *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowAttrs("class").Matching(bluemonday.SpaceSeparatedTokens).OnElements("div", "span")
+	p.AllowAttrs("class", "name").Matching(bluemonday.SpaceSeparatedTokens).OnElements("a")
+	p.AllowAttrs("rel").Matching(regexp.MustCompile(`^nofollow$`)).OnElements("a")
+	p.AllowAttrs("aria-hidden").Matching(regexp.MustCompile(`^true$`)).OnElements("a")
+	p.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	p.AllowAttrs("checked", "disabled").Matching(regexp.MustCompile(`^$`)).OnElements("input")
+	p.AllowDataURIImages()
+
+	if len(iframehosts) > 0 {
+		var quoted []string
+		for _, host := range iframehosts {
+			quoted = append(quoted, regexp.QuoteMeta(host))
+		}
+		srcRe := regexp.MustCompile(fmt.Sprintf(`^https://(%s)(/|$)`, strings.Join(quoted, "|")))
+		p.AllowAttrs("src").Matching(srcRe).OnElements("iframe")
+		p.AllowAttrs("width", "height").Matching(bluemonday.NumberOrPercent).OnElements("iframe")
+		p.AllowAttrs("title").OnElements("iframe")
+		p.AllowAttrs("allowfullscreen").Matching(regexp.MustCompile(`^(|allowfullscreen|true)$`)).OnElements("iframe")
+		p.AllowAttrs("frameborder").Matching(bluemonday.Integer).OnElements("iframe")
+		p.AllowAttrs("allow").Matching(regexp.MustCompile(`^[a-z\-; ]*$`)).OnElements("iframe")
+		p.AllowElements("iframe")
+	}
+	return p
+}
+
+// Allowed iframe hosts are entered one per line, or separated by spaces or
+// commas.
+func parseIframeHosts(s string) []string {
+	var hosts []string
+	for _, host := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\t'
+	}) {
+		host = cleanDomain(host)
+		if host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+func parseMarkdown(s string) string {
+	// Fenced code blocks with a known language are highlighted separately and
+	// put back as html.
+	var codes []string
+	s = fenceRe.ReplaceAllStringFunc(s, func(smatch string) string {
+		matches := fenceRe.FindStringSubmatch(smatch)
+		code, ok := highlightCode(matches[3], matches[1], matches[2])
+		if !ok {
+			return smatch
+		}
+		codes = append(codes, code)
+		return "\n\n" + placeholder("CODE", len(codes)-1) + "\n\n"
+	})
+
+	markup := string(github_flavored_markdown.Markdown([]byte(s)))
+	for i, code := range codes {
+		ph := placeholder("CODE", i)
+		markup = strings.Replace(markup, "<p>"+ph+"</p>", code, 1)
+		markup = strings.Replace(markup, ph, code, 1)
+	}
+	return markup
+}
+
+var codeRe = regexp.MustCompile("(?ms)^```.*?^```[ \t]*$|``[^\n]*?``|`[^`\n]+`")
+
+// Swap fenced code blocks and inline code in markdown for placeholders, so
+// that text in code isn't taken for macros or html. Returns the masked
+// markdown and a func to put the code back.
+func maskCode(s string) (string, func(string) string) {
+	var codes []string
+	s = codeRe.ReplaceAllStringFunc(s, func(code string) string {
+		codes = append(codes, code)
+		return placeholder("MASK", len(codes)-1)
+	})
+	return s, func(s string) string {
+		for i, code := range codes {
+			s = strings.Replace(s, placeholder("MASK", i), code, 1)
+		}
+		return s
+	}
+}
+
+var htmlCodeRe = regexp.MustCompile(`(?is)<pre\b.*?</pre>|<code\b.*?</code>`)
+
+// Same as maskCode() for code in rendered html.
+func maskHtmlCode(s string) (string, func(string) string) {
+	var codes []string
+	s = htmlCodeRe.ReplaceAllStringFunc(s, func(code string) string {
+		codes = append(codes, code)
+		return placeholder("HTMLCODE", len(codes)-1)
+	})
+	return s, func(s string) string {
+		for i, code := range codes {
+			s = strings.Replace(s, placeholder("HTMLCODE", i), code, 1)
+		}
+		return s
+	}
+}
+
+// ```lang [linenos] [hl=2,5-7]
+// code
+// ```
+var fenceRe = regexp.MustCompile("(?ms)^```[ \t]*([\\w+#.-]+)[ \t]*([^\n]*)\n(.*?)\n?^```[ \t]*$")
+
+// Highlight code in lang, returns false if lang isn't known.
+// opts turns on line numbers ("linenos") and highlighted lines ("hl=2,5-7").
+// Tokens are marked with classes, styled in twsrc.css.
+func highlightCode(code, lang, opts string) (string, bool) {
+	lexer := lexers.Get(lang)
+	if lexer == nil {
+		return "", false
+	}
+	fmtopts := []chromahtml.Option{
+		chromahtml.WithClasses(true),
+		chromahtml.WithAllClasses(true),
+		chromahtml.PreventSurroundingPre(true),
+	}
+	for _, opt := range strings.Fields(opts) {
+		if opt == "linenos" {
+			fmtopts = append(fmtopts, chromahtml.WithLineNumbers(true))
+			continue
+		}
+		if strings.HasPrefix(opt, "hl=") {
+			fmtopts = append(fmtopts, chromahtml.HighlightLines(parseLineRanges(strings.TrimPrefix(opt, "hl="))))
+		}
+	}
+
+	it, err := chroma.Coalesce(lexer).Tokenise(nil, code+"\n")
+	if err != nil {
+		return "", false
+	}
+	var b strings.Builder
+	b.WriteString("<div class=\"chroma\"><pre>")
+	err = chromahtml.New(fmtopts...).Format(&b, styles.Fallback, it)
+	if err != nil {
+		log.Printf("highlightCode() err (%s)\n", err)
+		return "", false
+	}
+	b.WriteString("</pre></div>\n")
+	return b.String(), true
+}
+
+// "2,5-7" => [[2,2], [5,7]]
+func parseLineRanges(s string) [][2]int {
+	var ranges [][2]int
+	for _, sr := range strings.Split(s, ",") {
+		ss := strings.SplitN(sr, "-", 2)
+		start := atoi(ss[0])
+		end := start
+		if len(ss) == 2 {
+			end = atoi(ss[1])
+		}
+		if start <= 0 || end < start {
+			continue
+		}
+		ranges = append(ranges, [2]int{start, end})
+	}
+	return ranges
+}
+
+func normalizeText(s string) string {
+	s = strings.ReplaceAll(s, "\r", "") // CRLF => CR
+	return s
+}
+
+//*** Html templates ***
+
+// Html layout templates are embedded from templates/ at build time, or read
+// from the -templates directory to customize them without recompiling.
+//
+//go:embed templates/*.html
+var _templatesFS embed.FS
+var _tmpl *template.Template
+
+var _templateFuncs = template.FuncMap{
+	"formatSize": formatSize,
+	"radioopt": func(sid, optval, lbl string, checked bool) FormField {
+		return FormField{Id: sid, Val: optval, Label: lbl, Checked: checked}
+	},
+	"checkbox": func(sid, lbl string, checked bool) FormField {
+		return FormField{Id: sid, Label: lbl, Checked: checked}
+	},
+}
+
+func loadTemplates(dir string) error {
+	var fsys fs.FS
+	if dir != "" {
+		fsys = os.DirFS(dir)
+	} else {
+		sub, err := fs.Sub(_templatesFS, "templates")
+		if err != nil {
+			return err
+		}
+		fsys = sub
+	}
+	t, err := template.New("").Funcs(_templateFuncs).ParseFS(fsys, "*.html")
+	if err != nil {
+		return err
+	}
+	_tmpl = t
+	return nil
+}
+func execTemplate(P PrintFunc, name string, data interface{}) {
+	var buf bytes.Buffer
+	err := _tmpl.ExecuteTemplate(&buf, name, data)
+	if err != nil {
+		log.Printf("execTemplate() %s (%s)\n", name, err)
+	}
+	P("%s", buf.String())
+}
+
+//*** Html menu template functions ***
+// title is the page being shown, its parent pages are shown as breadcrumbs.
+func printSectionMenuHead(P PrintFunc, site *Site, title string, login *User) {
+	var siteurl string
+	var crumbs []PageRef
+	if site != nil {
+		siteurl = siteUrl(site.Sitename)
+		ss := strings.Split(title, "/")
+		for i := 0; i < len(ss)-1; i++ {
+			crumbs = append(crumbs, PageRef{
+				Title: ss[i],
+				Href:  pageUrl(site.Sitename, strings.Join(ss[:i+1], "/")),
+			})
+		}
+	}
+	execTemplate(P, "sectionmenuhead", struct {
+		Site    *Site
+		Siteurl string
+		Crumbs  []PageRef
+		Login   *User
+	}{site, siteurl, crumbs, login})
+}
+func printSectionMenuFoot(P PrintFunc) {
+	execTemplate(P, "sectionmenufoot", nil)
+}
+func printMenuHead(P PrintFunc, title string) {
+	execTemplate(P, "menuhead", title)
+}
+func printMenuFoot(P PrintFunc) {
+	execTemplate(P, "menufoot", nil)
+}
+func printMenuLine(P PrintFunc, href, text string) {
+	printMenuLineThumb(P, href, text, nil)
+}
+func printMenuLineThumb(P PrintFunc, href, text string, thumb *Thumb) {
+	execTemplate(P, "menuline", struct {
+		Href  string
+		Text  string
+		Thumb *Thumb
+	}{href, text, thumb})
+}
+func printMenuText(P PrintFunc, text string) {
+	execTemplate(P, "menutext", text)
+}
+
+//*** Html form template functions ***
+
+// Template data for form controls. Only the fields used by the control's
+// template need to be set.
+type FormField struct {
+	Id        string
+	Label     string
+	Val       string
+	Size      int
+	Rows      int
+	Type      string
+	Checked   bool
+	Multiple  bool
+	Multipart bool
+	Action    string
+	Opts      [][2]string
+	Thumb     *Thumb
+}
+
+func printFormHead(P PrintFunc, action string) {
+	execTemplate(P, "formhead", FormField{Action: action})
+}
+func printFormHeadMultipart(P PrintFunc, action string) {
+	execTemplate(P, "formhead", FormField{Action: action, Multipart: true})
+}
+func printFormFoot(P PrintFunc) {
+	execTemplate(P, "formfoot", nil)
+}
+func printFormTitle(P PrintFunc, title string) {
+	execTemplate(P, "formtitle", title)
+}
+func printFormControlHead(P PrintFunc) {
+	execTemplate(P, "formcontrolhead", false)
+}
+func printFormControlHeadFlexBetween(P PrintFunc) {
+	execTemplate(P, "formcontrolhead", true)
+}
+func printFormControlFoot(P PrintFunc) {
+	execTemplate(P, "formcontrolfoot", nil)
+}
+func printFormLabel(P PrintFunc, sfor, lbl string) {
+	execTemplate(P, "formlabel", FormField{Id: sfor, Label: lbl})
+}
+func printFormInput(P PrintFunc, sid, val string, size int) {
+	execTemplate(P, "forminput", FormField{Id: sid, Val: val, Size: size})
+}
+func printFormFile(P PrintFunc, sid string) {
+	execTemplate(P, "formfile", FormField{Id: sid})
+}
+func printFormFileMultiple(P PrintFunc, sid string) {
+	execTemplate(P, "formfile", FormField{Id: sid, Multiple: true})
+}
+func printFormRadio(P PrintFunc, sid, optval, lbl string, checked bool) {
+	execTemplate(P, "formradio", FormField{Id: sid, Val: optval, Label: lbl, Checked: checked})
+}
+func printFormCheckbox(P PrintFunc, sid, lbl string, checked bool) {
+	execTemplate(P, "formcheckbox", FormField{Id: sid, Label: lbl, Checked: checked})
+}
+func printFormSelect(P PrintFunc, sid string, opts [][2]string, val string) {
+	execTemplate(P, "formselect", FormField{Id: sid, Opts: opts, Val: val})
+}
+func printFormTextarea(P PrintFunc, sid, val string, rows int) {
+	execTemplate(P, "formtextarea", FormField{Id: sid, Val: val, Rows: rows})
+}
+func printFormHidden(P PrintFunc, sid, val string) {
+	execTemplate(P, "formhidden", FormField{Id: sid, Val: val})
+}
+func printFormButton(P PrintFunc, sid, lbl, stype string) {
+	execTemplate(P, "formbutton", FormField{Id: sid, Label: lbl, Type: stype})
+}
+func printFormSubmitButton(P PrintFunc, sid, lbl string) {
+	printFormButton(P, sid, lbl, "submit")
+}
+func printFormSpacer(P PrintFunc) {
+	execTemplate(P, "formspacer", nil)
+}
+func printFormCancel(P PrintFunc, href string) {
+	execTemplate(P, "formcancel", href)
+}
+func printFormHelp(P PrintFunc, text string) {
+	execTemplate(P, "formhelp", text)
+}
+func printFormControlError(P PrintFunc, errmsg string) {
+	if errmsg != "" {
+		execTemplate(P, "formerror", errmsg)
+	}
+}
+func printFormControlInput(P PrintFunc, sid, lbl, val string, size int) {
+	printFormControlHead(P)
+	printFormLabel(P, sid, lbl)
+	printFormInput(P, sid, val, size)
+	printFormControlFoot(P)
+}
+func printFormControlFile(P PrintFunc, sid, lbl string) {
+	printFormControlHead(P)
+	printFormLabel(P, sid, lbl)
+	printFormFile(P, sid)
+	printFormControlFoot(P)
+}
+func printFormControlFileMultiple(P PrintFunc, sid, lbl string) {
+	execTemplate(P, "formcontrolfilemultiple", FormField{Id: sid, Label: lbl, Multiple: true})
+}
+func printFormControlRadio(P PrintFunc, sid, lbl string, opts [][2]string, val string) {
+	execTemplate(P, "formcontrolradio", FormField{Id: sid, Label: lbl, Opts: opts, Val: val})
+}
+func printFormControlCheckbox(P PrintFunc, sid, lbl string, checked bool) {
+	printFormControlHead(P)
+	printFormCheckbox(P, sid, lbl, checked)
+	printFormControlFoot(P)
+}
+func printFormControlSelect(P PrintFunc, sid, lbl string, opts [][2]string, val string) {
+	printFormControlHead(P)
+	printFormLabel(P, sid, lbl)
+	printFormSelect(P, sid, opts, val)
+	printFormControlFoot(P)
+}
+func printFormControlTextarea(P PrintFunc, sid, lbl, val string, rows int) {
+	printFormControlHead(P)
+	printFormLabel(P, sid, lbl)
+	printFormTextarea(P, sid, val, rows)
+	printFormControlFoot(P)
+}
+func printFormControlButton(P PrintFunc, sid, lbl, stype string) {
+	printFormControlHead(P)
+	printFormButton(P, sid, lbl, stype)
+	printFormControlFoot(P)
+}
+func printFormControlSubmitButton(P PrintFunc, sid, lbl string) {
+	printFormControlButton(P, sid, lbl, "submit")
+}
+
+//*** Other html template functions ***
+
+// Site themes are stylesheets in static/themes/ loaded after style.css.
+var _themes = [][2]string{
+	{"", "Default"},
+	{"dark", "Dark"},
+	{"sepia", "Sepia"},
+	{"serif", "Serif"},
+}
+
+func isTheme(theme string) bool {
+	for _, t := range _themes {
+		if t[0] == theme {
+			return true
+		}
+	}
+	return false
+}
+
+// Stylesheets for a site's theme and custom css, to pass to printHead().
+func siteCssUrls(site *Site) []string {
+	if site == nil {
+		return nil
+	}
+	var cssurls []string
+	if site.Theme != "" {
+		cssurls = append(cssurls, fmt.Sprintf("/static/themes/%s.css", site.Theme))
+	}
+	if site.Css != "" {
+		// Version param changes with the css so that it can be cached.
+		cssurls = append(cssurls, fmt.Sprintf("/sitecss/?siteid=%d&v=%s", site.Siteid, hashBytes([]byte(site.Css))[:12]))
+	}
+	return cssurls
+}
+func printHead(P PrintFunc, jsurls []string, cssurls []string, title string) {
+	// Stylesheet urls are generated by t2, including data: urls for
+	// previewing site css, so they're passed as trusted urls.
+	var tcssurls []template.URL
+	for _, cssurl := range cssurls {
+		tcssurls = append(tcssurls, template.URL(cssurl))
+	}
+	execTemplate(P, "head", struct {
+		Title   string
+		Cssurls []template.URL
+		Jsurls  []string
+	}{title, tcssurls, jsurls})
+}
+func printFoot(P PrintFunc) {
+	execTemplate(P, "foot", nil)
+}
+func printSidebar(P PrintFunc, db *sql.DB) {
+	execTemplate(P, "sidebarhead", nil)
+	printSitesMenu(P, db)
+	execTemplate(P, "sidebarfoot", nil)
+}
+func printFooter(P PrintFunc, db *sql.DB, site *Site) {
+	var markup template.HTML
+	if site != nil && site.Footer != "" {
+		markup = template.HTML(renderMarkdown(db, site, site.Footer))
+	}
+	execTemplate(P, "footer", markup)
+}
+func printMainHead(P PrintFunc) {
+	execTemplate(P, "mainhead", nil)
+}
+func printMainFoot(P PrintFunc) {
+	execTemplate(P, "mainfoot", nil)
+}
+func printContentDiv(P PrintFunc, markup string) {
+	// Print html markup wrapped in a <div class="content"> container.
+	// markup is trusted html, such as sanitized markdown output.
+	execTemplate(P, "contentdiv", template.HTML(markup))
+}
+func printBoxHead(P PrintFunc, class string) {
+	execTemplate(P, "boxhead", class)
+}
+func printBoxFoot(P PrintFunc) {
+	execTemplate(P, "boxfoot", nil)
+}
+
+func printPageNav(P PrintFunc, pageTitle string) {
+	if pageTitle == "" {
+		return
+	}
+	execTemplate(P, "pagenav", pageTitle)
+}
+
+func indexHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isFileUrl(r) {
+			printFile(db, w, r)
+			return
+		}
+		if sitename, name, arg, ok := parseSpecialUrl(r); ok {
+			if name == "tag" {
+				printTagPage(db, w, r, sitename, arg)
+				return
+			}
+			if name == "search" {
+				printSearchPage(db, w, r, sitename)
+				return
+			}
+		}
+
+		login := getLoginUser(r, db)
+		qsitename, qtitle := parsePageUrl(r)
+
+		var site *Site
+		var p *Page
+		if qsitename != "" {
+			site = querySiteBySitename(db, qsitename)
+			if site == nil && redirectSiteAlias(db, w, r, qsitename) {
+				return
+			}
+			if site != nil && redirectSiteDomain(w, r, site) {
+				return
+			}
+		}
+
+		for {
+			if site == nil {
+				break
+			}
+			if qtitle != "" {
+				p = queryPageByTitle(db, site.Siteid, qtitle)
+				if p == nil {
+					if ap := queryPageByAlias(db, site.Siteid, qtitle); ap != nil {
+						http.Redirect(w, r, pageUrl(site.Sitename, ap.Title), http.StatusMovedPermanently)
+						return
+					}
+				}
+				break
+			}
+
+			// No page title requested so show the 'index' page (page_id = 1).
+			p = queryPageById(db, site.Siteid, 1)
+			if p == nil {
+				// If no index page, create it.
+				p = &Page{
+					Pageid: 1,
+					Title:  fmt.Sprintf("%s start page", site.Sitename),
+					Body:   "(Edit this page to fill in start page content)",
+				}
+				err := createIndexPage(db, site, p)
+				if handleDbErr(w, err, "indexHandler") {
+					return
+				}
+			}
+			qtitle = p.Title
+			break
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		P := makePrintFunc(w)
+		printHead(P, nil, siteCssUrls(site), "t2")
+
+		// Render the page first so that its headings can go in the menu.
+		var headings []Heading
+		if p != nil {
+			p.Body, headings = renderPage(db, site, p)
+		}
+		layout := ""
+		if p != nil {
+			layout = p.Layout
+		}
+		if layout != "full" {
+			printSectionMenu(P, db, site, p, qtitle, headings, login)
+		}
+		printMain(P, db, site, p, qtitle, login)
+
+		if layout == "" {
+			printSidebar(P, db)
+		}
+		printFoot(P)
+		printFooter(P, db, site)
+	}
+}
+
+func printSectionMenu(P PrintFunc, db *sql.DB, site *Site, p *Page, qtitle string, headings []Heading, login *User) {
+	printSectionMenuHead(P, site, qtitle, login)
+	defer func() {
+		printNavMenu(P, site)
+		if site == nil || !site.Navonly {
+			printPagesMenu(P, db, site, qtitle)
+		}
+		printTagsMenu(P, db, site)
+		printFilesMenu(P, db, site)
+		printSectionMenuFoot(P)
+	}()
+
+	if site == nil {
+		printMenuHead(P, "Actions")
+		printMenuLine(P, "/createsite/", "Create Site")
+		printMenuLine(P, "/clonesite/", "Clone Site")
+		printMenuLine(P, "/trash/", "Deleted Sites")
+		printMenuFoot(P)
+		return
+	}
+
+	if qtitle == "" {
+		printMenuHead(P, "Actions")
+		printMenuLine(P, fmt.Sprintf("/editsite?siteid=%d", site.Siteid), "Site Settings")
+		printMenuLine(P, fmt.Sprintf("/uploadfile?siteid=%d", site.Siteid), "Upload Files")
+		printMenuLine(P, fmt.Sprintf("/createpage?siteid=%d", site.Siteid), "Create Page")
+		printMenuFoot(P)
+		return
+	}
+
+	if p == nil {
+		printMenuHead(P, "Actions")
+		printMenuLine(P, fmt.Sprintf("/editsite?siteid=%d", site.Siteid), "Site Settings")
+		printMenuLine(P, fmt.Sprintf("/uploadfile?siteid=%d", site.Siteid), "Upload Files")
+		href := fmt.Sprintf("/createpage?siteid=%d&title=%s", site.Siteid, escape(qtitle))
+		link := fmt.Sprintf("Create page '%s'", qtitle)
+		printMenuLine(P, href, link)
+		printMenuFoot(P)
+		return
+	}
+
+	printMenuHead(P, "Actions")
+	printMenuLine(P, fmt.Sprintf("/editsite?siteid=%d", site.Siteid), "Site Settings")
+	printMenuLine(P, fmt.Sprintf("/uploadfile?siteid=%d", site.Siteid), "Upload Files")
+	printMenuLine(P, fmt.Sprintf("/createpage?siteid=%d", site.Siteid), "Create Page")
+	printMenuLine(P, fmt.Sprintf("/editpage?siteid=%d&pageid=%d", site.Siteid, p.Pageid), "Edit Page")
+	printMenuLine(P, fmt.Sprintf("/createpage?siteid=%d&title=%s", site.Siteid, escape(p.Title+"/")), "Create Child Page")
+	printMenuLine(P, fmt.Sprintf("/movepage?siteid=%d&pageid=%d", site.Siteid, p.Pageid), "Move Page")
+	printMenuFoot(P)
+
+	if site.Toc && len(headings) > 0 {
+		printMenuHead(P, "Contents")
+		for _, h := range headings {
+			printMenuLine(P, "#"+h.Id, h.Text)
+		}
+		printMenuFoot(P)
+	}
+
+	printBacklinksMenu(P, db, site, p)
+}
+
+// Pages in the site that link to or include page p. Links and includes
+// from other sites aren't tracked.
+func printBacklinksMenu(P PrintFunc, db *sql.DB, site *Site, p *Page) {
+	linking, err := queryLinkingPages(db, site.Siteid, "page", p.Title)
+	if err != nil {
+		log.Printf("printBacklinksMenu() db err (%s)\n", err)
+		return
+	}
+	including, err := queryLinkingPages(db, site.Siteid, "include", p.Title)
+	if err != nil {
+		log.Printf("printBacklinksMenu() db err (%s)\n", err)
+		return
+	}
+	if len(linking) == 0 && len(including) == 0 {
+		return
+	}
+
+	printMenuHead(P, "Backlinks")
+	for _, lp := range linking {
+		printMenuLine(P, pageUrl(site.Sitename, lp.Title), lp.Title)
+	}
+	for _, ip := range including {
+		printMenuLine(P, pageUrl(site.Sitename, ip.Title), ip.Title+" (includes)")
+	}
+	printMenuFoot(P)
+}
+
+func printMain(P PrintFunc, db *sql.DB, site *Site, p *Page, qtitle string, login *User) {
+	printMainHead(P)
+	defer printMainFoot(P)
+
+	if site == nil {
+		return
+	}
+
+	if site.Header != "" {
+		execTemplate(P, "siteheader", template.HTML(renderMarkdown(db, site, site.Header)))
+	}
+
+	printPageNav(P, qtitle)
+
+	if p == nil {
+		printContentDiv(P, "<p class=\"italic\">(Page not found)</p>")
+		return
+	}
+
+	// p.Body was rendered by the caller.
+	printContentDiv(P, p.Body)
+	printPageTags(P, db, site, p)
+}
+
+// A tag linked to its tag page, for templates.
+type TagRef struct {
+	Tag   string
+	Href  string
+	Count int
+	Class string // text size in the tag cloud
+}
+
+func printPageTags(P PrintFunc, db *sql.DB, site *Site, p *Page) {
+	tags, err := queryPageTags(db, site.Siteid, p.Pageid)
+	if err != nil {
+		log.Printf("printPageTags() db err (%s)\n", err)
+		return
+	}
+	if len(tags) == 0 {
+		return
+	}
+	var refs []TagRef
+	for _, tag := range tags {
+		refs = append(refs, TagRef{Tag: tag, Href: tagUrl(site.Sitename, tag)})
+	}
+	execTemplate(P, "pagetags", refs)
+}
+
+// Site's tags or the tags of all sites if site is nil, with tags on more
+// pages shown larger.
+func printTagsMenu(P PrintFunc, db *sql.DB, site *Site) {
+	var tags []TagCount
+	var err error
+	var sitename string
+	if site == nil {
+		tags, err = queryAllTags(db)
+	} else {
+		sitename = site.Sitename
+		tags, err = querySiteTags(db, site.Siteid)
+	}
+	if err != nil {
+		log.Printf("printTagsMenu() db err (%s)\n", err)
+		return
+	}
+	// Search is shown even when there are no tags.
+	if len(tags) == 0 {
+		printMenuHead(P, "Search")
+		printMenuLine(P, searchUrl(sitename), "Search...")
+		printMenuFoot(P)
+		return
+	}
+
+	maxcount := 1
+	for _, tc := range tags {
+		if tc.Count > maxcount {
+			maxcount = tc.Count
+		}
+	}
+	sizes := []string{"text-xs", "text-sm", "text-base", "text-lg"}
+	var refs []TagRef
+	for _, tc := range tags {
+		size := 0
+		if maxcount > 1 {
+			size = (tc.Count - 1) * (len(sizes) - 1) / (maxcount - 1)
+		}
+		refs = append(refs, TagRef{
+			Tag:   tc.Tag,
+			Href:  tagUrl(sitename, tc.Tag),
+			Count: tc.Count,
+			Class: sizes[size],
+		})
+	}
+
+	printMenuHead(P, "Tags")
+	execTemplate(P, "tagcloud", refs)
+	printMenuLine(P, searchUrl(sitename), "Search...")
+	printMenuFoot(P)
+}
+
+// Pages matching q and tag in site, or in all sites if site is nil.
+func searchSitePages(db *sql.DB, site *Site, q, tag string) ([]PageRef, error) {
+	if site != nil {
+		pp, err := searchPages(db, site.Siteid, q, tag)
+		if err != nil {
+			return nil, err
+		}
+		return pageRefs(site, pp), nil
+	}
+
+	sites, err := querySites(db, false)
+	if err != nil {
+		return nil, err
+	}
+	var refs []PageRef
+	for _, site := range sites {
+		pp, err := searchPages(db, site.Siteid, q, tag)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range pp {
+			refs = append(refs, PageRef{
+				Title:   p.Title,
+				Href:    absPageUrl(site.Sitename, p.Title),
+				Site:    site.Sitename,
+				Summary: p.Summary,
+			})
+		}
+	}
+	return refs, nil
+}
+
+// Site for a special page url, writing a redirect or error if there isn't
+// one to show. sitename "" returns nil for all sites.
+func specialPageSite(db *sql.DB, w http.ResponseWriter, r *http.Request, sitename string) (*Site, bool) {
+	if sitename == "" {
+		return nil, true
+	}
+	site := querySiteBySitename(db, sitename)
+	if site == nil {
+		if !redirectSiteAlias(db, w, r, sitename) {
+			http.Error(w, fmt.Sprintf("site '%s' not found.", sitename), 404)
+		}
+		return nil, false
+	}
+	if redirectSiteDomain(w, r, site) {
+		return nil, false
+	}
+	return site, true
+}
+
+// "/<sitename>/~tag/<tag>" lists the pages with tag, and "/~tag/<tag>" lists
+// them across all sites. Without a tag, all tags are listed.
+func printTagPage(db *sql.DB, w http.ResponseWriter, r *http.Request, sitename string, tag string) {
+	site, ok := specialPageSite(db, w, r, sitename)
+	if !ok {
+		return
+	}
+	login := getLoginUser(r, db)
+	tag = strings.ToLower(strings.TrimSpace(tag))
+
+	var refs []PageRef
+	var err error
+	if tag != "" {
+		refs, err = searchSitePages(db, site, "", tag)
+		if handleDbErr(w, err, "printTagPage") {
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	P := makePrintFunc(w)
+	title := "Tags"
+	if tag != "" {
+		title = fmt.Sprintf("Tag: %s", tag)
+	}
+	printHead(P, nil, siteCssUrls(site), title)
+
+	printSectionMenu(P, db, site, nil, "", nil, login)
+
+	printMainHead(P)
+	printPageNav(P, title)
+	if tag != "" {
+		execTemplate(P, "pagelist", refs)
+	} else {
+		printTagsMenu(P, db, site)
+	}
+	printMainFoot(P)
+
+	printSidebar(P, db)
+	printFoot(P)
+	printFooter(P, db, site)
+}
+
+// "/<sitename>/~search?q=text&tag=tag" searches a site's pages, and
+// "/~search" searches all sites.
+func printSearchPage(db *sql.DB, w http.ResponseWriter, r *http.Request, sitename string) {
+	site, ok := specialPageSite(db, w, r, sitename)
+	if !ok {
+		return
+	}
+	login := getLoginUser(r, db)
+	q := strings.TrimSpace(r.FormValue("q"))
+	tag := strings.ToLower(strings.TrimSpace(r.FormValue("tag")))
+
+	var tags []TagCount
+	var err error
+	if site == nil {
+		tags, err = queryAllTags(db)
+	} else {
+		tags, err = querySiteTags(db, site.Siteid)
+	}
+	if handleDbErr(w, err, "printSearchPage") {
+		return
+	}
+	var refs []PageRef
+	if q != "" || tag != "" {
+		refs, err = searchSitePages(db, site, q, tag)
+		if handleDbErr(w, err, "printSearchPage") {
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	P := makePrintFunc(w)
+	printHead(P, nil, siteCssUrls(site), "Search")
+
+	printSectionMenu(P, db, site, nil, "", nil, login)
+
+	printMainHead(P)
+	printPageNav(P, "Search")
+	execTemplate(P, "searchform", struct {
+		Action string
+		Q      string
+		Tag    string
+		Tags   []TagCount
+	}{searchUrl(sitename), q, tag, tags})
+	if q != "" || tag != "" {
+		execTemplate(P, "pagelist", refs)
+	}
+	printMainFoot(P)
+
+	printSidebar(P, db)
+	printFoot(P)
+	printFooter(P, db, site)
+}
+
+func parseLinks(db *sql.DB, rs *RenderState, body string, site *Site) string {
+	if site == nil {
+		return body
+	}
+	idx := renderSiteIndex(rs, db, site.Siteid)
+
+	// Links written in code are shown as they are.
+	body, unmask := maskHtmlCode(body)
+
+	// ![[file1.png]] => <img src="/sitename/~file/file1.png">
+	// ![[file1.png|400]] => <img src="/sitename/~file/file1.png?w=400">
+	// ![[file1.png#left]] => <img src="/sitename/~file/file1.png#left">
+	sre := `!\[\[(.+?)(?:\|(\d+))?\]\]`
+	re := regexp.MustCompile(sre)
+	body = re.ReplaceAllStringFunc(body, func(smatch string) string {
+		matches := re.FindStringSubmatch(smatch)
+
+		// Body is already html, so unescape before building the url.
+		filename, frag := html.UnescapeString(matches[1]), ""
+		if i := strings.Index(filename, "#"); i != -1 {
+			filename, frag = filename[:i], filename[i:]
+		}
+		filename = strings.TrimSpace(filename)
+
+		// Use the file's alt text, or the filename if it has none.
+		alt := filename
+		if fileAlt := idx.Files[filename]; fileAlt != "" {
+			alt = fileAlt
+		}
+
+		src := fileUrl(site.Sitename, filename)
+		if matches[2] != "" {
+			src += "?w=" + matches[2]
+		}
+		// Keep any #fragment (ex. "#left") after the query string.
+		src += frag
+		return fmt.Sprintf("<img src=\"%s\" alt=\"%s\">", html.EscapeString(src), html.EscapeString(alt))
+	})
+
+	// [[Target Page]] => <a href="/sitename/Target+Page">Target Page</a>
+	// [[Target Page|label]] => <a href="/sitename/Target+Page">label</a>
+	// [[Target Page#Section]] => <a href="/sitename/Target+Page#section">Target Page#Section</a>
+	// [[othersite:Target Page]] => <a href="/othersite/Target+Page">othersite:Target Page</a>
+	// [[~file/file1.pdf|label]] => <a href="/sitename/~file/file1.pdf">label</a>
+	// Links to pages or files that don't exist get class "redlink".
+	sre = `\[\[(.+?)\]\]`
+	re = regexp.MustCompile(sre)
+	body = re.ReplaceAllStringFunc(body, func(smatch string) string {
+		matches := re.FindStringSubmatch(smatch)
+		link := parseWikiLink(db, rs, site, html.UnescapeString(matches[1]))
+		if link.Missing {
+			return fmt.Sprintf("<a class=\"redlink\" href=\"%s\">%s</a>", html.EscapeString(link.Href), html.EscapeString(link.Label))
+		}
+		return fmt.Sprintf("<a href=\"%s\">%s</a>", html.EscapeString(link.Href), html.EscapeString(link.Label))
+	})
+
+	return unmask(body)
+}
+
+type WikiLink struct {
+	Href    string
+	Label   string
+	Missing bool
+}
+
+// Parse the text inside [[...]] into a link.
+func parseWikiLink(db *sql.DB, rs *RenderState, site *Site, text string) WikiLink {
+	target, label := text, ""
+	if i := strings.Index(text, "|"); i != -1 {
+		target, label = text[:i], strings.TrimSpace(text[i+1:])
+	}
+	target = strings.TrimSpace(target)
+	hasLabel := label != ""
+	if !hasLabel {
+		label = strings.TrimPrefix(target, "~file/")
+	}
+
+	var section string
+	if i := strings.Index(target, "#"); i != -1 {
+		target, section = strings.TrimSpace(target[:i]), strings.TrimSpace(target[i+1:])
+	}
+	var frag string
+	if section != "" {
+		frag = "#" + anchorName(section)
+	}
+
+	// [[#Section]] links within the current page.
+	if target == "" {
+		return WikiLink{Href: frag, Label: label}
+	}
+
+	if strings.HasPrefix(target, "~file/") {
+		filename := strings.TrimPrefix(target, "~file/")
+		_, ok := renderSiteIndex(rs, db, site.Siteid).Files[filename]
+		return WikiLink{
+			Href:    fileUrl(site.Sitename, filename),
+			Label:   label,
+			Missing: !ok,
+		}
+	}
+
+	// "othersite:Title" links to a page in another site. Titles containing
+	// ':' that don't start with a sitename are plain page titles.
+	linksite, title := resolvePageTarget(db, site, target)
+	if linksite.Siteid == site.Siteid && title != target && !hasLabel {
+		// [[thissite:Title]] is labeled as a plain [[Title]].
+		label = strings.TrimSpace(label[strings.Index(label, ":")+1:])
+	}
+	if linksite.Siteid != site.Siteid {
+		return WikiLink{
+			Href:    absPageUrl(linksite.Sitename, title) + frag,
+			Label:   label,
+			Missing: title != "" && !renderSiteIndex(rs, db, linksite.Siteid).Pages[title],
+		}
+	}
+
+	return WikiLink{
+		Href:    pageUrl(site.Sitename, title) + frag,
+		Label:   label,
+		Missing: title != "" && !renderSiteIndex(rs, db, site.Siteid).Pages[title],
+	}
+}
+
+// Anchor name of a heading, as generated by the markdown renderer.
+func anchorName(heading string) string {
+	return sanitized_anchor_name.Create(heading)
+}
+
+// Site navigation menu is edited in site settings, one link per line:
+// "Page Title" or "Label | Page Title" or "Label | https://example.com".
+type NavLink struct {
+	Label string
+	Href  string
+}
+
+func parseSiteNav(site *Site) []NavLink {
+	var links []NavLink
+	for _, line := range strings.Split(site.Nav, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		label, target := line, line
+		if i := strings.Index(line, "|"); i != -1 {
+			label = strings.TrimSpace(line[:i])
+			target = strings.TrimSpace(line[i+1:])
+		}
+		if target == "" {
+			continue
+		}
+		if label == "" {
+			label = target
+		}
+
+		var href string
+		lower := strings.ToLower(target)
+		if strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") || strings.HasPrefix(lower, "mailto:") {
+			href = target
+		} else {
+			href = pageUrl(site.Sitename, target)
+		}
+		links = append(links, NavLink{Label: label, Href: href})
+	}
+	return links
+}
+func printNavMenu(P PrintFunc, site *Site) {
+	if site == nil {
+		return
+	}
+	links := parseSiteNav(site)
+	if len(links) == 0 {
+		return
+	}
+
+	printMenuHead(P, "Navigation")
+	for _, link := range links {
+		printMenuLine(P, link.Href, link.Label)
+	}
+	printMenuFoot(P)
+}
+
+// Pages menu shown as a tree of "Parent/Child" titles, with the branches
+// leading to and below the current page (title) opened.
+func printPagesMenu(P PrintFunc, db *sql.DB, site *Site, title string) {
+	if site == nil {
+		return
+	}
+
+	printMenuHead(P, "Pages")
+	defer printMenuFoot(P)
+
+	pp, err := queryPages(db, site.Siteid, "title", 0)
+	if err != nil {
+		log.Printf("printPagesMenu() db err (%s)\n", err)
+		return
+	}
+	if len(pp) == 0 {
+		printMenuText(P, "(no pages yet)")
+		return
+	}
+	execTemplate(P, "pagetree", pageTree(site, pp, title))
+}
+
+// A node in the pages tree. Nodes without a page of their own have no Href.
+type PageNode struct {
+	Name     string
+	Href     string
+	Open     bool
+	Current  bool
+	Children []*PageNode
+}
+
+func pageTree(site *Site, pp []*Page, current string) []*PageNode {
+	var roots []*PageNode
+	nodes := map[string]*PageNode{}
+	for _, p := range pp {
+		ss := strings.Split(p.Title, "/")
+		var parent *PageNode
+		for i := range ss {
+			path := strings.Join(ss[:i+1], "/")
+			node := nodes[path]
+			if node == nil {
+				node = &PageNode{
+					Name: ss[i],
+					Open: current == path || strings.HasPrefix(current, path+"/"),
+				}
+				nodes[path] = node
+				if parent == nil {
+					roots = append(roots, node)
+				} else {
+					parent.Children = append(parent.Children, node)
+				}
+			}
+			parent = node
+		}
+		parent.Href = pageUrl(site.Sitename, p.Title)
+		parent.Current = p.Title == current
+	}
+	return roots
+}
+
+func printFilesMenu(P PrintFunc, db *sql.DB, site *Site) {
+	if site == nil {
+		return
+	}
+
+	printMenuHead(P, "Files")
+	defer printMenuFoot(P)
+
+	s := fmt.Sprintf("SELECT filename, content_type FROM %s ORDER BY filename", filetblName(site.Siteid))
+	rows, err := db.Query(s)
+	if err != nil {
+		log.Printf("printFilesMenu() db err (%s)\n", err)
+		return
+	}
+	var filename, ctype string
+	i := 0
+	for rows.Next() {
+		rows.Scan(&filename, &ctype)
+		printMenuLineThumb(P, fileUrl(site.Sitename, filename), filename, fileThumb(site, filename, ctype, 16))
+		i++
+	}
+	if i == 0 {
+		printMenuText(P, "(no files yet)")
+	}
+}
+
+// Inline <img> thumbnail, Src is fetched at double Width for high dpi screens.
+type Thumb struct {
+	Src   string
+	Width int
+}
+
+// Thumbnail of an image file for file lists, or nil if not an image.
+func fileThumb(site *Site, filename, ctype string, width int) *Thumb {
+	if !isResizableImage(ctype) {
+		return nil
+	}
+	return &Thumb{
+		Src:   fmt.Sprintf("%s?w=%d", fileUrl(site.Sitename, filename), width*2),
+		Width: width,
+	}
+}
+
+func printSitesMenu(P PrintFunc, db *sql.DB) {
+	printMenuHead(P, "Sites")
+	defer printMenuFoot(P)
+
+	s := "SELECT site_id, sitename, desc FROM site ORDER BY site_id"
+	rows, err := db.Query(s)
+	if err != nil {
+		log.Printf("printSitesMenu() db err (%s)\n", err)
+		return
+	}
+	var site Site
+	i := 0
+	for rows.Next() {
+		rows.Scan(&site.Siteid, &site.Sitename, &site.Desc)
+		printMenuLine(P, siteUrl(site.Sitename), site.Sitename)
+		i++
+	}
+	if i == 0 {
+		printMenuText(P, "(no sites yet)")
+	}
+}
+
+func createsiteHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var errmsg string
+		var site Site
+
+		login := getLoginUser(r, db)
+		if !validateLogin(w, login) {
+			return
+		}
+
+		// /clonesite/ can copy any site, /createsite/ only offers template sites.
+		isclone := strings.HasPrefix(r.URL.Path, "/clonesite")
+		action := "/createsite/"
+		title := "Create Site"
+		formtitle := "Create site"
+		if isclone {
+			action = "/clonesite/"
+			title = "Clone Site"
+			formtitle = "Clone site"
+		}
+
+		srcsites, err := querySites(db, !isclone)
+		if err != nil {
+			log.Printf("Error querying sites (%s)\n", err)
+			errmsg = "A problem occured. Please try again."
+		}
+		qsrcsiteid := idtoi(r.FormValue("srcsiteid"))
+
+		if r.Method == "POST" {
+			site.Sitename = strings.TrimSpace(r.FormValue("sitename"))
+			site.Desc = strings.TrimSpace(r.FormValue("desc"))
+			site.Desc = normalizeText(site.Desc)
+			for {
+				if site.Sitename == "" {
+					errmsg = "Please enter a site name."
+					break
+				}
+				if strings.HasPrefix(site.Sitename, "~") {
+					errmsg = "Site name can't start with '~'."
+					break
+				}
+				var srcsite *Site
+				for _, s := range srcsites {
+					if s.Siteid == qsrcsiteid {
+						srcsite = s
+					}
+				}
+				if isclone && srcsite == nil {
+					errmsg = "Please select a site to clone."
+					break
+				}
+				if srcsite == nil {
+					_, err = createSite(db, &site)
+				} else {
+					_, err = cloneSite(db, srcsite, &site)
+				}
+				if err == errQuotaExceeded {
+					errmsg = fmt.Sprintf("Site files exceed the new site's storage quota of %s.", formatSize(siteQuota(&site)))
+					break
+				}
+				if err != nil {
+					log.Printf("Error creating site (%s)\n", err)
+					errmsg = "A problem occured. Please try again."
+					break
+				}
+				http.Redirect(w, r, pageUrl(site.Sitename, ""), http.StatusSeeOther)
+				return
+			}
+		}
+
+		opts := [][2]string{}
+		if !isclone {
+			opts = append(opts, [2]string{"0", "(blank site)"})
+		}
+		for _, s := range srcsites {
+			opts = append(opts, [2]string{itoa(s.Siteid), s.Sitename})
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		P := makePrintFunc(w)
+		printHead(P, nil, nil, title)
+
+		printSectionMenuHead(P, nil, "", login)
+		printSectionMenuFoot(P)
+
+		printMainHead(P)
+		printFormHead(P, action)
+		printFormTitle(P, formtitle)
+		printFormControlError(P, errmsg)
+		if isclone {
+			printFormControlSelect(P, "srcsiteid", "Site to clone", opts, itoa(qsrcsiteid))
+		} else if len(srcsites) > 0 {
+			printFormControlSelect(P, "srcsiteid", "Start from template", opts, itoa(qsrcsiteid))
+		}
+		printFormControlInput(P, "sitename", "Sitename (enter a unique site name)", site.Sitename, 10)
+		printFormControlTextarea(P, "desc", "Description", site.Desc, 10)
+		printFormControlSubmitButton(P, "create", "Create")
+		printFormFoot(P)
+		printMainFoot(P)
+
+		printSidebar(P, db)
+
+		printFoot(P)
+	}
+}
+
+func editsiteHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var errmsg string
+		login := getLoginUser(r, db)
+		if !validateLogin(w, login) {
+			return
+		}
+
+		qsiteid := idtoi(r.FormValue("siteid"))
+		site := querySiteById(db, qsiteid)
+		if site == nil {
+			http.Error(w, fmt.Sprintf("siteid %d not found.", qsiteid), 404)
+			return
+		}
+
+		domain := siteDomain(site.Sitename)
+		ispreview := false
+		if r.Method == "POST" {
+			oldsitename := site.Sitename
+			site.Sitename = strings.TrimSpace(r.FormValue("sitename"))
+			site.Desc = strings.TrimSpace(r.FormValue("desc"))
+			site.Desc = normalizeText(site.Desc)
+			site.Quota = int64(atoi(strings.TrimSpace(r.FormValue("quota")))) * 1024 * 1024
+			site.Istemplate = r.FormValue("istemplate") != ""
+			site.Theme = r.FormValue("theme")
+			site.Css = normalizeText(r.FormValue("css"))
+			site.Header = normalizeText(strings.TrimSpace(r.FormValue("header")))
+			site.Footer = normalizeText(strings.TrimSpace(r.FormValue("footer")))
+			site.Nav = normalizeText(strings.TrimSpace(r.FormValue("nav")))
+			site.Navonly = r.FormValue("navonly") != ""
+			site.Toc = r.FormValue("toc") != ""
+			site.Iframehosts = strings.Join(parseIframeHosts(r.FormValue("iframehosts")), "\n")
+			domain = cleanDomain(r.FormValue("domain"))
+			for {
+				if !isTheme(site.Theme) {
+					errmsg = "Please select a theme."
+					break
+				}
+				// Preview shows the theme and css without saving.
+				if r.FormValue("preview") != "" {
+					ispreview = true
+					break
+				}
+				if site.Sitename == "" {
+					errmsg = "Please enter a site name."
+					break
+				}
+				if strings.HasPrefix(site.Sitename, "~") {
+					errmsg = "Site name can't start with '~'."
+					break
+				}
+				if othersite := querySiteBySitename(db, site.Sitename); othersite != nil && othersite.Siteid != site.Siteid {
+					errmsg = fmt.Sprintf("A site named '%s' already exists.", site.Sitename)
+					break
+				}
+				// Old sitenames keep redirecting to the renamed site.
+				if othersite := querySiteByAlias(db, site.Sitename); othersite != nil && othersite.Siteid != site.Siteid {
+					errmsg = fmt.Sprintf("Site name '%s' is a previous name of site '%s'.", site.Sitename, othersite.Sitename)
+					break
+				}
+				if strings.ContainsAny(domain, "/ ") {
+					errmsg = "Please enter a host name only, such as docs.example.com."
+					break
+				}
+				if domain != "" && domain == _mainHost {
+					errmsg = "Domain is the main host name, please enter a different one."
+					break
+				}
+				if othersite := querySiteByDomain(db, domain); othersite != nil && othersite.Siteid != site.Siteid {
+					errmsg = fmt.Sprintf("Domain is already used by site '%s'.", othersite.Sitename)
+					break
+				}
+
+				err := updateSite(db, site, oldsitename)
+				if err != nil {
+					log.Printf("Error updating site (%s)\n", err)
+					errmsg = "A problem occured. Please try again."
+					break
+				}
+				err = setSiteDomain(db, site.Siteid, domain)
+				if err != nil {
+					log.Printf("Error updating site domain (%s)\n", err)
+					errmsg = "A problem occured. Please try again."
+					break
+				}
+				http.Redirect(w, r, siteUrl(site.Sitename), http.StatusSeeOther)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		P := makePrintFunc(w)
+		cssurls := siteCssUrls(site)
+		if ispreview && site.Css != "" {
+			// Unsaved css is passed inline for the preview.
+			cssurls = siteCssUrls(&Site{Theme: site.Theme})
+			cssurls = append(cssurls, "data:text/css;base64,"+base64.StdEncoding.EncodeToString([]byte(site.Css)))
+		}
+		printHead(P, nil, cssurls, "Edit Site")
+
+		printSectionMenuHead(P, site, "", login)
+		printMenuHead(P, "Actions")
+		printMenuLine(P, fmt.Sprintf("/trash?siteid=%d", qsiteid), "Trash")
+		printMenuLine(P, fmt.Sprintf("/clonesite?srcsiteid=%d", qsiteid), "Clone Site")
+		printMenuLine(P, fmt.Sprintf("/delsite?siteid=%d", qsiteid), "Delete Site")
+		printMenuFoot(P)
+		printSectionMenuFoot(P)
+
+		printMainHead(P)
+		printPageNav(P, "")
+		printFormHead(P, fmt.Sprintf("/editsite/?siteid=%d", qsiteid))
+		printFormTitle(P, "Edit site")
+		printFormControlError(P, errmsg)
+		printFormControlInput(P, "sitename", "Sitename (unique sitename required)", site.Sitename, 60)
+		printFormControlTextarea(P, "desc", "Description", site.Desc, 10)
+		printFormControlInput(P, "quota", fmt.Sprintf("Storage quota in MB (0 to use default of %s)", formatSize(_defaultSiteQuota)), itoa(site.Quota/1024/1024), 10)
+		printFormControlInput(P, "domain", "Domain (optional, serves this site at the root of the host name)", domain, 60)
+		printFormControlCheckbox(P, "istemplate", "Offer this site as a template when creating new sites", site.Istemplate)
+		printFormControlTextarea(P, "header", "Header (markdown, shown above every page)", site.Header, 4)
+		printFormControlTextarea(P, "footer", "Footer (markdown, replaces the default footer)", site.Footer, 4)
+		printFormControlTextarea(P, "nav", "Navigation menu (one link per line: Page Title, Label | Page Title, or Label | https://...)", site.Nav, 6)
+		printFormControlCheckbox(P, "navonly", "Show only the navigation menu, not the list of all pages", site.Navonly)
+		printFormControlCheckbox(P, "toc", "Show a table of contents of the page's headings in the page menu", site.Toc)
+		printFormControlTextarea(P, "iframehosts", "Allowed iframe hosts (one per line, such as www.youtube.com; pages can embed https iframes from these hosts)", site.Iframehosts, 3)
+		printFormControlSelect(P, "theme", "Theme", _themes, site.Theme)
+		printFormControlTextarea(P, "css", "Custom CSS (added after the theme)", site.Css, 10)
+		printFormControlHead(P)
+		printFormSubmitButton(P, "update", "Update")
+		printFormSpacer(P)
+		printFormSubmitButton(P, "preview", "Preview")
+		printFormControlFoot(P)
+		printFormFoot(P)
+		if ispreview {
+			printBoxHead(P, "mt-4 max-w-2xl")
+			printFormTitle(P, "Preview")
+			printContentDiv(P, parseMarkdown(_themePreview))
+			printBoxFoot(P)
+		}
+		printMainFoot(P)
+
+		printSidebar(P, db)
+
+		printFoot(P)
+	}
+}
+
+func sitecssHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		qsiteid := idtoi(r.FormValue("siteid"))
+		site := querySiteById(db, qsiteid)
+		if site == nil {
+			http.Error(w, fmt.Sprintf("siteid %d not found.", qsiteid), 404)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/css; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if r.FormValue("v") != "" {
+			w.Header().Set("Cache-Control", "max-age=31536000, immutable")
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		io.WriteString(w, site.Css)
+	}
+}
+
+func delsiteHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var errmsg string
+		login := getLoginUser(r, db)
+		if !validateLogin(w, login) {
+			return
+		}
+
+		qsiteid := idtoi(r.FormValue("siteid"))
+		site := querySiteById(db, qsiteid)
+		if site == nil {
+			http.Error(w, fmt.Sprintf("siteid %d not found.", qsiteid), 404)
+			return
+		}
+
+		if r.Method == "POST" {
+			for {
+				err := trashSite(db, qsiteid, login.Userid)
+				if err != nil {
+					log.Printf("Error deleting site (%s)\n", err)
+					errmsg = "A problem occured. Please try again."
+					break
+				}
+
+				http.Redirect(w, r, "/", http.StatusSeeOther)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		P := makePrintFunc(w)
+		printHead(P, nil, siteCssUrls(site), "Delete Site")
+
+		printSectionMenuHead(P, site, "", login)
+		printMenuHead(P, "Actions")
+		printMenuLine(P, fmt.Sprintf("/editsite?siteid=%d", qsiteid), "Edit Site")
+		printMenuFoot(P)
+		printSectionMenuFoot(P)
+
+		printMainHead(P)
+		printPageNav(P, "")
+		printFormHead(P, fmt.Sprintf("/delsite/?siteid=%d", qsiteid))
+		printFormControlError(P, errmsg)
+		printFormControlHead(P)
+		printFormSubmitButton(P, "delete", "Move Site to Trash")
+		printFormCancel(P, fmt.Sprintf("/?siteid=%d", qsiteid))
+		printFormControlFoot(P)
+		printBoxHead(P, "")
+		printFormTitle(P, site.Sitename)
+		printContentDiv(P, renderMarkdown(db, site, site.Desc))
+		printBoxFoot(P)
+		printFormFoot(P)
+		printMainFoot(P)
+
+		printSidebar(P, db)
+
+		printFoot(P)
+	}
+}
+
+func createpageHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var errmsg string
+		var p Page
+
+		login := getLoginUser(r, db)
+		if !validateLogin(w, login) {
+			return
+		}
+
+		qsiteid := idtoi(r.FormValue("siteid"))
+		site := querySiteById(db, qsiteid)
+		if site == nil {
+			http.Error(w, fmt.Sprintf("siteid %d not found.", qsiteid), 404)
+			return
+		}
+
+		p.Title = strings.TrimSpace(r.FormValue("title"))
+		if r.Method == "POST" {
+			p.Body = r.FormValue("body")
+			p.Body = normalizeText(p.Body)
+			for {
+				if p.Title == "" {
+					errmsg = "Please enter a page title."
+					break
+				}
+				errmsg = validateTitle(p.Title)
+				if errmsg != "" {
+					break
+				}
+				errmsg = validatePageMeta(db, site, &p)
+				if errmsg != "" {
+					break
+				}
+				_, err := createPage(db, site, &p)
+				if err != nil {
+					log.Printf("Error creating page (%s)\n", err)
+					errmsg = "A problem occured. Please try again."
+					break
+				}
+				http.Redirect(w, r, pageUrl(site.Sitename, p.Title), http.StatusSeeOther)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		P := makePrintFunc(w)
+		printHead(P, nil, siteCssUrls(site), "Create Page")
+
+		printSectionMenuHead(P, site, "", login)
+		printSectionMenuFoot(P)
+
+		printMainHead(P)
+		printPageNav(P, "")
+		printFormHead(P, fmt.Sprintf("/createpage/?siteid=%d", qsiteid))
+		printFormTitle(P, "Create Page")
+		printFormControlError(P, errmsg)
+		printFormControlInput(P, "title", "Title", p.Title, 10)
+		printFormControlTextarea(P, "body", "Body", p.Body, 25)
+		printFormHelp(P, _frontMatterHelp)
+		printFormControlSubmitButton(P, "create", "Create")
+		printFormFoot(P)
+		printMainFoot(P)
+
+		printSidebar(P, db)
+
+		printFoot(P)
+	}
+}
+
+func editpageHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var errmsg string
+
+		login := getLoginUser(r, db)
+		if !validateLogin(w, login) {
+			return
+		}
+
+		qsiteid := idtoi(r.FormValue("siteid"))
+		qpageid := idtoi(r.FormValue("pageid"))
+		site := querySiteById(db, qsiteid)
+		if site == nil {
+			http.Error(w, fmt.Sprintf("siteid %d not found.", qsiteid), 404)
+			return
+		}
+		p := queryPageById(db, qsiteid, qpageid)
+		if p == nil {
+			http.Error(w, fmt.Sprintf("pageid %d not found.", qpageid), 404)
+			return
+		}
+
+		if r.Method == "POST" {
+			p.Title = strings.TrimSpace(r.FormValue("title"))
+			p.Body = r.FormValue("body")
+			p.Body = normalizeText(p.Body)
+			for {
+				if p.Title == "" {
+					errmsg = "Please enter a page title."
+					break
+				}
+				errmsg = validateTitle(p.Title)
+				if errmsg != "" {
+					break
+				}
+				errmsg = validatePageMeta(db, site, p)
+				if errmsg != "" {
+					break
+				}
+
+				err := updatePage(db, site, p)
+				if err != nil {
+					log.Printf("Error updating page (%s)\n", err)
+					errmsg = "A problem occured. Please try again."
+					break
+				}
+				http.Redirect(w, r, pageUrl(site.Sitename, p.Title), http.StatusSeeOther)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		P := makePrintFunc(w)
+		printHead(P, nil, siteCssUrls(site), "Edit Page")
+
+		printSectionMenuHead(P, site, p.Title, login)
+		printMenuHead(P, "Actions")
+		printMenuLine(P, fmt.Sprintf("/editsite?siteid=%d", qsiteid), "Site Settings")
+		printMenuLine(P, fmt.Sprintf("/movepage?siteid=%d&pageid=%d", qsiteid, qpageid), "Move Page")
+		printMenuLine(P, fmt.Sprintf("/delpage?siteid=%d&pageid=%d", qsiteid, qpageid), "Delete Page")
+		printMenuFoot(P)
+		printSectionMenuFoot(P)
+
+		printMainHead(P)
+		printPageNav(P, p.Title)
+		printFormHead(P, fmt.Sprintf("/editpage/?siteid=%d&pageid=%d", qsiteid, qpageid))
+		printFormTitle(P, "Edit Page")
+		printFormControlError(P, errmsg)
+		printFormControlInput(P, "title", "Title", p.Title, 10)
+		printFormControlTextarea(P, "body", "Body", p.Body, 25)
+		printFormHelp(P, _frontMatterHelp)
+		printFormControlSubmitButton(P, "update", "Update")
+		printFormFoot(P)
+		printMainFoot(P)
+
+		printSidebar(P, db)
+
+		printFoot(P)
+	}
+}
+
+func movepageHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var errmsg string
+
+		login := getLoginUser(r, db)
+		if !validateLogin(w, login) {
+			return
+		}
+
+		qsiteid := idtoi(r.FormValue("siteid"))
+		qpageid := idtoi(r.FormValue("pageid"))
+		site := querySiteById(db, qsiteid)
+		if site == nil {
+			http.Error(w, fmt.Sprintf("siteid %d not found.", qsiteid), 404)
+			return
+		}
+		p := queryPageById(db, qsiteid, qpageid)
+		if p == nil {
+			http.Error(w, fmt.Sprintf("pageid %d not found.", qpageid), 404)
+			return
+		}
+		subtree, err := queryPageSubtree(db, qsiteid, p.Title)
+		if handleDbErr(w, err, "movepageHandler") {
+			return
+		}
+
+		newtitle := p.Title
+		rewriteRefs := true
+		keepAliases := false
+		if r.Method == "POST" {
+			newtitle = strings.TrimSpace(r.FormValue("title"))
+			rewriteRefs = r.FormValue("rewrite") != ""
+			keepAliases = r.FormValue("keepalias") != ""
+			for {
+				if newtitle == "" {
+					errmsg = "Please enter a page title."
+					break
+				}
+				errmsg = validateTitle(newtitle)
+				if errmsg != "" {
+					break
+				}
+				if newtitle == p.Title {
+					http.Redirect(w, r, pageUrl(site.Sitename, p.Title), http.StatusSeeOther)
+					return
+				}
+				if strings.HasPrefix(newtitle, p.Title+"/") {
+					errmsg = "A page can't be moved under itself."
+					break
+				}
+				for _, sp := range subtree {
+					t := newtitle + strings.TrimPrefix(sp.Title, p.Title)
+					if queryPageByTitle(db, qsiteid, t) != nil {
+						errmsg = fmt.Sprintf("A page titled '%s' already exists.", t)
+						break
+					}
+					// Aliases of pages being moved are fine to take over.
+					if ap := queryPageByAlias(db, qsiteid, t); ap != nil && !strings.HasPrefix(ap.Title+"/", p.Title+"/") {
+						errmsg = fmt.Sprintf("Title '%s' is an alias of page '%s'.", t, ap.Title)
+						break
+					}
+				}
+				if errmsg != "" {
+					break
+				}
+				err := movePage(db, site, p.Title, newtitle, rewriteRefs, keepAliases)
+				if err != nil {
+					log.Printf("Error moving page (%s)\n", err)
+					errmsg = "A problem occured. Please try again."
+					break
+				}
+				http.Redirect(w, r, pageUrl(site.Sitename, newtitle), http.StatusSeeOther)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		P := makePrintFunc(w)
+		printHead(P, nil, siteCssUrls(site), "Move Page")
+
+		printSectionMenuHead(P, site, p.Title, login)
+		printMenuHead(P, "Actions")
+		printMenuLine(P, fmt.Sprintf("/editsite?siteid=%d", qsiteid), "Site Settings")
+		printMenuLine(P, fmt.Sprintf("/editpage?siteid=%d&pageid=%d", qsiteid, qpageid), "Edit Page")
+		printMenuFoot(P)
+		printPagesMenu(P, db, site, p.Title)
+		printSectionMenuFoot(P)
+
+		printMainHead(P)
+		printPageNav(P, p.Title)
+		printFormHead(P, fmt.Sprintf("/movepage/?siteid=%d&pageid=%d", qsiteid, qpageid))
+		printFormTitle(P, fmt.Sprintf("Move %s", p.Title))
+		printFormControlError(P, errmsg)
+		printFormControlInput(P, "title", "New title (Parent/Title to move under another page)", newtitle, 60)
+		if len(subtree) > 1 {
+			printFormHelp(P, fmt.Sprintf("The %d child pages of this page are moved along with it.", len(subtree)-1))
+		}
+		printFormControlCheckbox(P, "rewrite", "Update links and includes in pages that refer to the moved pages", rewriteRefs)
+		printFormControlCheckbox(P, "keepalias", "Keep the old titles as aliases so that old links keep working (no new page can use them)", keepAliases)
+		printFormControlSubmitButton(P, "move", "Move")
+		printFormFoot(P)
+		printMainFoot(P)
+
+		printSidebar(P, db)
+		printFoot(P)
+	}
+}
+
+func delpageHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var errmsg string
+
+		login := getLoginUser(r, db)
+		if !validateLogin(w, login) {
+			return
+		}
+
+		qsiteid := idtoi(r.FormValue("siteid"))
+		qpageid := idtoi(r.FormValue("pageid"))
+		site := querySiteById(db, qsiteid)
+		if site == nil {
+			http.Error(w, fmt.Sprintf("siteid %d not found.", qsiteid), 404)
+			return
+		}
+		p := queryPageById(db, qsiteid, qpageid)
+		if p == nil {
+			http.Error(w, fmt.Sprintf("pageid %d not found.", qpageid), 404)
+			return
+		}
+
+		if r.Method == "POST" {
+			for {
+				err := trashPage(db, qsiteid, qpageid, login.Userid)
+				if err == errStartPageInTrash {
+					errmsg = "An earlier start page is still in the trash. Restore or purge it first."
+					break
+				}
+				if err != nil {
+					log.Printf("Error deleting page (%s)\n", err)
+					errmsg = "A problem occured. Please try again."
+					break
+				}
+				http.Redirect(w, r, pageUrl(site.Sitename, ""), http.StatusSeeOther)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		P := makePrintFunc(w)
+		printHead(P, nil, siteCssUrls(site), "Delete Page")
+
+		printSectionMenuHead(P, site, p.Title, login)
+		printMenuHead(P, "Actions")
+		printMenuLine(P, fmt.Sprintf("/editsite?siteid=%d", qsiteid), "Site Settings")
+		printMenuLine(P, fmt.Sprintf("/editpage?siteid=%d&pageid=%d", qsiteid, qpageid), "Edit Page")
+		printMenuFoot(P)
+		printSectionMenuFoot(P)
+
+		printMainHead(P)
+		printPageNav(P, p.Title)
+
+		printFormHead(P, fmt.Sprintf("/delpage/?siteid=%d&pageid=%d", qsiteid, qpageid))
+		printFormControlError(P, errmsg)
+		printFormControlHead(P)
+		printFormSubmitButton(P, "delete", "Move Page to Trash")
+		printFormCancel(P, fmt.Sprintf("/?siteid=%d&title=%s", qsiteid, escape(p.Title)))
+		printFormControlFoot(P)
+		printBoxHead(P, "")
+		printFormTitle(P, p.Title)
+		markup, _ := renderPage(db, site, p)
+		printContentDiv(P, markup)
+		printBoxFoot(P)
+		printFormFoot(P)
 
-	P("<nav class=\"flex flex-row justify-between border-b border-gray-500 pb-1 mb-4\">\n")
-	P("  <h1 class=\"font-bold text-xl\">%s</h1>\n", pageTitle)
-	if pageTitle != "" {
-		P("  <a class=\"italic text-xs no-underline self-center text-blue-900\" href=\"#\">%s</a>\n", pageTitle)
+		printMainFoot(P)
+		printSidebar(P, db)
+		printFoot(P)
 	}
-	P("</nav>\n")
 }
 
-func indexHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+// Result of saving one uploaded file, for listing back to the user.
+type UploadResult struct {
+	Filename  string
+	Savedname string
+	IsPage    bool
+	Err       error
+}
+
+func uploadfileHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if isFileUrl(r) {
-			printFile(db, w, r)
-			return
+		var errmsg string
+		var results []UploadResult
+		var previews []*ZipPreview
+		onconflict := "skip"
+		extract := false
+		mdpages := false
+
+		// Limit request body before anything reads the multipart form.
+		// Allow some room over the max for the other form fields. Each
+		// file is checked against _maxUploadSize separately.
+		if r.Method == "POST" {
+			r.Body = http.MaxBytesReader(w, r.Body, _maxUploadRequest+1024*1024)
 		}
 
 		login := getLoginUser(r, db)
-		qsitename, qtitle := parsePageUrl(r)
+		if !validateLogin(w, login) {
+			return
+		}
 
-		var site *Site
-		var p *Page
-		if qsitename != "" {
-			site = querySiteBySitename(db, qsitename)
+		qsiteid := idtoi(r.FormValue("siteid"))
+		site := querySiteById(db, qsiteid)
+		if site == nil {
+			http.Error(w, fmt.Sprintf("siteid %d not found.", qsiteid), 404)
+			return
 		}
 
-		for {
-			if site == nil {
-				break
-			}
-			if qtitle != "" {
-				p = queryPageByTitle(db, site.Siteid, qtitle)
-				break
+		// Confirm extracting previously uploaded zip files.
+		if r.Method == "POST" && len(r.Form["zipid"]) > 0 {
+			onconflict = r.FormValue("onconflict")
+			mdpages = r.FormValue("mdpages") != ""
+			for _, zipid := range r.Form["zipid"] {
+				results = append(results, extractZipUpload(db, site, zipid, mdpages, onconflict, login.Userid)...)
 			}
+		} else if r.Method == "POST" {
+			for {
+				err := r.ParseMultipartForm(32 << 20)
+				var maxerr *http.MaxBytesError
+				if errors.As(err, &maxerr) {
+					errmsg = fmt.Sprintf("Upload too large. Max size of all files uploaded together is %s.", formatSize(_maxUploadRequest))
+					break
+				}
+				if err != nil {
+					log.Printf("uploadfile: IO error reading form: %s\n", err)
+					errmsg = "A problem occured. Please try again."
+					break
+				}
+				if r.FormValue("onconflict") != "" {
+					onconflict = r.FormValue("onconflict")
+				}
+				extract = r.FormValue("extract") != ""
+				mdpages = r.FormValue("mdpages") != ""
 
-			// No page title requested so show the 'index' page (page_id = 1).
-			p = queryPageById(db, site.Siteid, 1)
-			if p == nil {
-				// If no index page, create it.
-				p = &Page{
-					Pageid: 1,
-					Title:  fmt.Sprintf("%s start page", site.Sitename),
-					Body:   "(Edit this page to fill in start page content)",
+				headers := r.MultipartForm.File["file"]
+				if len(headers) == 0 {
+					errmsg = "Please select a file to upload."
+					break
 				}
-				err := createIndexPage(db, site, p)
-				if handleDbErr(w, err, "indexHandler") {
-					return
+				for _, header := range headers {
+					if extract && fileext(header.Filename) == "zip" {
+						previews = append(previews, previewZipUpload(db, site, header, mdpages, login.Userid))
+						continue
+					}
+					results = append(results, uploadFile(db, site, header, onconflict, login.Userid))
 				}
+				break
+			}
+		}
+		for _, result := range results {
+			if result.Err == errQuotaExceeded {
+				errmsg = fmt.Sprintf("Not enough storage space for all files. Site has used %s of its %s quota.", formatSize(querySiteUsage(db, site.Siteid)), formatSize(siteQuota(site)))
+				break
 			}
-			qtitle = p.Title
-			break
 		}
 
 		w.Header().Set("Content-Type", "text/html")
 		P := makePrintFunc(w)
-		printHead(P, nil, nil, "t2")
+		printHead(P, []string{"/static/upload.js"}, siteCssUrls(site), "Upload File")
 
-		printSectionMenu(P, db, site, p, qtitle, login)
-		printMain(P, db, site, p, qtitle, login)
+		printSectionMenuHead(P, site, "", login)
+
+		printMenuHead(P, "Actions")
+		printMenuLine(P, fmt.Sprintf("/delfile?siteid=%d", site.Siteid), "Delete Files")
+		printMenuLine(P, fmt.Sprintf("/trash?siteid=%d", site.Siteid), "Trash")
+		printMenuFoot(P)
+
+		printPagesMenu(P, db, site, "")
+		printFilesMenu(P, db, site)
+		printSectionMenuFoot(P)
+
+		printMainHead(P)
+		printPageNav(P, "")
+		if len(previews) > 0 {
+			printUploadResults(P, site, results)
+			printZipPreviews(P, site, previews, mdpages, onconflict)
+			printMainFoot(P)
+			printSidebar(P, db)
+			printFoot(P)
+			return
+		}
+
+		printFormHeadMultipart(P, fmt.Sprintf("/uploadfile/?siteid=%d", qsiteid))
+		printFormTitle(P, "Upload Files")
+		printFormControlError(P, errmsg)
+		printUploadResults(P, site, results)
+		printFormControlHead(P)
+		printFormHelp(P, fmt.Sprintf("Storage used: %s of %s. Max upload size: %s per file, %s in total.", formatSize(querySiteUsage(db, site.Siteid)), formatSize(siteQuota(site)), formatSize(_maxUploadSize), formatSize(_maxUploadRequest)))
+		printFormControlFoot(P)
+		printFormControlFileMultiple(P, "file", "Upload files (or drag and drop files here)")
+		printFormControlRadio(P, "onconflict", "If a file with the same name already exists", [][2]string{
+			{"skip", "Skip it"},
+			{"replace", "Replace existing file"},
+			{"keepboth", "Keep both (add a number to the new filename)"},
+		}, onconflict)
+		printFormControlCheckbox(P, "extract", "Extract .zip files into site files", extract)
+		printFormControlCheckbox(P, "mdpages", "Create pages from .md files in .zip files", mdpages)
+		printFormControlSubmitButton(P, "upload", "Upload")
+		printFormFoot(P)
 
+		printMainFoot(P)
 		printSidebar(P, db)
 		printFoot(P)
-		printFooter(P)
 	}
 }
 
-func printSectionMenu(P PrintFunc, db *sql.DB, site *Site, p *Page, qtitle string, login *User) {
-	printSectionMenuHead(P, site, login)
-	defer func() {
-		printPagesMenu(P, db, site)
-		printFilesMenu(P, db, site)
-		printSectionMenuFoot(P)
-	}()
+// Read an uploaded file and save it into the site's files table.
+func uploadFile(db *sql.DB, site *Site, header *multipart.FileHeader, onconflict string, userid int64) UploadResult {
+	result := UploadResult{Filename: header.Filename}
 
-	if site == nil {
-		printMenuHead(P, "Actions")
-		printMenuLine(P, "/createsite/", "Create Site")
-		printMenuFoot(P)
-		return
+	filename := cleanFilename(header.Filename)
+	if filename == "" {
+		result.Err = fmt.Errorf("invalid filename")
+		return result
 	}
-
-	if qtitle == "" {
-		printMenuHead(P, "Actions")
-		printMenuLine(P, fmt.Sprintf("/editsite?siteid=%d", site.Siteid), "Site Settings")
-		printMenuLine(P, fmt.Sprintf("/uploadfile?siteid=%d", site.Siteid), "Upload Files")
-		printMenuLine(P, fmt.Sprintf("/createpage?siteid=%d", site.Siteid), "Create Page")
-		printMenuFoot(P)
-		return
+	if header.Size > _maxUploadSize {
+		result.Err = fmt.Errorf("file too large, max upload size is %s", formatSize(_maxUploadSize))
+		return result
 	}
 
-	if p == nil {
-		printMenuHead(P, "Actions")
-		printMenuLine(P, fmt.Sprintf("/editsite?siteid=%d", site.Siteid), "Site Settings")
-		printMenuLine(P, fmt.Sprintf("/uploadfile?siteid=%d", site.Siteid), "Upload Files")
-		href := fmt.Sprintf("/createpage?siteid=%d&title=%s", site.Siteid, escape(qtitle))
-		link := fmt.Sprintf("Create page '%s'", qtitle)
-		printMenuLine(P, href, link)
-		printMenuFoot(P)
-		return
+	file, err := header.Open()
+	if err != nil {
+		log.Printf("uploadfile: IO error reading file: %s\n", err)
+		result.Err = fmt.Errorf("error reading uploaded file")
+		return result
+	}
+	defer file.Close()
+	bs, err := ioutil.ReadAll(file)
+	if err != nil {
+		log.Printf("uploadfile: IO error reading file: %s\n", err)
+		result.Err = fmt.Errorf("error reading uploaded file")
+		return result
 	}
 
-	printMenuHead(P, "Actions")
-	printMenuLine(P, fmt.Sprintf("/editsite?siteid=%d", site.Siteid), "Site Settings")
-	printMenuLine(P, fmt.Sprintf("/uploadfile?siteid=%d", site.Siteid), "Upload Files")
-	printMenuLine(P, fmt.Sprintf("/createpage?siteid=%d", site.Siteid), "Create Page")
-	printMenuLine(P, fmt.Sprintf("/editpage?siteid=%d&pageid=%d", site.Siteid, p.Pageid), "Edit Page")
-	printMenuFoot(P)
+	result.Savedname, result.Err = saveFile(db, site, filename, bs, onconflict, userid)
+	return result
 }
 
-func printMain(P PrintFunc, db *sql.DB, site *Site, p *Page, qtitle string, login *User) {
-	printMainHead(P)
-	defer printMainFoot(P)
-
-	if site == nil {
+func printUploadResults(P PrintFunc, site *Site, results []UploadResult) {
+	if len(results) == 0 {
 		return
 	}
-
-	printPageNav(P, qtitle)
-
-	if p == nil {
-		printContentDiv(P, "<p class=\"italic\">(Page not found)</p>\n")
-		return
+	type resultItem struct {
+		UploadResult
+		Skipped bool
+		Href    string
+	}
+	var items []resultItem
+	for _, result := range results {
+		item := resultItem{UploadResult: result, Skipped: result.Err == errSkipped}
+		if result.IsPage {
+			item.Href = pageUrl(site.Sitename, result.Savedname)
+		} else {
+			item.Href = fileUrl(site.Sitename, result.Savedname)
+		}
+		items = append(items, item)
 	}
+	execTemplate(P, "uploadresults", items)
+}
 
-	p.Body = parseMarkdown(p.Body)
-	p.Body = parseLinks(p.Body, site)
-	printContentDiv(P, p.Body)
+// Uploaded zip file waiting for the user to confirm extracting it.
+// The zip file is kept in the temp dir until then, named with the site
+// and user it was uploaded by so that only they can extract it.
+type ZipPreview struct {
+	Zipid    string
+	Filename string
+	Entries  []*ZipEntry
+	Err      error
 }
 
-func parseLinks(body string, site *Site) string {
-	if site == nil {
-		return body
-	}
+// A file in a zip and what extracting it will create.
+type ZipEntry struct {
+	Name   string
+	Target string
+	IsPage bool
+	Size   int64
+	Exists bool
+	Err    error
+}
 
-	// ![[file1.png]] => <img src="/sitename/~file/file1.png">
-	sre := `!\[\[(.+?)\]\]`
-	re := regexp.MustCompile(sre)
-	body = re.ReplaceAllStringFunc(body, func(smatch string) string {
-		matches := re.FindStringSubmatch(smatch)
-		return fmt.Sprintf("<img src=\"/%s/~file/%s\">", escape(site.Sitename), matches[1])
-	})
+const maxZipEntries = 1000
+const maxZipRatio = 100
+const maxZipPageSize = 1024 * 1024
+const zipUploadTTL = time.Hour
 
-	// [[Target Page]] => <a href="/sitename/Target+Page">Target Page</a>
-	sre = `\[\[(.+?)\]\]`
-	re = regexp.MustCompile(sre)
-	body = re.ReplaceAllStringFunc(body, func(smatch string) string {
-		matches := re.FindStringSubmatch(smatch)
-		targetname := matches[1]
-		if strings.HasPrefix(targetname, "~file/") {
-			targetname = strings.TrimPrefix(targetname, "~file/")
-		}
-		return fmt.Sprintf("<a href=\"/%s/%s\">%s</a>", escape(site.Sitename), matches[1], targetname)
-	})
+var zipidRe = regexp.MustCompile(`^t2zip-(\d+)-(\d+)-\d+\.zip$`)
 
-	return body
+func zipUploadPath(siteid, userid int64, zipid string) (string, error) {
+	matches := zipidRe.FindStringSubmatch(zipid)
+	if matches == nil || idtoi(matches[1]) != siteid || idtoi(matches[2]) != userid {
+		return "", fmt.Errorf("invalid zip id")
+	}
+	return filepath.Join(os.TempDir(), zipid), nil
 }
 
-func printPagesMenu(P PrintFunc, db *sql.DB, site *Site) {
-	if site == nil {
-		return
+// Remove zip uploads that were never confirmed.
+func cleanupZipUploads() {
+	matches, _ := filepath.Glob(filepath.Join(os.TempDir(), "t2zip-*.zip"))
+	for _, match := range matches {
+		fi, err := os.Stat(match)
+		if err == nil && time.Since(fi.ModTime()) > zipUploadTTL {
+			os.Remove(match)
+		}
 	}
+}
 
-	printMenuHead(P, "Pages")
-	defer printMenuFoot(P)
+// Save uploaded zip to temp dir and list what extracting it will create.
+func previewZipUpload(db *sql.DB, site *Site, header *multipart.FileHeader, mdpages bool, userid int64) *ZipPreview {
+	preview := ZipPreview{Filename: header.Filename}
+	cleanupZipUploads()
 
-	s := fmt.Sprintf("SELECT page_id, title, body FROM %s ORDER BY title", pagetblName(site.Siteid))
-	rows, err := db.Query(s)
+	file, err := header.Open()
 	if err != nil {
-		log.Printf("printPagesMenu() db err (%s)\n", err)
-		return
-	}
-	var p Page
-	i := 0
-	for rows.Next() {
-		rows.Scan(&p.Pageid, &p.Title, &p.Body)
-		href := fmt.Sprintf("/%s/%s", escape(site.Sitename), escape(p.Title))
-		printMenuLine(P, href, p.Title)
-		i++
+		log.Printf("uploadfile: IO error reading zip: %s\n", err)
+		preview.Err = fmt.Errorf("error reading uploaded file")
+		return &preview
 	}
-	if i == 0 {
-		printMenuText(P, "<p class=\"text-gray-700 italic\">(no pages yet)</p>")
-	}
-}
+	defer file.Close()
 
-func printFilesMenu(P PrintFunc, db *sql.DB, site *Site) {
-	if site == nil {
-		return
+	tmpf, err := os.CreateTemp("", fmt.Sprintf("t2zip-%d-%d-*.zip", site.Siteid, userid))
+	if err != nil {
+		log.Printf("uploadfile: error creating temp file: %s\n", err)
+		preview.Err = fmt.Errorf("error saving uploaded file")
+		return &preview
 	}
+	defer tmpf.Close()
+	preview.Zipid = filepath.Base(tmpf.Name())
 
-	printMenuHead(P, "Files")
-	defer printMenuFoot(P)
-
-	s := fmt.Sprintf("SELECT filename FROM %s ORDER BY filename", filetblName(site.Siteid))
-	rows, err := db.Query(s)
+	_, err = io.Copy(tmpf, file)
 	if err != nil {
-		log.Printf("printFilesMenu() db err (%s)\n", err)
-		return
+		os.Remove(tmpf.Name())
+		log.Printf("uploadfile: error writing temp file: %s\n", err)
+		preview.Err = fmt.Errorf("error saving uploaded file")
+		return &preview
 	}
-	var filename string
-	i := 0
-	for rows.Next() {
-		rows.Scan(&filename)
-		printMenuLine(P, fileUrl(site.Sitename, filename), filename)
-		i++
+
+	zr, err := zip.NewReader(tmpf, header.Size)
+	if err != nil {
+		os.Remove(tmpf.Name())
+		preview.Err = fmt.Errorf("not a valid zip file")
+		return &preview
 	}
-	if i == 0 {
-		printMenuText(P, "<p class=\"text-gray-700 italic\">(no files yet)</p>")
+	preview.Entries, preview.Err = readZipEntries(db, site, zr, mdpages)
+	if preview.Err != nil {
+		os.Remove(tmpf.Name())
 	}
+	return &preview
 }
 
-func printSitesMenu(P PrintFunc, db *sql.DB) {
-	printMenuHead(P, "Sites")
-	defer printMenuFoot(P)
-
-	s := "SELECT site_id, sitename, desc FROM site ORDER BY site_id"
-	rows, err := db.Query(s)
-	if err != nil {
-		log.Printf("printSitesMenu() db err (%s)\n", err)
-		return
-	}
-	var site Site
-	i := 0
-	for rows.Next() {
-		rows.Scan(&site.Siteid, &site.Sitename, &site.Desc)
-		href := fmt.Sprintf("/%s", escape(site.Sitename))
-		printMenuLine(P, href, site.Sitename)
-		i++
+// Reject absolute paths and paths that climb out of the extract dir.
+func isSafeZipPath(name string) bool {
+	if name == "" || strings.HasPrefix(name, "/") || strings.Contains(name, "\\") || strings.Contains(name, ":") {
+		return false
 	}
-	if i == 0 {
-		printMenuText(P, "<p class=\"text-gray-700 italic\">(no sites yet)</p>")
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return false
+		}
 	}
+	return true
 }
 
-func createsiteHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var errmsg string
-		var site Site
+// Return what each zip entry would be extracted into, with the reason
+// that an entry will be skipped in ZipEntry.Err.
+func readZipEntries(db *sql.DB, site *Site, zr *zip.Reader, mdpages bool) ([]*ZipEntry, error) {
+	if len(zr.File) > maxZipEntries {
+		return nil, fmt.Errorf("too many files in zip (max %d)", maxZipEntries)
+	}
 
-		login := getLoginUser(r, db)
-		if !validateLogin(w, login) {
-			return
-		}
+	available := siteQuota(site) - querySiteUsage(db, site.Siteid)
+	entries := []*ZipEntry{}
 
-		if r.Method == "POST" {
-			site.Sitename = strings.TrimSpace(r.FormValue("sitename"))
-			site.Desc = strings.TrimSpace(r.FormValue("desc"))
-			site.Desc = normalizeText(site.Desc)
-			for {
-				if site.Sitename == "" {
-					errmsg = "Please enter a site name."
-					break
-				}
-				_, err := createSite(db, &site)
-				if err != nil {
-					log.Printf("Error creating site (%s)\n", err)
-					errmsg = "A problem occured. Please try again."
-					break
-				}
-				http.Redirect(w, r, pageUrl(site.Sitename, ""), http.StatusSeeOther)
-				return
-			}
+	// Entries in different folders can have the same name once the
+	// folders are stripped. Only the first one is extracted.
+	targets := map[string]string{}
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
 		}
+		entry := ZipEntry{Name: zf.Name, Size: int64(zf.UncompressedSize64)}
+		entries = append(entries, &entry)
 
-		w.Header().Set("Content-Type", "text/html")
-		P := makePrintFunc(w)
-		printHead(P, nil, nil, "Create Site")
-
-		printSectionMenuHead(P, nil, login)
-		printSectionMenuFoot(P)
-
-		printMainHead(P)
-		printFormHead(P, "/createsite/")
-		printFormTitle(P, "Create site")
-		printFormControlError(P, errmsg)
-		printFormControlInput(P, "sitename", "Sitename (enter a unique site name)", site.Sitename, 10)
-		printFormControlTextarea(P, "desc", "Description", site.Desc, 10)
-		printFormControlSubmitButton(P, "create", "Create")
-		printFormFoot(P)
-		printMainFoot(P)
+		if !isSafeZipPath(zf.Name) {
+			entry.Err = fmt.Errorf("unsafe path")
+			continue
+		}
+		base := cleanFilename(zf.Name)
+		if base == "" || strings.HasPrefix(base, ".") || strings.HasPrefix(zf.Name, "__MACOSX/") {
+			entry.Err = fmt.Errorf("hidden or system file")
+			continue
+		}
+		if zf.CompressedSize64 > 0 && zf.UncompressedSize64/zf.CompressedSize64 > maxZipRatio && zf.UncompressedSize64 > 1024*1024 {
+			entry.Err = fmt.Errorf("suspicious compression ratio")
+			continue
+		}
 
-		printSidebar(P, db)
+		if mdpages && fileext(base) == "md" {
+			entry.IsPage = true
+			entry.Target = strings.TrimSuffix(base, path.Ext(base))
+			if entry.Size > maxZipPageSize {
+				entry.Err = fmt.Errorf("page too large (max %s)", formatSize(maxZipPageSize))
+				continue
+			}
+			if first, ok := targets["page:"+entry.Target]; ok {
+				entry.Err = fmt.Errorf("same page title as %s", first)
+				continue
+			}
+			targets["page:"+entry.Target] = zf.Name
+			entry.Exists = queryPageByTitle(db, site.Siteid, entry.Target) != nil
+			continue
+		}
 
-		printFoot(P)
+		entry.Target = base
+		if first, ok := targets["file:"+entry.Target]; ok {
+			entry.Err = fmt.Errorf("same filename as %s", first)
+			continue
+		}
+		targets["file:"+entry.Target] = zf.Name
+		if entry.Size > _maxUploadSize {
+			entry.Err = fmt.Errorf("file too large (max %s)", formatSize(_maxUploadSize))
+			continue
+		}
+		if entry.Size > available {
+			entry.Err = fmt.Errorf("not enough storage space")
+			continue
+		}
+		available -= entry.Size
+		entry.Exists = queryFileInfoByFilename(db, site.Siteid, entry.Target) != nil
 	}
+	return entries, nil
 }
 
-func editsiteHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var errmsg string
-		login := getLoginUser(r, db)
-		if !validateLogin(w, login) {
-			return
+// Extract previously previewed zip upload into site files and pages.
+func extractZipUpload(db *sql.DB, site *Site, zipid string, mdpages bool, onconflict string, userid int64) []UploadResult {
+	zippath, err := zipUploadPath(site.Siteid, userid, zipid)
+	if err != nil {
+		return []UploadResult{{Filename: zipid, Err: err}}
+	}
+	zr, err := zip.OpenReader(zippath)
+	if err != nil {
+		return []UploadResult{{Filename: zipid, Err: fmt.Errorf("zip upload expired, please upload it again")}}
+	}
+	defer os.Remove(zippath)
+	defer zr.Close()
+
+	entries, err := readZipEntries(db, site, &zr.Reader, mdpages)
+	if err != nil {
+		return []UploadResult{{Filename: zipid, Err: err}}
+	}
+
+	// Index zip files by name to read the entries' contents.
+	zfiles := map[string]*zip.File{}
+	for _, zf := range zr.File {
+		zfiles[zf.Name] = zf
+	}
+
+	results := []UploadResult{}
+	for _, entry := range entries {
+		result := UploadResult{Filename: entry.Name, Savedname: entry.Target, IsPage: entry.IsPage, Err: entry.Err}
+		if entry.Err != nil {
+			results = append(results, result)
+			continue
 		}
 
-		qsiteid := idtoi(r.FormValue("siteid"))
-		site := querySiteById(db, qsiteid)
-		if site == nil {
-			http.Error(w, fmt.Sprintf("siteid %d not found.", qsiteid), 404)
-			return
+		bs, err := readZipFile(zfiles[entry.Name], entry.Size)
+		if err != nil {
+			result.Err = err
+			results = append(results, result)
+			continue
 		}
+		if entry.IsPage {
+			result.Savedname, result.Err = savePage(db, site, entry.Target, normalizeText(string(bs)), onconflict)
+		} else {
+			result.Savedname, result.Err = saveFile(db, site, entry.Target, bs, onconflict, userid)
+		}
+		results = append(results, result)
+	}
+	return results
+}
 
-		if r.Method == "POST" {
-			site.Sitename = strings.TrimSpace(r.FormValue("sitename"))
-			site.Desc = strings.TrimSpace(r.FormValue("desc"))
-			site.Desc = normalizeText(site.Desc)
-			for {
-				if site.Sitename == "" {
-					errmsg = "Please enter a site name."
-					break
-				}
+// Read zip file contents, not trusting the size recorded in the zip.
+func readZipFile(zf *zip.File, size int64) ([]byte, error) {
+	rc, err := zf.Open()
+	if err != nil {
+		return nil, fmt.Errorf("error reading zip entry")
+	}
+	defer rc.Close()
+	bs, err := ioutil.ReadAll(io.LimitReader(rc, size+1))
+	if err != nil {
+		return nil, fmt.Errorf("error reading zip entry")
+	}
+	if int64(len(bs)) > size {
+		return nil, fmt.Errorf("zip entry larger than its recorded size")
+	}
+	return bs, nil
+}
 
-				s := "UPDATE site SET sitename = ?, desc = ? WHERE site_id = ?"
-				_, err := sqlexec(db, s, site.Sitename, site.Desc, qsiteid)
-				if err != nil {
-					log.Printf("Error updating site (%s)\n", err)
-					errmsg = "A problem occured. Please try again."
-					break
-				}
-				http.Redirect(w, r, pageUrl(site.Sitename, ""), http.StatusSeeOther)
-				return
+func printZipPreviews(P PrintFunc, site *Site, previews []*ZipPreview, mdpages bool, onconflict string) {
+	printFormHead(P, fmt.Sprintf("/uploadfile/?siteid=%d", site.Siteid))
+	printFormTitle(P, "Extract Zip Files")
+
+	n := 0
+	for _, preview := range previews {
+		execTemplate(P, "zippreview", preview)
+		if preview.Err != nil {
+			continue
+		}
+		for _, entry := range preview.Entries {
+			if entry.Err == nil {
+				n++
 			}
 		}
+	}
 
-		w.Header().Set("Content-Type", "text/html")
-		P := makePrintFunc(w)
-		printHead(P, nil, nil, "Edit Site")
+	if n > 0 {
+		if mdpages {
+			printFormHidden(P, "mdpages", "y")
+		}
+		printFormHidden(P, "onconflict", onconflict)
+		printFormControlHead(P)
+		printFormSubmitButton(P, "extract", "Extract")
+		printFormCancel(P, fmt.Sprintf("/uploadfile/?siteid=%d", site.Siteid))
+		printFormControlFoot(P)
+	}
+	printFormFoot(P)
+}
 
-		printSectionMenuHead(P, site, login)
-		printMenuHead(P, "Actions")
-		printMenuLine(P, fmt.Sprintf("/delsite?siteid=%d", qsiteid), "Delete Site")
-		printMenuFoot(P)
-		printSectionMenuFoot(P)
+func fileext(filename string) string {
+	ss := strings.Split(filename, ".")
+	if len(ss) < 2 {
+		return ""
+	}
+	return strings.ToLower(ss[len(ss)-1])
+}
 
-		printMainHead(P)
-		printPageNav(P, "")
-		printFormHead(P, fmt.Sprintf("/editsite/?siteid=%d", qsiteid))
-		printFormTitle(P, "Edit site")
-		printFormControlError(P, errmsg)
-		printFormControlInput(P, "sitename", "Sitename (unique sitename required)", site.Sitename, 60)
-		printFormControlTextarea(P, "desc", "Description", site.Desc, 10)
-		printFormControlSubmitButton(P, "update", "Update")
-		printFormFoot(P)
-		printMainFoot(P)
+// Return the mime type of file contents, using the filename extension if
+// it's a known type, otherwise sniffing the first 512 bytes of contents.
+func detectContentType(filename string, bs []byte) string {
+	var extType string
+	if ext := fileext(filename); ext != "" {
+		extType = mime.TypeByExtension("." + ext)
+	}
+	sniffType := http.DetectContentType(bs)
 
-		printSidebar(P, db)
+	// Don't let an innocent looking extension hide html content.
+	if isRiskyContentType(sniffType) && !isRiskyContentType(extType) {
+		return sniffType
+	}
+	if extType != "" {
+		return extType
+	}
+	return sniffType
+}
 
-		printFoot(P)
+// Content types that browsers may execute script from when opened directly.
+func isRiskyContentType(ctype string) bool {
+	mtype, _, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return false
+	}
+	switch mtype {
+	case "text/html", "application/xhtml+xml", "image/svg+xml", "text/xml", "application/xml",
+		"text/javascript", "application/javascript", "application/ecmascript":
+		return true
 	}
+	return false
 }
 
-func delsiteHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var errmsg string
-		login := getLoginUser(r, db)
-		if !validateLogin(w, login) {
+func printFile(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	qsitename, qfilename := parseFileUrl(r)
+	if qsitename == "" || qfilename == "" {
+		http.Error(w, fmt.Sprintf("Bad request (%s)", r.URL.Path), 400)
+		return
+	}
+
+	site := querySiteBySitename(db, qsitename)
+	if site == nil {
+		if redirectSiteAlias(db, w, r, qsitename) {
 			return
 		}
+		http.Error(w, fmt.Sprintf("sitename %s not found.", qsitename), 400)
+		return
+	}
+	if redirectSiteDomain(w, r, site) {
+		return
+	}
+	file := queryFileInfoByFilename(db, site.Siteid, qfilename)
+	if file == nil {
+		http.Error(w, fmt.Sprintf("filename %s not found.", qfilename), 400)
+		return
+	}
 
-		qsiteid := idtoi(r.FormValue("siteid"))
-		site := querySiteById(db, qsiteid)
-		if site == nil {
-			http.Error(w, fmt.Sprintf("siteid %d not found.", qsiteid), 404)
+	// "?info" shows the file details page.
+	if _, ok := r.URL.Query()["info"]; ok {
+		printFileInfo(db, w, r, site, file)
+		return
+	}
+
+	// "?v=<version_id>" requests a previous version of the file.
+	// Previous versions never change, so they can be cached for good.
+	// The current version must be revalidated as it may be replaced.
+	blobtbl, blobidcol, blobid := filetblName(site.Siteid), "file_id", file.Fileid
+	if qversionid := idtoi(r.FormValue("v")); qversionid != 0 {
+		fv := queryFileVersion(db, site.Siteid, qversionid)
+		if fv == nil || fv.Fileid != file.Fileid {
+			http.Error(w, fmt.Sprintf("version %d of %s not found.", qversionid, qfilename), 404)
 			return
 		}
+		file.Size, file.Hash, file.Ctype, file.Updatedt = fv.Size, fv.Hash, fv.Ctype, fv.Updatedt
+		blobtbl, blobidcol, blobid = fileversiontblName(site.Siteid), "version_id", fv.Versionid
+		w.Header().Set("Cache-Control", "max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
 
-		if r.Method == "POST" {
-			for {
-				tx, err := db.Begin()
-				if err != nil {
-					log.Printf("DB error (%s)\n", err)
-					errmsg = "A problem occured. Please try again."
-					break
-				}
-				s := "DELETE FROM site WHERE site_id = ?"
-				_, err = txexec(tx, s, qsiteid)
-				if err != nil {
-					tx.Rollback()
-					log.Printf("Error deleting site (%s)\n", err)
-					errmsg = "A problem occured. Please try again."
-					break
-				}
+	ctype := file.Ctype
+	if ctype == "" {
+		ctype = mime.TypeByExtension("." + fileext(file.Filename))
+	}
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	// Uploaded html/svg/etc. shouldn't be able to run script on our origin.
+	// Sandbox the response and force html to download instead of rendering.
+	if isRiskyContentType(ctype) {
+		w.Header().Set("Content-Security-Policy", "sandbox; default-src 'none'; img-src 'self' data:; style-src 'unsafe-inline'")
+		if !strings.HasPrefix(ctype, "image/") {
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.Filename}))
+		}
+	}
+	// "?w=<width>" requests an image resized to width.
+	if qwidth := atoi(r.FormValue("w")); qwidth > 0 && isResizableImage(ctype) {
+		qwidth = thumbWidth(qwidth)
+		thumb, thumbctype, err := queryThumb(db, site, blobtbl, blobidcol, blobid, file.Hash, qwidth)
+		if err != nil {
+			log.Printf("printFile: error resizing %s (%s)\n", file.Filename, err)
+			http.Error(w, "Error resizing image.", 500)
+			return
+		}
+		w.Header().Set("Content-Type", thumbctype)
+		w.Header().Set("ETag", fmt.Sprintf("\"%s-w%d\"", file.Hash, qwidth))
+		http.ServeContent(w, r, file.Filename, file.Updatedt, bytes.NewReader(thumb))
+		return
+	}
 
-				s = fmt.Sprintf("DROP TABLE %s", pagetblName(qsiteid))
-				_, err = txexec(tx, s)
-				if err != nil {
-					tx.Rollback()
-					log.Printf("Error deleting pagetbl (%s)\n", err)
-					errmsg = "A problem occured. Please try again."
-					break
-				}
+	if file.Hash != "" {
+		w.Header().Set("ETag", fmt.Sprintf("\"%s\"", file.Hash))
+	}
 
-				err = tx.Commit()
-				if err != nil {
-					log.Printf("DB error (%s)\n", err)
-					errmsg = "A problem occured. Please try again."
-					break
-				}
+	// ServeContent handles Range, If-None-Match, If-Modified-Since and
+	// Content-Length. File contents are read from the db only as needed.
+	br := newBlobReader(db, blobtbl, blobidcol, blobid, file.Size)
+	http.ServeContent(w, r, file.Filename, file.Updatedt, br)
+}
 
-				http.Redirect(w, r, "/", http.StatusSeeOther)
-				return
-			}
+const maxImagePixels = 50 * 1000 * 1000
+
+// Images are only resized to these widths, to limit the number of cached
+// thumbs per image.
+var _thumbWidths = []int{16, 32, 96, 200, 400, 800, 1600}
+
+// Return the smallest thumb width that's at least width.
+func thumbWidth(width int) int {
+	for _, w := range _thumbWidths {
+		if w >= width {
+			return w
 		}
+	}
+	return _thumbWidths[len(_thumbWidths)-1]
+}
 
-		w.Header().Set("Content-Type", "text/html")
-		P := makePrintFunc(w)
-		printHead(P, nil, nil, "Delete Site")
+func isResizableImage(ctype string) bool {
+	return ctype == "image/png" || ctype == "image/jpeg" || ctype == "image/gif"
+}
 
-		printSectionMenuHead(P, site, login)
-		printMenuHead(P, "Actions")
-		printMenuLine(P, fmt.Sprintf("/editsite?siteid=%d", qsiteid), "Edit Site")
-		printMenuFoot(P)
-		printSectionMenuFoot(P)
+// Return image resized to width, from the thumbs cache if it's been
+// generated before. Images are only ever scaled down.
+// Thumbs count towards the site's storage used, so they're only cached
+// while the site has room for them.
+func queryThumb(db *sql.DB, site *Site, blobtbl, blobidcol string, blobid int64, hash string, width int) ([]byte, string, error) {
+	var bs []byte
+	var ctype string
+	thumbtbl := thumbtblName(site.Siteid)
+	s := fmt.Sprintf("SELECT bytes, content_type FROM %s WHERE hash = ? AND width = ?", thumbtbl)
+	err := db.QueryRow(s, hash, width).Scan(&bs, &ctype)
+	if err == nil && hash != "" {
+		return bs, ctype, nil
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return nil, "", err
+	}
 
-		printMainHead(P)
-		printPageNav(P, "")
-		printFormHead(P, fmt.Sprintf("/delsite/?siteid=%d", qsiteid))
-		printFormControlError(P, errmsg)
-		printFormControlHead(P)
-		printFormSubmitButton(P, "delete", "Delete Site")
-		P("<a class=\"ml-2 text-blue-900 no-underline\" href=\"/?siteid=%d\">Cancel</a>\n", qsiteid)
-		printFormControlFoot(P)
-		P("<div class=\"border p-2\">\n")
-		printFormTitle(P, site.Sitename)
-		printContentDiv(P, parseMarkdown(site.Desc))
-		P("</div>\n")
-		printFormFoot(P)
-		printMainFoot(P)
+	s = fmt.Sprintf("SELECT bytes FROM %s WHERE %s = ?", blobtbl, blobidcol)
+	err = db.QueryRow(s, blobid).Scan(&bs)
+	if err != nil {
+		return nil, "", err
+	}
+	bs, ctype, err = resizeImage(bs, width)
+	if err != nil {
+		return nil, "", err
+	}
 
-		printSidebar(P, db)
+	// Without a hash the thumb can't be told apart from other files'.
+	if hash == "" || querySiteUsage(db, site.Siteid)+int64(len(bs)) > siteQuota(site) {
+		return bs, ctype, nil
+	}
+	s = fmt.Sprintf("INSERT OR REPLACE INTO %s (hash, width, bytes, content_type) VALUES (?, ?, ?, ?)", thumbtbl)
+	_, err = sqlexec(db, s, hash, width, bs, ctype)
+	if err != nil {
+		return nil, "", err
+	}
+	return bs, ctype, nil
+}
 
-		printFoot(P)
+// Delete cached thumbs that no longer belong to any file or file version.
+func purgeThumbsTx(tx *sql.Tx, siteid int64) error {
+	s := fmt.Sprintf("DELETE FROM %s WHERE hash NOT IN (SELECT hash FROM %s UNION SELECT hash FROM %s)", thumbtblName(siteid), filetblName(siteid), fileversiontblName(siteid))
+	_, err := txexec(tx, s)
+	return err
+}
+
+// Scale down encoded png/jpeg/gif image to width. Gifs are encoded as png.
+func resizeImage(bs []byte, width int) ([]byte, string, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(bs))
+	if err != nil {
+		return nil, "", err
 	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return nil, "", fmt.Errorf("image too large to resize (%dx%d)", cfg.Width, cfg.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(bs))
+	if err != nil {
+		return nil, "", err
+	}
+	// The decoded image is copied again when scaling, so check its actual
+	// size as well as the size in the header.
+	if img.Bounds().Dx()*img.Bounds().Dy() > maxImagePixels {
+		return nil, "", fmt.Errorf("image too large to resize (%dx%d)", img.Bounds().Dx(), img.Bounds().Dy())
+	}
+	if width < img.Bounds().Dx() {
+		img = scaleImage(img, width)
+	}
+
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+		return buf.Bytes(), "image/jpeg", err
+	}
+	err = png.Encode(&buf, img)
+	return buf.Bytes(), "image/png", err
 }
 
-func createpageHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var errmsg string
-		var p Page
+// Box filter downscale: each destination pixel is the average of the
+// source pixels it covers.
+func scaleImage(src image.Image, width int) image.Image {
+	sb := src.Bounds()
+	sw, sh := sb.Dx(), sb.Dy()
+	height := sh * width / sw
+	if height < 1 {
+		height = 1
+	}
 
-		login := getLoginUser(r, db)
-		if !validateLogin(w, login) {
-			return
-		}
+	rgba := image.NewRGBA(image.Rect(0, 0, sw, sh))
+	draw.Draw(rgba, rgba.Bounds(), src, sb.Min, draw.Src)
 
-		qsiteid := idtoi(r.FormValue("siteid"))
-		site := querySiteById(db, qsiteid)
-		if site == nil {
-			http.Error(w, fmt.Sprintf("siteid %d not found.", qsiteid), 404)
-			return
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for dy := 0; dy < height; dy++ {
+		sy0 := dy * sh / height
+		sy1 := (dy + 1) * sh / height
+		if sy1 <= sy0 {
+			sy1 = sy0 + 1
 		}
+		for dx := 0; dx < width; dx++ {
+			sx0 := dx * sw / width
+			sx1 := (dx + 1) * sw / width
+			if sx1 <= sx0 {
+				sx1 = sx0 + 1
+			}
 
-		p.Title = strings.TrimSpace(r.FormValue("title"))
-		if r.Method == "POST" {
-			p.Body = r.FormValue("body")
-			p.Body = normalizeText(p.Body)
-			for {
-				if p.Title == "" {
-					errmsg = "Please enter a page title."
-					break
-				}
-				_, err := createPage(db, site, &p)
-				if err != nil {
-					log.Printf("Error creating page (%s)\n", err)
-					errmsg = "A problem occured. Please try again."
-					break
+			var r, g, b, a, n int
+			for sy := sy0; sy < sy1; sy++ {
+				i := rgba.PixOffset(sx0, sy)
+				for sx := sx0; sx < sx1; sx++ {
+					r += int(rgba.Pix[i])
+					g += int(rgba.Pix[i+1])
+					b += int(rgba.Pix[i+2])
+					a += int(rgba.Pix[i+3])
+					i += 4
+					n++
 				}
-				http.Redirect(w, r, pageUrl(site.Sitename, p.Title), http.StatusSeeOther)
-				return
 			}
+			i := dst.PixOffset(dx, dy)
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(b / n)
+			dst.Pix[i+3] = uint8(a / n)
 		}
+	}
+	return dst
+}
 
-		w.Header().Set("Content-Type", "text/html")
-		P := makePrintFunc(w)
-		printHead(P, nil, nil, "Create Page")
-
-		printSectionMenuHead(P, site, login)
-		printSectionMenuFoot(P)
-
-		printMainHead(P)
-		printPageNav(P, "")
-		printFormHead(P, fmt.Sprintf("/createpage/?siteid=%d", qsiteid))
-		printFormTitle(P, "Create Page")
-		printFormControlError(P, errmsg)
-		printFormControlInput(P, "title", "Title", p.Title, 10)
-		printFormControlTextarea(P, "body", "Body", p.Body, 25)
-		printFormControlSubmitButton(P, "create", "Create")
-		printFormFoot(P)
-		printMainFoot(P)
+// blobReader reads a file's bytes column in chunks so that large files
+// don't have to be loaded into memory all at once.
+type blobReader struct {
+	db     *sql.DB
+	tbl    string
+	idcol  string
+	id     int64
+	size   int64
+	offset int64
+	buf    []byte
+	bufoff int64
+}
 
-		printSidebar(P, db)
+const blobChunkSize = 4 * 1024 * 1024
 
-		printFoot(P)
+func newBlobReader(db *sql.DB, tbl, idcol string, id, size int64) *blobReader {
+	return &blobReader{db: db, tbl: tbl, idcol: idcol, id: id, size: size}
+}
+func (br *blobReader) Read(p []byte) (int, error) {
+	if br.offset >= br.size {
+		return 0, io.EOF
+	}
+
+	// Refill chunk buffer if current offset is outside of it.
+	if br.offset < br.bufoff || br.offset >= br.bufoff+int64(len(br.buf)) {
+		// sqlite substr() is 1-based.
+		s := fmt.Sprintf("SELECT substr(bytes, ?, ?) FROM %s WHERE %s = ?", br.tbl, br.idcol)
+		var bs []byte
+		err := br.db.QueryRow(s, br.offset+1, blobChunkSize, br.id).Scan(&bs)
+		if err != nil {
+			return 0, err
+		}
+		if len(bs) == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		br.buf = bs
+		br.bufoff = br.offset
 	}
+
+	n := copy(p, br.buf[br.offset-br.bufoff:])
+	br.offset += int64(n)
+	return n, nil
+}
+func (br *blobReader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = br.offset + offset
+	case io.SeekEnd:
+		abs = br.size + offset
+	default:
+		return 0, fmt.Errorf("blobReader.Seek: invalid whence")
+	}
+	if abs < 0 {
+		return 0, fmt.Errorf("blobReader.Seek: negative position")
+	}
+	br.offset = abs
+	return abs, nil
 }
 
-func editpageHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+func delfileHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var errmsg string
 
@@ -1206,69 +6239,151 @@ func editpageHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 		}
 
 		qsiteid := idtoi(r.FormValue("siteid"))
-		qpageid := idtoi(r.FormValue("pageid"))
 		site := querySiteById(db, qsiteid)
 		if site == nil {
 			http.Error(w, fmt.Sprintf("siteid %d not found.", qsiteid), 404)
 			return
 		}
-		p := queryPageById(db, qsiteid, qpageid)
-		if p == nil {
-			http.Error(w, fmt.Sprintf("pageid %d not found.", qpageid), 404)
+
+		// Read all checked fileid's into map. Unchecked filenames will be discarded.
+		// Ex. checkedFileids[<fileid>] == "y" (checked)
+		checkedFileids := map[int64]string{}
+		r.ParseForm()
+		for k := range r.Form {
+			if strings.HasPrefix(k, "chk-") {
+				fileid := idtoi(strings.TrimPrefix(k, "chk-"))
+				checkedFileids[fileid] = "y"
+			}
+		}
+
+		// Pages using each file, keyed by fileid.
+		s := fmt.Sprintf("SELECT file_id, filename, content_type FROM %s ORDER BY filename", filetblName(site.Siteid))
+		rows, err := db.Query(s)
+		if handleDbErr(w, err, "delfileHandler") {
 			return
 		}
+		files := []*File{}
+		for rows.Next() {
+			var file File
+			err = rows.Scan(&file.Fileid, &file.Filename, &file.Ctype)
+			if err != nil {
+				break
+			}
+			files = append(files, &file)
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		rows.Close()
+		if handleDbErr(w, err, "delfileHandler") {
+			return
+		}
+		usedby := map[int64][]*Page{}
+		for _, file := range files {
+			pp, err := queryLinkingPages(db, site.Siteid, "file", file.Filename)
+			if handleDbErr(w, err, "delfileHandler") {
+				return
+			}
+			usedby[file.Fileid] = pp
+		}
+
+		confirmInUse := r.FormValue("confirm") != ""
+		showConfirm := false
 
 		if r.Method == "POST" {
-			p.Title = strings.TrimSpace(r.FormValue("title"))
-			p.Body = r.FormValue("body")
-			p.Body = normalizeText(p.Body)
 			for {
-				if p.Title == "" {
-					errmsg = "Please enter a page title."
+				delFileids := []int64{}
+				inuse := false
+				for k := range checkedFileids {
+					delFileids = append(delFileids, k)
+					if len(usedby[k]) > 0 {
+						inuse = true
+					}
+				}
+				if len(delFileids) == 0 {
+					errmsg = "Please select files to delete."
+					break
+				}
+				if inuse && !confirmInUse {
+					errmsg = "Some of the selected files are still used by pages. Deleting them will break those pages."
+					showConfirm = true
 					break
 				}
 
-				s := fmt.Sprintf("UPDATE %s SET title = ?, body = ? WHERE page_id = ?", pagetblName(qsiteid))
-				_, err := sqlexec(db, s, p.Title, p.Body, qpageid)
+				err := trashFiles(db, site.Siteid, delFileids, login.Userid)
 				if err != nil {
-					log.Printf("Error updating page (%s)\n", err)
+					log.Printf("Error deleting files (%s)\n", err)
 					errmsg = "A problem occured. Please try again."
 					break
 				}
-				http.Redirect(w, r, pageUrl(site.Sitename, p.Title), http.StatusSeeOther)
+
+				http.Redirect(w, r, fmt.Sprintf("/uploadfile/?siteid=%d", qsiteid), http.StatusSeeOther)
 				return
 			}
 		}
 
 		w.Header().Set("Content-Type", "text/html")
 		P := makePrintFunc(w)
-		printHead(P, nil, nil, "Edit Page")
+		printHead(P, nil, siteCssUrls(site), "Upload File")
+
+		printSectionMenuHead(P, site, "", login)
 
-		printSectionMenuHead(P, site, login)
 		printMenuHead(P, "Actions")
-		printMenuLine(P, fmt.Sprintf("/editsite?siteid=%d", qsiteid), "Site Settings")
-		printMenuLine(P, fmt.Sprintf("/delpage?siteid=%d&pageid=%d", qsiteid, qpageid), "Delete Page")
+		printMenuLine(P, fmt.Sprintf("/uploadfile?siteid=%d", site.Siteid), "Upload Files")
+		printMenuLine(P, fmt.Sprintf("/trash?siteid=%d", site.Siteid), "Trash")
 		printMenuFoot(P)
+
+		printPagesMenu(P, db, site, "")
+		printFilesMenu(P, db, site)
 		printSectionMenuFoot(P)
 
 		printMainHead(P)
-		printPageNav(P, p.Title)
-		printFormHead(P, fmt.Sprintf("/editpage/?siteid=%d&pageid=%d", qsiteid, qpageid))
-		printFormTitle(P, "Edit Page")
+		printPageNav(P, "")
+		printFormHead(P, fmt.Sprintf("/delfile/?siteid=%d", qsiteid))
+		printFormTitle(P, "Delete Files")
 		printFormControlError(P, errmsg)
-		printFormControlInput(P, "title", "Title", p.Title, 10)
-		printFormControlTextarea(P, "body", "Body", p.Body, 25)
-		printFormControlSubmitButton(P, "update", "Update")
+
+		i := 0
+		for _, file := range files {
+			execTemplate(P, "delfileitem", struct {
+				Checkbox FormField
+				Siteid   int64
+				Fileid   int64
+				Fileurl  string
+				Usedby   []PageRef
+			}{
+				Checkbox: FormField{
+					Id:      fmt.Sprintf("chk-%d", file.Fileid),
+					Label:   file.Filename,
+					Checked: checkedFileids[file.Fileid] != "",
+					Thumb:   fileThumb(site, file.Filename, file.Ctype, 48),
+				},
+				Siteid:  site.Siteid,
+				Fileid:  file.Fileid,
+				Fileurl: fileUrl(site.Sitename, file.Filename),
+				Usedby:  pageRefs(site, usedby[file.Fileid]),
+			})
+			i++
+		}
+		if i == 0 {
+			printFormHelp(P, "(no files yet)")
+		}
+
+		if showConfirm {
+			printFormControlCheckbox(P, "confirm", "Delete files even though pages use them", false)
+		}
+		if i > 0 {
+			printFormControlSubmitButton(P, "del", "Move to Trash")
+		}
 		printFormFoot(P)
-		printMainFoot(P)
 
+		printMainFoot(P)
 		printSidebar(P, db)
-
 		printFoot(P)
 	}
 }
 
-func delpageHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+func filehistoryHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var errmsg string
 
@@ -1278,56 +6393,76 @@ func delpageHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 		}
 
 		qsiteid := idtoi(r.FormValue("siteid"))
-		qpageid := idtoi(r.FormValue("pageid"))
+		qfileid := idtoi(r.FormValue("fileid"))
 		site := querySiteById(db, qsiteid)
 		if site == nil {
 			http.Error(w, fmt.Sprintf("siteid %d not found.", qsiteid), 404)
 			return
 		}
-		p := queryPageById(db, qsiteid, qpageid)
-		if p == nil {
-			http.Error(w, fmt.Sprintf("pageid %d not found.", qpageid), 404)
+		file := queryFileInfoById(db, qsiteid, qfileid)
+		if file == nil {
+			http.Error(w, fmt.Sprintf("fileid %d not found.", qfileid), 404)
 			return
 		}
 
 		if r.Method == "POST" {
 			for {
-				s := fmt.Sprintf("DELETE FROM %s WHERE page_id = ?", pagetblName(qsiteid))
-				_, err := sqlexec(db, s, qpageid)
+				qversionid := idtoi(r.FormValue("restore"))
+				fv := queryFileVersion(db, qsiteid, qversionid)
+				if fv == nil || fv.Fileid != file.Fileid {
+					errmsg = "Please select a version to restore."
+					break
+				}
+				usage := querySiteUsage(db, qsiteid)
+				if usage+file.Size > siteQuota(site) {
+					errmsg = fmt.Sprintf("Not enough storage space to keep the current version. Site has used %s of its %s quota.", formatSize(usage), formatSize(siteQuota(site)))
+					break
+				}
+				err := restoreFileVersion(db, qsiteid, file.Fileid, fv.Versionid, login.Userid)
 				if err != nil {
-					log.Printf("Error deleting page (%s)\n", err)
+					log.Printf("Error restoring file version (%s)\n", err)
 					errmsg = "A problem occured. Please try again."
 					break
 				}
-				http.Redirect(w, r, pageUrl(site.Sitename, ""), http.StatusSeeOther)
+				http.Redirect(w, r, fmt.Sprintf("/filehistory/?siteid=%d&fileid=%d", qsiteid, qfileid), http.StatusSeeOther)
 				return
 			}
 		}
 
+		fvs, err := queryFileVersions(db, qsiteid, qfileid)
+		if handleDbErr(w, err, "filehistoryHandler") {
+			return
+		}
+
 		w.Header().Set("Content-Type", "text/html")
 		P := makePrintFunc(w)
-		printHead(P, nil, nil, "Delete Page")
+		printHead(P, nil, siteCssUrls(site), "File History")
 
-		printSectionMenuHead(P, site, login)
+		printSectionMenuHead(P, site, "", login)
 		printMenuHead(P, "Actions")
-		printMenuLine(P, fmt.Sprintf("/editsite?siteid=%d", qsiteid), "Site Settings")
-		printMenuLine(P, fmt.Sprintf("/editpage?siteid=%d&pageid=%d", qsiteid, qpageid), "Edit Page")
+		printMenuLine(P, fmt.Sprintf("/uploadfile?siteid=%d", site.Siteid), "Upload Files")
+		printMenuLine(P, fmt.Sprintf("/delfile?siteid=%d", site.Siteid), "Delete Files")
 		printMenuFoot(P)
+		printPagesMenu(P, db, site, "")
+		printFilesMenu(P, db, site)
 		printSectionMenuFoot(P)
 
 		printMainHead(P)
-		printPageNav(P, p.Title)
-
-		printFormHead(P, fmt.Sprintf("/delpage/?siteid=%d&pageid=%d", qsiteid, qpageid))
+		printPageNav(P, "")
+		printFormHead(P, fmt.Sprintf("/filehistory/?siteid=%d&fileid=%d", qsiteid, qfileid))
+		printFormTitle(P, fmt.Sprintf("History of %s", file.Filename))
 		printFormControlError(P, errmsg)
-		printFormControlHead(P)
-		printFormSubmitButton(P, "delete", "Delete Page")
-		P("<a class=\"ml-2 text-blue-900 no-underline\" href=\"/?siteid=%d&title=%s\">Cancel</a>\n", qsiteid, escape(p.Title))
-		printFormControlFoot(P)
-		P("<div class=\"border p-2\">\n")
-		printFormTitle(P, p.Title)
-		printContentDiv(P, parseMarkdown(p.Body))
-		P("</div>\n")
+
+		uploader := "(unknown)"
+		if u := queryUserById(db, file.Userid); u != nil {
+			uploader = u.Username
+		}
+		execTemplate(P, "filehistory", struct {
+			File     *File
+			Fileurl  string
+			Uploader string
+			Versions []*FileVersion
+		}{file, fileUrl(site.Sitename, file.Filename), uploader, fvs})
 		printFormFoot(P)
 
 		printMainFoot(P)
@@ -1336,7 +6471,26 @@ func delpageHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 	}
 }
 
-func uploadfileHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+// Link to a page, for templates.
+type PageRef struct {
+	Title   string
+	Href    string
+	Site    string // set when listing pages from several sites
+	Summary string
+}
+
+func pageRefs(site *Site, pp []*Page) []PageRef {
+	var refs []PageRef
+	for _, p := range pp {
+		refs = append(refs, PageRef{Title: p.Title, Href: pageUrl(site.Sitename, p.Title), Summary: p.Summary})
+	}
+	return refs
+}
+func printUsedByPages(P PrintFunc, site *Site, pp []*Page) {
+	execTemplate(P, "usedby", pageRefs(site, pp))
+}
+
+func renamefileHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var errmsg string
 
@@ -1346,69 +6500,78 @@ func uploadfileHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 		}
 
 		qsiteid := idtoi(r.FormValue("siteid"))
+		qfileid := idtoi(r.FormValue("fileid"))
 		site := querySiteById(db, qsiteid)
 		if site == nil {
 			http.Error(w, fmt.Sprintf("siteid %d not found.", qsiteid), 404)
 			return
 		}
+		file := queryFileInfoById(db, qsiteid, qfileid)
+		if file == nil {
+			http.Error(w, fmt.Sprintf("fileid %d not found.", qfileid), 404)
+			return
+		}
+		usedby, err := queryLinkingPages(db, qsiteid, "file", file.Filename)
+		if handleDbErr(w, err, "renamefileHandler") {
+			return
+		}
 
+		newname := file.Filename
+		rewriteRefs := true
 		if r.Method == "POST" {
+			newname = cleanFilename(r.FormValue("filename"))
+			rewriteRefs = r.FormValue("rewrite") != ""
 			for {
-				file, header, err := r.FormFile("file")
-				if file != nil {
-					defer file.Close()
-				}
-				if err != nil {
-					log.Printf("uploadfile: IO error reading file: %s\n", err)
-					errmsg = "A problem occured. Please try again."
+				if newname == "" {
+					errmsg = "Please enter a filename."
 					break
 				}
-				if header == nil {
-					errmsg = "Please select a file to upload."
-					break
+				if newname == file.Filename {
+					http.Redirect(w, r, fmt.Sprintf("/delfile/?siteid=%d", qsiteid), http.StatusSeeOther)
+					return
 				}
-
-				bs, err := ioutil.ReadAll(file)
-				if err != nil {
-					log.Printf("uploadfile: IO error reading file: %s\n", err)
-					errmsg = "A problem occured. Please try again."
+				if queryFileInfoByFilename(db, qsiteid, newname) != nil {
+					errmsg = fmt.Sprintf("A file named '%s' already exists.", newname)
 					break
 				}
-
-				s := fmt.Sprintf("INSERT INTO %s (filename, bytes) VALUES (?, ?);", filetblName(qsiteid))
-				_, err = sqlexec(db, s, header.Filename, bs)
+				err := renameFile(db, qsiteid, file.Fileid, file.Filename, newname, rewriteRefs)
 				if err != nil {
-					log.Printf("uploadfile: DB error inserting file contents: %s\n", err)
+					log.Printf("Error renaming file (%s)\n", err)
 					errmsg = "A problem occured. Please try again."
 					break
 				}
-
-				http.Redirect(w, r, fmt.Sprintf("/uploadfile/?siteid=%d", qsiteid), http.StatusSeeOther)
+				http.Redirect(w, r, fmt.Sprintf("/delfile/?siteid=%d", qsiteid), http.StatusSeeOther)
 				return
 			}
 		}
 
 		w.Header().Set("Content-Type", "text/html")
 		P := makePrintFunc(w)
-		printHead(P, nil, nil, "Upload File")
-
-		printSectionMenuHead(P, site, login)
+		printHead(P, nil, siteCssUrls(site), "Rename File")
 
+		printSectionMenuHead(P, site, "", login)
 		printMenuHead(P, "Actions")
+		printMenuLine(P, fmt.Sprintf("/uploadfile?siteid=%d", site.Siteid), "Upload Files")
 		printMenuLine(P, fmt.Sprintf("/delfile?siteid=%d", site.Siteid), "Delete Files")
+		printMenuLine(P, fmt.Sprintf("/filehistory?siteid=%d&fileid=%d", site.Siteid, file.Fileid), "File History")
 		printMenuFoot(P)
-
-		printPagesMenu(P, db, site)
+		printPagesMenu(P, db, site, "")
 		printFilesMenu(P, db, site)
 		printSectionMenuFoot(P)
 
 		printMainHead(P)
 		printPageNav(P, "")
-		printFormHeadMultipart(P, fmt.Sprintf("/uploadfile/?siteid=%d", qsiteid))
-		printFormTitle(P, "Upload File")
+		printFormHead(P, fmt.Sprintf("/renamefile/?siteid=%d&fileid=%d", qsiteid, qfileid))
+		printFormTitle(P, fmt.Sprintf("Rename %s", file.Filename))
 		printFormControlError(P, errmsg)
-		printFormControlFile(P, "file", "Upload file")
-		printFormControlSubmitButton(P, "upload", "Upload")
+		printFormControlInput(P, "filename", "New filename", newname, 60)
+		if len(usedby) > 0 {
+			printFormControlHead(P)
+			printFormCheckbox(P, "rewrite", "Update references in pages that use this file", rewriteRefs)
+			printUsedByPages(P, site, usedby)
+			printFormControlFoot(P)
+		}
+		printFormControlSubmitButton(P, "rename", "Rename")
 		printFormFoot(P)
 
 		printMainFoot(P)
@@ -1417,49 +6580,55 @@ func uploadfileHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 	}
 }
 
-func fileext(filename string) string {
-	ss := strings.Split(filename, ".")
-	if len(ss) < 2 {
-		return ""
-	}
-	return strings.ToLower(ss[len(ss)-1])
-}
-func printFile(db *sql.DB, w http.ResponseWriter, r *http.Request) {
-	qsitename, qfilename := parseFileUrl(r)
-	if qsitename == "" || qfilename == "" {
-		http.Error(w, fmt.Sprintf("Bad request (%s)", r.URL.Path), 400)
-		return
-	}
-
-	site := querySiteBySitename(db, qsitename)
-	if site == nil {
-		http.Error(w, fmt.Sprintf("sitename %s not found.", qsitename), 400)
+func printFileInfo(db *sql.DB, w http.ResponseWriter, r *http.Request, site *Site, file *File) {
+	login := getLoginUser(r, db)
+	usedby, err := queryLinkingPages(db, site.Siteid, "file", file.Filename)
+	if handleDbErr(w, err, "printFileInfo") {
 		return
 	}
-	file := queryFileByFilename(db, site.Siteid, qfilename)
-	if file == nil {
-		http.Error(w, fmt.Sprintf("filename %s not found.", qfilename), 400)
-		return
+	uploader := "(unknown)"
+	if u := queryUserById(db, file.Userid); u != nil {
+		uploader = u.Username
 	}
 
-	ext := fileext(file.Filename)
-	if ext == "" {
-		w.Header().Set("Content-Type", "application")
-	} else if ext == "png" || ext == "gif" || ext == "bmp" {
-		w.Header().Set("Content-Type", fmt.Sprintf("image/%s", ext))
-	} else if ext == "jpg" || ext == "jpeg" {
-		w.Header().Set("Content-Type", fmt.Sprintf("image/jpeg"))
-	} else {
-		w.Header().Set("Content-Type", fmt.Sprintf("application/%s", ext))
+	w.Header().Set("Content-Type", "text/html")
+	P := makePrintFunc(w)
+	printHead(P, nil, siteCssUrls(site), file.Filename)
+
+	printSectionMenuHead(P, site, "", login)
+	if login != nil {
+		printMenuHead(P, "Actions")
+		printMenuLine(P, fmt.Sprintf("/editfile?siteid=%d&fileid=%d", site.Siteid, file.Fileid), "Edit Details")
+		printMenuLine(P, fmt.Sprintf("/renamefile?siteid=%d&fileid=%d", site.Siteid, file.Fileid), "Rename File")
+		printMenuLine(P, fmt.Sprintf("/filehistory?siteid=%d&fileid=%d", site.Siteid, file.Fileid), "File History")
+		printMenuLine(P, fmt.Sprintf("/uploadfile?siteid=%d", site.Siteid), "Upload Files")
+		printMenuFoot(P)
 	}
+	printPagesMenu(P, db, site, "")
+	printFilesMenu(P, db, site)
+	printSectionMenuFoot(P)
 
-	_, err := w.Write(file.Bytes)
-	if handleDbErr(w, err, "printFile") {
-		return
+	printMainHead(P)
+	printPageNav(P, file.Filename)
+	var desc template.HTML
+	if file.Desc != "" {
+		desc = template.HTML(renderMarkdown(db, site, file.Desc))
 	}
+	execTemplate(P, "fileinfo", struct {
+		File     *File
+		Fileurl  string
+		Isimage  bool
+		Desc     template.HTML
+		Uploader string
+		Usedby   []PageRef
+	}{file, fileUrl(site.Sitename, file.Filename), isResizableImage(file.Ctype), desc, uploader, pageRefs(site, usedby)})
+
+	printMainFoot(P)
+	printSidebar(P, db)
+	printFoot(P)
 }
 
-func delfileHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+func editfileHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var errmsg string
 
@@ -1469,90 +6638,186 @@ func delfileHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 		}
 
 		qsiteid := idtoi(r.FormValue("siteid"))
+		qfileid := idtoi(r.FormValue("fileid"))
 		site := querySiteById(db, qsiteid)
 		if site == nil {
 			http.Error(w, fmt.Sprintf("siteid %d not found.", qsiteid), 404)
 			return
 		}
-
-		// Read all checked fileid's into map. Unchecked filenames will be discarded.
-		// Ex. checkedFileids[<fileid>] == "y" (checked)
-		checkedFileids := map[int64]string{}
-		r.ParseForm()
-		for k := range r.Form {
-			if strings.HasPrefix(k, "chk-") {
-				fileid := idtoi(strings.TrimPrefix(k, "chk-"))
-				checkedFileids[fileid] = "y"
-			}
+		file := queryFileInfoById(db, qsiteid, qfileid)
+		if file == nil {
+			http.Error(w, fmt.Sprintf("fileid %d not found.", qfileid), 404)
+			return
 		}
 
 		if r.Method == "POST" {
+			file.Desc = normalizeText(strings.TrimSpace(r.FormValue("desc")))
+			file.Alt = strings.TrimSpace(r.FormValue("alt"))
 			for {
-				fileids := []string{}
-				for k := range checkedFileids {
-					fileids = append(fileids, itoa(k))
-				}
-				s := fmt.Sprintf("DELETE FROM %s WHERE file_id IN (%s)", filetblName(site.Siteid), strings.Join(fileids, ", "))
-				_, err := sqlexec(db, s)
+				s := fmt.Sprintf("UPDATE %s SET desc = ?, alt = ? WHERE file_id = ?", filetblName(qsiteid))
+				_, err := sqlexec(db, s, file.Desc, file.Alt, qfileid)
 				if err != nil {
-					log.Printf("Error deleting files (%s)\n", err)
+					log.Printf("Error updating file (%s)\n", err)
 					errmsg = "A problem occured. Please try again."
 					break
 				}
-
-				http.Redirect(w, r, fmt.Sprintf("/uploadfile/?siteid=%d", qsiteid), http.StatusSeeOther)
+				http.Redirect(w, r, fileUrl(site.Sitename, file.Filename)+"?info", http.StatusSeeOther)
 				return
 			}
 		}
 
 		w.Header().Set("Content-Type", "text/html")
 		P := makePrintFunc(w)
-		printHead(P, nil, nil, "Upload File")
-
-		printSectionMenuHead(P, site, login)
+		printHead(P, nil, siteCssUrls(site), "Edit File")
 
+		printSectionMenuHead(P, site, "", login)
 		printMenuHead(P, "Actions")
-		printMenuLine(P, fmt.Sprintf("/uploadfile?siteid=%d", site.Siteid), "Upload Files")
+		printMenuLine(P, fileUrl(site.Sitename, file.Filename)+"?info", "File Details")
+		printMenuLine(P, fmt.Sprintf("/renamefile?siteid=%d&fileid=%d", site.Siteid, file.Fileid), "Rename File")
 		printMenuFoot(P)
-
-		printPagesMenu(P, db, site)
+		printPagesMenu(P, db, site, "")
 		printFilesMenu(P, db, site)
 		printSectionMenuFoot(P)
 
 		printMainHead(P)
 		printPageNav(P, "")
-		printFormHead(P, fmt.Sprintf("/delfile/?siteid=%d", qsiteid))
-		printFormTitle(P, "Delete Files")
+		printFormHead(P, fmt.Sprintf("/editfile/?siteid=%d&fileid=%d", qsiteid, qfileid))
+		printFormTitle(P, fmt.Sprintf("Edit %s", file.Filename))
 		printFormControlError(P, errmsg)
+		printFormControlInput(P, "alt", "Alt text (describes the image for screen readers)", file.Alt, 60)
+		printFormControlTextarea(P, "desc", "Description", file.Desc, 10)
+		printFormControlSubmitButton(P, "update", "Update")
+		printFormFoot(P)
 
-		s := fmt.Sprintf("SELECT file_id, filename FROM %s ORDER BY filename", filetblName(site.Siteid))
-		rows, err := db.Query(s)
-		if handleDbErr(w, err, "delfileHandler") {
+		printMainFoot(P)
+		printSidebar(P, db)
+		printFoot(P)
+	}
+}
+
+func trashHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var errmsg string
+
+		login := getLoginUser(r, db)
+		if !validateLogin(w, login) {
 			return
 		}
-		var file File
-		i := 0
-		for rows.Next() {
-			rows.Scan(&file.Fileid, &file.Filename)
-			printFormControlHead(P)
 
-			if checkedFileids[file.Fileid] != "" {
-				P("<input id=\"chk-%d\" name=\"chk-%d\" type=\"checkbox\" value=\"y\" checked>\n", file.Fileid, file.Fileid)
+		// No siteid shows the deleted sites.
+		var site *Site
+		qsiteid := idtoi(r.FormValue("siteid"))
+		if qsiteid != 0 {
+			site = querySiteById(db, qsiteid)
+			if site == nil {
+				http.Error(w, fmt.Sprintf("siteid %d not found.", qsiteid), 404)
+				return
+			}
+		}
+
+		if r.Method == "POST" {
+			restore := r.FormValue("restore") != ""
+			action := "purging"
+			if restore {
+				action = "restoring"
+			}
+			errs := []string{}
+			r.ParseForm()
+			for k := range r.Form {
+				var err error
+				id := idtoi(k[strings.Index(k, "-")+1:])
+				if strings.HasPrefix(k, "pg-") && site != nil {
+					if restore {
+						err = restorePage(db, site, id)
+					} else {
+						err = purgePage(db, site.Siteid, id)
+					}
+				} else if strings.HasPrefix(k, "fl-") && site != nil {
+					if restore {
+						err = restoreFile(db, site.Siteid, id)
+					} else {
+						err = purgeFile(db, site.Siteid, id)
+					}
+				} else if strings.HasPrefix(k, "st-") && site == nil {
+					if restore {
+						err = restoreSite(db, id)
+					} else {
+						err = purgeSite(db, id)
+					}
+				} else {
+					continue
+				}
+				if err != nil {
+					log.Printf("trashHandler: error %s %s (%s)\n", action, k, err)
+					errs = append(errs, err.Error())
+				}
+			}
+			if len(errs) == 0 {
+				http.Redirect(w, r, fmt.Sprintf("/trash/?siteid=%d", qsiteid), http.StatusSeeOther)
+				return
+			}
+			if restore {
+				errmsg = fmt.Sprintf("Some items couldn't be restored: %s.", strings.Join(errs, "; "))
 			} else {
-				P("<input id=\"chk-%d\" name=\"chk-%d\" type=\"checkbox\" value=\"y\">\n", file.Fileid, file.Fileid)
+				errmsg = fmt.Sprintf("Some items couldn't be deleted: %s.", strings.Join(errs, "; "))
 			}
-			P("<label class=\"mr-2\" for=\"chk-%d\">%s</label>\n", file.Fileid, file.Filename)
-			//			P("<a class=\"text-xs text-blue-900\" href=\"%s\">link</a>\n", fileUrl(site.Sitename, file.Filename))
+		}
 
-			printFormControlFoot(P)
-			i++
+		w.Header().Set("Content-Type", "text/html")
+		P := makePrintFunc(w)
+		printHead(P, nil, siteCssUrls(site), "Trash")
+
+		printSectionMenuHead(P, site, "", login)
+		if site != nil {
+			printMenuHead(P, "Actions")
+			printMenuLine(P, fmt.Sprintf("/editsite?siteid=%d", site.Siteid), "Site Settings")
+			printMenuLine(P, fmt.Sprintf("/uploadfile?siteid=%d", site.Siteid), "Upload Files")
+			printMenuFoot(P)
+			printPagesMenu(P, db, site, "")
+			printFilesMenu(P, db, site)
 		}
-		if i == 0 {
-			P("<p class=\"text-gray-700 italic\">(no files yet)</p>")
+		printSectionMenuFoot(P)
+
+		printMainHead(P)
+		printPageNav(P, "")
+		printFormHead(P, fmt.Sprintf("/trash/?siteid=%d", qsiteid))
+		if site != nil {
+			printFormTitle(P, "Trash")
+		} else {
+			printFormTitle(P, "Deleted Sites")
+		}
+		printFormControlError(P, errmsg)
+		printFormHelp(P, fmt.Sprintf("Items in the trash are permanently deleted after %d days.", int(_trashRetention.Hours()/24)))
+		if site != nil {
+			printFormHelp(P, "Files in the trash count towards the site's storage quota until they're permanently deleted.")
 		}
 
-		if i > 0 {
-			printFormControlSubmitButton(P, "del", "Delete")
+		n := 0
+		if site != nil {
+			pages, err := queryTrashPages(db, site.Siteid)
+			if handleDbErr(w, err, "trashHandler") {
+				return
+			}
+			files, err := queryTrashFiles(db, site.Siteid)
+			if handleDbErr(w, err, "trashHandler") {
+				return
+			}
+			n += printTrashItems(P, "Pages", "pg", pages)
+			n += printTrashItems(P, "Files", "fl", files)
+		} else {
+			sites, err := queryTrashSites(db)
+			if handleDbErr(w, err, "trashHandler") {
+				return
+			}
+			n += printTrashItems(P, "Sites", "st", sites)
+		}
+
+		if n > 0 {
+			printFormControlHead(P)
+			printFormSubmitButton(P, "restore", "Restore")
+			printFormSpacer(P)
+			printFormSubmitButton(P, "purge", "Delete Permanently")
+			printFormControlFoot(P)
 		}
 		printFormFoot(P)
 
@@ -1561,3 +6826,14 @@ func delfileHandler(db *sql.DB) func(http.ResponseWriter, *http.Request) {
 		printFoot(P)
 	}
 }
+
+// Print checkbox list of trash items. Returns number of items printed.
+func printTrashItems(P PrintFunc, title, prefix string, items []*TrashItem) int {
+	execTemplate(P, "trashitems", struct {
+		Title  string
+		Lower  string
+		Prefix string
+		Items  []*TrashItem
+	}{title, strings.ToLower(title), prefix, items})
+	return len(items)
+}
@@ -0,0 +1,1812 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Handlers print pages through the embedded templates.
+func TestMain(m *testing.M) {
+	err := loadTemplates("")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// New database as created by "t2 -i", with the "main" site.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dbfile := filepath.Join(t.TempDir(), "test.db")
+	createTables(dbfile)
+	db, err := sql.Open("sqlite3", dbfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// Database with the schema of the first version of t2, before migrations
+// were added. Site "one" has a start page linking to a page and a file.
+func openBaselineDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "baseline.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	ss := []string{
+		"CREATE TABLE user (user_id INTEGER PRIMARY KEY NOT NULL, username TEXT UNIQUE, password TEXT, active INTEGER NOT NULL, email TEXT)",
+		"CREATE TABLE site (site_id INTEGER PRIMARY KEY NOT NULL, sitename TEXT UNIQUE, desc TEXT)",
+		"CREATE TABLE pages_1 (page_id INTEGER PRIMARY KEY NOT NULL, title TEXT UNIQUE, body TEXT)",
+		"CREATE TABLE files_1 (file_id INTEGER PRIMARY KEY NOT NULL, filename TEXT UNIQUE, bytes BLOB)",
+		"INSERT INTO user (user_id, username, password, active, email) VALUES (1, 'admin', '', 1, '')",
+		"INSERT INTO site (site_id, sitename, desc) VALUES (1, 'one', 'Site one')",
+		"INSERT INTO pages_1 (page_id, title, body) VALUES (1, 'Start', '---\nsummary: The start\ntags: a, b\n---\nSee [[Other]] and ![[pic.png]].')",
+		"INSERT INTO pages_1 (page_id, title, body) VALUES (2, 'Other', 'Other page')",
+		"INSERT INTO files_1 (file_id, filename, bytes) VALUES (1, 'pic.png', X'89504E470D0A1A0A0000000D49484452')",
+	}
+	for _, s := range ss {
+		_, err := db.Exec(s)
+		if err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+	}
+	return db
+}
+
+func TestMigrateBaselineDB(t *testing.T) {
+	db := openBaselineDB(t)
+	err := migrateDB(db)
+	if err != nil {
+		t.Fatalf("migrateDB: %s", err)
+	}
+	// Migrations are run on every startup.
+	err = migrateDB(db)
+	if err != nil {
+		t.Fatalf("migrateDB second run: %s", err)
+	}
+
+	site := querySiteById(db, 1)
+	if site == nil || site.Sitename != "one" {
+		t.Fatalf("site 1 = %+v, want site 'one'", site)
+	}
+
+	file := queryFileInfoByFilename(db, 1, "pic.png")
+	if file == nil {
+		t.Fatal("file 'pic.png' not found")
+	}
+	bs := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+	if file.Hash != hashBytes(bs) {
+		t.Errorf("file hash = %q, want %q", file.Hash, hashBytes(bs))
+	}
+	if file.Ctype != "image/png" {
+		t.Errorf("file content type = %q, want image/png", file.Ctype)
+	}
+
+	p := queryPageByTitle(db, 1, "Start")
+	if p == nil {
+		t.Fatal("page 'Start' not found")
+	}
+	if p.Summary != "The start" {
+		t.Errorf("page summary = %q, want %q", p.Summary, "The start")
+	}
+	tags, err := queryPageTags(db, 1, p.Pageid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 2 {
+		t.Errorf("page tags = %v, want [a b]", tags)
+	}
+
+	pp, err := queryLinkingPages(db, 1, "file", "pic.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pp) != 1 || pp[0].Title != "Start" {
+		t.Errorf("pages using 'pic.png' = %v, want [Start]", pp)
+	}
+	pp, err = queryLinkingPages(db, 1, "page", "Other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pp) != 1 || pp[0].Title != "Start" {
+		t.Errorf("pages linking to 'Other' = %v, want [Start]", pp)
+	}
+
+	// Pages and sites can be created in the migrated tables.
+	_, err = createPage(db, site, &Page{Title: "New", Body: "new page"})
+	if err != nil {
+		t.Errorf("createPage: %s", err)
+	}
+	_, err = createSite(db, &Site{Sitename: "two"})
+	if err != nil {
+		t.Errorf("createSite: %s", err)
+	}
+}
+
+func TestTrashStartPage(t *testing.T) {
+	db := openTestDB(t)
+	site := querySiteBySitename(db, "main")
+	if site == nil {
+		t.Fatal("site 'main' not found")
+	}
+
+	// The start page is recreated as page_id 1 once it's trashed.
+	err := createIndexPage(db, site, &Page{Title: "Start", Body: "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = trashPage(db, site.Siteid, 1, 1)
+	if err != nil {
+		t.Fatalf("trashPage: %s", err)
+	}
+	err = createIndexPage(db, site, &Page{Title: "Start 2", Body: "second"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = trashPage(db, site.Siteid, 1, 1)
+	if err != errStartPageInTrash {
+		t.Fatalf("trashPage with a start page in the trash = %v, want errStartPageInTrash", err)
+	}
+	if queryPageById(db, site.Siteid, 1) == nil {
+		t.Fatal("start page was removed by failed trashPage")
+	}
+
+	// Restoring the earlier start page gives it a new page_id.
+	err = restorePage(db, site, 1)
+	if err != nil {
+		t.Fatalf("restorePage: %s", err)
+	}
+	p := queryPageByTitle(db, site.Siteid, "Start")
+	if p == nil || p.Pageid == 1 {
+		t.Fatalf("restored start page = %+v, want a new page_id", p)
+	}
+	err = trashPage(db, site.Siteid, 1, 1)
+	if err != nil {
+		t.Fatalf("trashPage after restore: %s", err)
+	}
+}
+
+// Trashed items keep their ids, so new items must not reuse them, also in
+// databases from before ids were AUTOINCREMENT.
+func TestTrashedIdsNotReused(t *testing.T) {
+	db := openBaselineDB(t)
+	err := migrateDB(db)
+	if err != nil {
+		t.Fatalf("migrateDB: %s", err)
+	}
+	site := querySiteById(db, 1)
+
+	err = trashPage(db, 1, 2, 1)
+	if err != nil {
+		t.Fatalf("trashPage: %s", err)
+	}
+	pageid, err := createPage(db, site, &Page{Title: "New", Body: "new page"})
+	if err != nil {
+		t.Fatalf("createPage: %s", err)
+	}
+	if pageid == 2 {
+		t.Errorf("new page reused trashed page_id 2")
+	}
+	err = restorePage(db, site, 2)
+	if err != nil {
+		t.Errorf("restorePage: %s", err)
+	}
+
+	err = trashFiles(db, 1, []int64{1}, 1)
+	if err != nil {
+		t.Fatalf("trashFiles: %s", err)
+	}
+	_, err = saveFile(db, site, "new.txt", []byte("new file"), "", 1)
+	if err != nil {
+		t.Fatalf("saveFile: %s", err)
+	}
+	if file := queryFileInfoByFilename(db, 1, "new.txt"); file == nil || file.Fileid == 1 {
+		t.Errorf("new file = %+v, reused trashed file_id 1", file)
+	}
+	err = restoreFile(db, 1, 1)
+	if err != nil {
+		t.Errorf("restoreFile: %s", err)
+	}
+
+	err = trashSite(db, 1, 1)
+	if err != nil {
+		t.Fatalf("trashSite: %s", err)
+	}
+	siteid, err := createSite(db, &Site{Sitename: "two"})
+	if err != nil {
+		t.Fatalf("createSite after trashing the highest site: %s", err)
+	}
+	if siteid == 1 {
+		t.Errorf("new site reused trashed site_id 1")
+	}
+	err = restoreSite(db, 1)
+	if err != nil {
+		t.Errorf("restoreSite: %s", err)
+	}
+}
+
+// A trashed page is checked against pages saved since it was deleted before
+// it is restored, the same as when saving it.
+func TestRestorePageMeta(t *testing.T) {
+	db := openTestDB(t)
+	site := querySiteById(db, 1)
+
+	for _, p := range []*Page{
+		{Title: "A", Body: "---\naliases: X\n---\nA"},
+		{Title: "B", Body: "B"},
+	} {
+		pageid, err := createPage(db, site, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = trashPage(db, site.Siteid, pageid, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Pageid = pageid
+	}
+	_, err := createPage(db, site, &Page{Title: "X", Body: "X"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = createPage(db, site, &Page{Title: "C", Body: "---\naliases: B\n---\nC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		title string
+		err   string
+	}{
+		{"A", "Alias 'X' is the title of another page"},
+		{"B", "Title 'B' is an alias of page 'C'"},
+	}
+	for _, test := range tests {
+		var pageid int64
+		s := fmt.Sprintf("SELECT page_id FROM %s WHERE title = ?", pagetrashtblName(site.Siteid))
+		err := db.QueryRow(s, test.title).Scan(&pageid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = restorePage(db, site, pageid)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("restorePage(%s) = %v, want %q", test.title, err, test.err)
+		}
+		if queryPageByTitle(db, site.Siteid, test.title) != nil {
+			t.Errorf("page %s restored", test.title)
+		}
+	}
+}
+
+func TestParseFrontMatter(t *testing.T) {
+	tests := []struct {
+		body string
+		fm   FrontMatter
+		rest string
+	}{
+		{"No front matter", FrontMatter{}, "No front matter"},
+		{"---\n---\nEmpty", FrontMatter{}, "Empty"},
+		{"---\ntags: [a, b]\naliases: x, y\nsummary: \" Sum \"\nlayout: wide\n---\nBody\n", FrontMatter{Tags: stringList{"a", "b"}, Aliases: stringList{"x", "y"}, Summary: "Sum", Layout: "wide"}, "Body\n"},
+		{"---\ntags:\n  - a\n  - \" \"\n---", FrontMatter{Tags: stringList{"a"}}, ""},
+		{"Text\n---\ntags: a\n---\n", FrontMatter{}, "Text\n---\ntags: a\n---\n"},
+	}
+	for _, test := range tests {
+		fm, rest, err := parseFrontMatter(test.body)
+		if err != nil {
+			t.Errorf("parseFrontMatter(%q) error: %s", test.body, err)
+			continue
+		}
+		if !reflect.DeepEqual(fm, test.fm) || rest != test.rest {
+			t.Errorf("parseFrontMatter(%q) = %+v, %q, want %+v, %q", test.body, fm, rest, test.fm, test.rest)
+		}
+	}
+
+	_, _, err := parseFrontMatter("---\ntags: [a\n---\nBody")
+	if err == nil {
+		t.Errorf("parseFrontMatter with invalid yaml, want error")
+	}
+}
+
+func TestAddPageAlias(t *testing.T) {
+	tests := []struct {
+		body    string
+		alias   string
+		aliases []string
+		rest    string
+	}{
+		{"Body", "Old", []string{"Old"}, "Body"},
+		{"---\nsummary: Sum\naliases: a, b\n---\nBody", "Old", []string{"a", "b", "Old"}, "Body"},
+		{"---\naliases: [Old]\n---\nBody", "Old", []string{"Old"}, "Body"},
+	}
+	for _, test := range tests {
+		body, err := addPageAlias(test.body, test.alias)
+		if err != nil {
+			t.Errorf("addPageAlias(%q, %q) error: %s", test.body, test.alias, err)
+			continue
+		}
+		fm, rest, err := parseFrontMatter(body)
+		if err != nil {
+			t.Errorf("addPageAlias(%q, %q) = %q, invalid front matter: %s", test.body, test.alias, body, err)
+			continue
+		}
+		if !reflect.DeepEqual([]string(fm.Aliases), test.aliases) || rest != test.rest {
+			t.Errorf("addPageAlias(%q, %q) = %q, want aliases %v and body %q", test.body, test.alias, body, test.aliases, test.rest)
+		}
+	}
+
+	// Other front matter keys are kept.
+	body, _ := addPageAlias("---\nsummary: Sum\ntags: t\n---\nBody", "Old")
+	fm, _, _ := parseFrontMatter(body)
+	if fm.Summary != "Sum" || len(fm.Tags) != 1 {
+		t.Errorf("addPageAlias lost front matter keys: %q", body)
+	}
+}
+
+func TestParsePageLinks(t *testing.T) {
+	body := "---\ntags: Go, SQL\naliases: Old\n---\n" +
+		"See [[Page One]], [[Page Two|label]], [[Page Three#Section]] and [[#Local]].\n" +
+		"![[pic.png|400]] [[~file/doc.pdf|the doc]]\n" +
+		"{{include: Snippet}}\n" +
+		"`{{include: In Code}}` `[[Code Page]]`\n" +
+		"```\n![[code.png]] [[~file/code.pdf]]\n```\n"
+	want := []PageLink{
+		{"tag", "go"},
+		{"tag", "sql"},
+		{"alias", "Old"},
+		{"include", "Snippet"},
+		{"page", "Page One"},
+		{"page", "Page Two"},
+		{"page", "Page Three"},
+		{"file", "pic.png"},
+		{"file", "doc.pdf"},
+	}
+	links := parsePageLinks(body)
+	if !reflect.DeepEqual(links, want) {
+		t.Errorf("parsePageLinks() = %v, want %v", links, want)
+	}
+}
+
+func TestRewriteFileRefs(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		{"![[a.png]]", "![[b.png]]"},
+		{"![[ a.png |400]] ![[a.png#left]]", "![[ b.png |400]] ![[b.png#left]]"},
+		{"[[~file/a.png|pic]]", "[[~file/b.png|pic]]"},
+		{"![[a.png.bak]] [[a.png]] a.png", "![[a.png.bak]] [[a.png]] a.png"},
+		{"![[a.png]] `![[a.png]]`\n```\n[[~file/a.png]]\n```", "![[b.png]] `![[a.png]]`\n```\n[[~file/a.png]]\n```"},
+	}
+	for _, test := range tests {
+		body := rewriteFileRefs(test.body, "a.png", "b.png")
+		if body != test.want {
+			t.Errorf("rewriteFileRefs(%q) = %q, want %q", test.body, body, test.want)
+		}
+	}
+}
+
+func TestRenameFile(t *testing.T) {
+	db := openTestDB(t)
+	site := querySiteBySitename(db, "main")
+	_, err := saveFile(db, site, "a.png", []byte("png"), "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pageid, err := createPage(db, site, &Page{Title: "Uses", Body: "![[a.png]]"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := queryFileInfoByFilename(db, site.Siteid, "a.png")
+	err = renameFile(db, site.Siteid, file.Fileid, "a.png", "b.png", true)
+	if err != nil {
+		t.Fatalf("renameFile: %s", err)
+	}
+	if queryFileInfoByFilename(db, site.Siteid, "b.png") == nil {
+		t.Errorf("renamed file 'b.png' not found")
+	}
+	if p := queryPageById(db, site.Siteid, pageid); p.Body != "![[b.png]]" {
+		t.Errorf("page body = %q, want %q", p.Body, "![[b.png]]")
+	}
+	pp, err := queryLinkingPages(db, site.Siteid, "file", "b.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pp) != 1 {
+		t.Errorf("pages using 'b.png' = %v, want [Uses]", pp)
+	}
+}
+
+func TestParseWikiLink(t *testing.T) {
+	db := openTestDB(t)
+	site := querySiteBySitename(db, "main")
+	_, err := createPage(db, site, &Page{Title: "Home Page", Body: "---\naliases: Home\n---\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = saveFile(db, site, "doc.pdf", []byte("%PDF"), "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := Site{Sitename: "other"}
+	_, err = createSite(db, &other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = createPage(db, &other, &Page{Title: "There", Body: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		text string
+		want WikiLink
+	}{
+		{"Home Page", WikiLink{Href: "/main/Home+Page", Label: "Home Page"}},
+		{" Home Page | home ", WikiLink{Href: "/main/Home+Page", Label: "home"}},
+		{"Home", WikiLink{Href: "/main/Home", Label: "Home"}},
+		{"Home Page#Some Section", WikiLink{Href: "/main/Home+Page#some-section", Label: "Home Page#Some Section"}},
+		{"#Intro", WikiLink{Href: "#intro", Label: "#Intro"}},
+		{"Missing", WikiLink{Href: "/main/Missing", Label: "Missing", Missing: true}},
+		{"~file/doc.pdf", WikiLink{Href: "/main/~file/doc.pdf", Label: "doc.pdf"}},
+		{"~file/none.pdf|gone", WikiLink{Href: "/main/~file/none.pdf", Label: "gone", Missing: true}},
+		{"other:There", WikiLink{Href: "/other/There", Label: "other:There"}},
+		{"other:Nowhere", WikiLink{Href: "/other/Nowhere", Label: "other:Nowhere", Missing: true}},
+		{"nosite:Title", WikiLink{Href: "/main/nosite%3ATitle", Label: "nosite:Title", Missing: true}},
+		{"main:Home Page", WikiLink{Href: "/main/Home+Page", Label: "Home Page"}},
+		{"main:Home Page|main home", WikiLink{Href: "/main/Home+Page", Label: "main home"}},
+	}
+	for _, test := range tests {
+		link := parseWikiLink(db, &RenderState{}, site, test.text)
+		if link != test.want {
+			t.Errorf("parseWikiLink(%q) = %+v, want %+v", test.text, link, test.want)
+		}
+	}
+}
+
+func TestRewritePageRefs(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		{"[[A]] [[A|label]] [[A#Sec]]", "[[B]] [[B|label]] [[B#Sec]]"},
+		{"[[A/Child]] [[ A/Child | c ]]", "[[B/Child]] [[ B/Child | c ]]"},
+		{"{{include: A}} {{include A/Part}}", "{{include: B}} {{include B/Part}}"},
+		{"[[AB]] [[A B]] ![[A]] A", "[[AB]] [[A B]] ![[A]] A"},
+	}
+	for _, test := range tests {
+		body := rewritePageRefs(test.body, "A", "B")
+		if body != test.want {
+			t.Errorf("rewritePageRefs(%q) = %q, want %q", test.body, body, test.want)
+		}
+	}
+}
+
+func TestMovePage(t *testing.T) {
+	db := openTestDB(t)
+	site := querySiteBySitename(db, "main")
+	for _, p := range []*Page{
+		{Title: "A/x", Body: "x"},
+		{Title: "A/x/y", Body: "y"},
+		{Title: "Links", Body: "[[A/x]] [[A/x/y]]"},
+	} {
+		_, err := createPage(db, site, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := movePage(db, site, "A/x", "B/x", true, false)
+	if err != nil {
+		t.Fatalf("movePage: %s", err)
+	}
+	if queryPageByTitle(db, site.Siteid, "B/x") == nil || queryPageByTitle(db, site.Siteid, "B/x/y") == nil {
+		t.Errorf("moved pages not found")
+	}
+	if p := queryPageByTitle(db, site.Siteid, "Links"); p.Body != "[[B/x]] [[B/x/y]]" {
+		t.Errorf("links after move = %q, want %q", p.Body, "[[B/x]] [[B/x/y]]")
+	}
+
+	// Without keeping aliases, the old title is free for a new page.
+	if ap := queryPageByAlias(db, site.Siteid, "A/x"); ap != nil {
+		t.Errorf("old title 'A/x' is an alias of '%s'", ap.Title)
+	}
+	p := Page{Title: "A/x", Body: "new"}
+	if errmsg := validatePageMeta(db, site, &p); errmsg != "" {
+		t.Errorf("new page with old title: %s", errmsg)
+	}
+
+	err = movePage(db, site, "B/x", "C/x", false, true)
+	if err != nil {
+		t.Fatalf("movePage: %s", err)
+	}
+	if ap := queryPageByAlias(db, site.Siteid, "B/x"); ap == nil || ap.Title != "C/x" {
+		t.Errorf("alias 'B/x' = %+v, want page 'C/x'", ap)
+	}
+	if ap := queryPageByAlias(db, site.Siteid, "B/x/y"); ap == nil || ap.Title != "C/x/y" {
+		t.Errorf("alias 'B/x/y' = %+v, want page 'C/x/y'", ap)
+	}
+	if p := queryPageByTitle(db, site.Siteid, "Links"); p.Body != "[[B/x]] [[B/x/y]]" {
+		t.Errorf("links after move without rewrite = %q, want them unchanged", p.Body)
+	}
+}
+
+func TestIsSafeZipPath(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"a.txt", true},
+		{"dir/sub/a.txt", true},
+		{"a..b.txt", true},
+		{"", false},
+		{"/etc/passwd", false},
+		{"../a.txt", false},
+		{"dir/../../a.txt", false},
+		{"dir\\a.txt", false},
+		{"C:/a.txt", false},
+	}
+	for _, test := range tests {
+		if got := isSafeZipPath(test.name); got != test.want {
+			t.Errorf("isSafeZipPath(%q) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// Zip file with the named entries, in order. Names ending in "/" are dirs.
+func makeTestZip(t *testing.T, entries [][2]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.Create(e[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write([]byte(e[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestZipImport(t *testing.T) {
+	db := openTestDB(t)
+	site := querySiteBySitename(db, "main")
+	_, err := saveFile(db, site, "old.txt", []byte("old"), "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bs := makeTestZip(t, [][2]string{
+		{"docs/", ""},
+		{"docs/a.txt", "a"},
+		{"other/a.txt", "second a"},
+		{"old.txt", "new"},
+		{"../evil.txt", "evil"},
+		{"__MACOSX/._a.txt", "mac"},
+		{".hidden", "hidden"},
+		{"pages/Zip Page.md", "---\ntags: zip\n---\nFrom a zip"},
+	})
+	zr, err := zip.NewReader(bytes.NewReader(bs), int64(len(bs)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readZipEntries(db, site, zr, true)
+	if err != nil {
+		t.Fatalf("readZipEntries: %s", err)
+	}
+	want := []struct {
+		target string
+		ispage bool
+		exists bool
+		ok     bool
+	}{
+		{"a.txt", false, false, true},
+		{"a.txt", false, false, false},
+		{"old.txt", false, true, true},
+		{"", false, false, false},
+		{"", false, false, false},
+		{"", false, false, false},
+		{"Zip Page", true, false, true},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("readZipEntries returned %d entries, want %d", len(entries), len(want))
+	}
+	for i, entry := range entries {
+		w := want[i]
+		if entry.Target != w.target || entry.IsPage != w.ispage || entry.Exists != w.exists || (entry.Err == nil) != w.ok {
+			t.Errorf("entry %q = %+v, want target %q, page %v, exists %v, ok %v", entry.Name, entry, w.target, w.ispage, w.exists, w.ok)
+		}
+	}
+
+	// Extract only from zips uploaded to the same site by the same user.
+	zipid := fmt.Sprintf("t2zip-%d-1-%d.zip", site.Siteid, os.Getpid())
+	zippath := filepath.Join(os.TempDir(), zipid)
+	err = os.WriteFile(zippath, bs, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(zippath)
+	results := extractZipUpload(db, site, zipid, true, "skip", 2)
+	if len(results) != 1 || results[0].Err == nil {
+		t.Errorf("extractZipUpload by another user = %+v, want error", results)
+	}
+
+	results = extractZipUpload(db, site, zipid, true, "skip", 1)
+	if len(results) != len(want) {
+		t.Fatalf("extractZipUpload returned %d results, want %d", len(results), len(want))
+	}
+	if results[2].Err != errSkipped {
+		t.Errorf("extracting existing file 'old.txt' = %v, want errSkipped", results[2].Err)
+	}
+	if file := queryFileByFilename(db, site.Siteid, "a.txt"); file == nil || string(file.Bytes) != "a" {
+		t.Errorf("extracted file 'a.txt' = %+v, want contents 'a'", file)
+	}
+	if file := queryFileByFilename(db, site.Siteid, "old.txt"); file == nil || string(file.Bytes) != "old" {
+		t.Errorf("skipped file 'old.txt' = %+v, want contents 'old'", file)
+	}
+	p := queryPageByTitle(db, site.Siteid, "Zip Page")
+	if p == nil {
+		t.Fatal("extracted page 'Zip Page' not found")
+	}
+	tags, err := queryPageTags(db, site.Siteid, p.Pageid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tags, []string{"zip"}) {
+		t.Errorf("extracted page tags = %v, want [zip]", tags)
+	}
+	if _, err := os.Stat(zippath); !os.IsNotExist(err) {
+		t.Errorf("zip upload %s not removed after extracting", zippath)
+	}
+}
+
+// Create page in site and return its rendered html.
+func renderTestPage(t *testing.T, db *sql.DB, site *Site, title, body string) string {
+	t.Helper()
+	p := Page{Title: title, Body: body}
+	pageid, err := createPage(db, site, &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Pageid = pageid
+	markup, _ := renderPage(db, site, &p)
+	return markup
+}
+
+// Text written in a page can't be taken for a placeholder.
+func TestRenderPlaceholders(t *testing.T) {
+	db := openTestDB(t)
+	site := querySiteBySitename(db, "main")
+	site.Iframehosts = "www.youtube.com"
+
+	markup := renderTestPage(t, db, site, "Text", "Text T2MACRO0T2 \uE000MACRO0\uE001 \uE000MASK0\uE001 {{pages}}\n\n`code`")
+	if !strings.Contains(markup, "Text T2MACRO0T2 MACRO0 MASK0") {
+		t.Errorf("placeholder-like text not kept as written: %q", markup)
+	}
+	if strings.Count(markup, "<ul>") != 1 || !strings.Contains(markup, `<a href="/main/Text" rel="nofollow">Text</a>`) {
+		t.Errorf("{{pages}} not rendered once in place: %q", markup)
+	}
+	if !strings.Contains(markup, "<code>code</code>") {
+		t.Errorf("inline code not rendered: %q", markup)
+	}
+	if strings.ContainsAny(markup, "\uE000\uE001") {
+		t.Errorf("placeholder runes left in html: %q", markup)
+	}
+}
+
+func TestMacros(t *testing.T) {
+	db := openTestDB(t)
+	site := querySiteBySitename(db, "main")
+	_, err := saveFile(db, site, "a.txt", []byte("12345"), "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, title := range []string{"Guide/Install", "Guide/Use", "Other"} {
+		_, err := createPage(db, site, &Page{Title: title, Body: title})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	registerMacro("hello", func(ctx *MacroContext, args string) string {
+		return "<b>hello " + args + "</b>"
+	})
+	defer delete(_macros, "hello")
+
+	tests := []struct {
+		title    string
+		body     string
+		want     []string
+		dontwant []string
+	}{
+		{"Hello", "{{hello: world}} {{ hello  there }}", []string{"<b>hello world</b>", "<b>hello there</b>"}, nil},
+		{"Unknown", "{{nosuch}}", []string{"{{nosuch}}"}, nil},
+		{"Code", "`{{hello}}`\n\n```\n{{hello}}\n```", []string{"<code>{{hello}}</code>", "{{hello}}\n</code>"}, []string{"<b>"}},
+		{"Recent", "{{recent}}", []string{"Recent</a> <em>", "Other</a> <em>"}, nil},
+		{"Recent Bad", "{{recent x}}", []string{"recent needs a number of pages: x"}, []string{"<ul>"}},
+		{"Guide", "{{children}}", []string{"Guide/Install</a>", "Guide/Use</a>"}, []string{"Other</a>"}},
+		{"Files", "{{files}}", []string{`<a href="/main/~file/a.txt" rel="nofollow">a.txt</a> <em>5 bytes</em>`}, nil},
+		{"Date", "{{date 2006}}", []string{time.Now().Format("2006")}, []string{"{{date"}},
+	}
+	for _, test := range tests {
+		markup := renderTestPage(t, db, site, test.title, test.body)
+		for _, want := range test.want {
+			if !strings.Contains(markup, want) {
+				t.Errorf("render %q = %q, want it to contain %q", test.body, markup, want)
+			}
+		}
+		for _, dontwant := range test.dontwant {
+			if strings.Contains(markup, dontwant) {
+				t.Errorf("render %q = %q, want it not to contain %q", test.body, markup, dontwant)
+			}
+		}
+	}
+
+	markup := renderTestPage(t, db, site, "Recent One", "{{recent 1}}")
+	if n := strings.Count(markup, "<li>"); n != 1 {
+		t.Errorf("{{recent 1}} listed %d pages, want 1: %q", n, markup)
+	}
+}
+
+func TestParseLinksSkipsCode(t *testing.T) {
+	db := openTestDB(t)
+	site := querySiteBySitename(db, "main")
+	markup := renderTestPage(t, db, site, "Code", "[[Snip]]\n\n```\n[[Snip]] ![[a.png]]\n```\n\n`[[Snip]]`\n\n```go\nvar s = \"[[Snip]]\"\n```")
+	if n := strings.Count(markup, "<a "); n != 1 {
+		t.Errorf("render has %d links, want only the one outside code: %q", n, markup)
+	}
+	if strings.Contains(markup, "<img") {
+		t.Errorf("file embed in code rendered as an image: %q", markup)
+	}
+	if n := strings.Count(markup, "[[Snip]]"); n != 3 {
+		t.Errorf("render has %d [[Snip]] left as text, want 3: %q", n, markup)
+	}
+}
+
+// POST a form to a handler as the admin user.
+func postForm(t *testing.T, h http.HandlerFunc, target string, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest("POST", target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: "userid", Value: "1"})
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+// POST files to /uploadfile as the admin user and return the response body.
+func postUpload(t *testing.T, db *sql.DB, siteid int64, files [][2]string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, f := range files {
+		fw, err := mw.CreateFormFile("file", f[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(f[1]))
+	}
+	mw.Close()
+
+	r := httptest.NewRequest("POST", fmt.Sprintf("/uploadfile/?siteid=%d", siteid), &buf)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.AddCookie(&http.Cookie{Name: "userid", Value: "1"})
+	w := httptest.NewRecorder()
+	uploadfileHandler(db)(w, r)
+	if w.Code != 200 {
+		t.Fatalf("upload status %d: %s", w.Code, w.Body.String())
+	}
+	return w.Body.String()
+}
+
+func TestUploadLimits(t *testing.T) {
+	db := openTestDB(t)
+	site := querySiteById(db, 1)
+
+	defer func(size, req int64) { _maxUploadSize, _maxUploadRequest = size, req }(_maxUploadSize, _maxUploadRequest)
+	_maxUploadSize = 10
+	_maxUploadRequest = 0
+
+	body := postUpload(t, db, site.Siteid, [][2]string{{"small.txt", "small"}, {"big.txt", "more than ten bytes"}})
+	if !strings.Contains(body, "file too large") {
+		t.Errorf("upload over max size: no file too large result in %q", body)
+	}
+	if queryFileInfoByFilename(db, site.Siteid, "small.txt") == nil {
+		t.Errorf("small.txt not saved")
+	}
+	if queryFileInfoByFilename(db, site.Siteid, "big.txt") != nil {
+		t.Errorf("big.txt saved over max upload size")
+	}
+
+	// The request limit allows 1MB over _maxUploadRequest for form fields.
+	body = postUpload(t, db, site.Siteid, [][2]string{{"huge.txt", strings.Repeat("x", 2*1024*1024)}})
+	if !strings.Contains(body, "Upload too large") {
+		t.Errorf("upload over max request: no form error in %q", body)
+	}
+	if queryFileInfoByFilename(db, site.Siteid, "huge.txt") != nil {
+		t.Errorf("huge.txt saved over max request size")
+	}
+}
+
+func TestUploadQuota(t *testing.T) {
+	db := openTestDB(t)
+	site := querySiteById(db, 1)
+	site.Quota = 20
+	err := updateSite(db, site, site.Sitename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := postUpload(t, db, site.Siteid, [][2]string{{"a.txt", "0123456789"}, {"b.txt", "0123456789x"}})
+	if !strings.Contains(body, "Not enough storage space") {
+		t.Errorf("upload over quota: no form error in %q", body)
+	}
+	if queryFileInfoByFilename(db, site.Siteid, "a.txt") == nil {
+		t.Errorf("a.txt not saved")
+	}
+	if queryFileInfoByFilename(db, site.Siteid, "b.txt") != nil {
+		t.Errorf("b.txt saved over quota")
+	}
+	if usage := querySiteUsage(db, site.Siteid); usage != 10 {
+		t.Errorf("usage %d, want 10", usage)
+	}
+
+	// Replacing a file keeps its previous contents, which count towards
+	// the quota too.
+	_, err = saveFile(db, site, "a.txt", []byte("abcdefghijk"), "replace", 1)
+	if err != errQuotaExceeded {
+		t.Errorf("replace over quota: err %v, want errQuotaExceeded", err)
+	}
+	if f := queryFileByFilename(db, site.Siteid, "a.txt"); string(f.Bytes) != "0123456789" {
+		t.Errorf("a.txt contents %q after replace over quota", f.Bytes)
+	}
+	_, err = saveFile(db, site, "a.txt", []byte("abcdefghij"), "replace", 1)
+	if err != nil {
+		t.Errorf("replace within quota: %v", err)
+	}
+}
+
+// Renamed sites keep redirecting from all their previous names, until
+// another site takes a name over.
+func TestSiteAliases(t *testing.T) {
+	db := openTestDB(t)
+	site := &Site{Sitename: "a"}
+	_, err := createSite(db, site)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sitename := range []string{"b", "c"} {
+		oldsitename := site.Sitename
+		site.Sitename = sitename
+		err = updateSite(db, site, oldsitename)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, alias := range []string{"a", "b"} {
+		if s := querySiteByAlias(db, alias); s == nil || s.Siteid != site.Siteid {
+			t.Errorf("querySiteByAlias(%s) = %+v, want site c", alias, s)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/a/Some%20Page?x=1", nil)
+	w := httptest.NewRecorder()
+	if !redirectSiteAlias(db, w, r, "a") {
+		t.Fatal("redirectSiteAlias(a) = false")
+	}
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/c/Some%20Page?x=1" {
+		t.Errorf("redirectSiteAlias(a) = %d %s, want 301 /c/Some%%20Page?x=1", w.Code, w.Header().Get("Location"))
+	}
+	if redirectSiteAlias(db, httptest.NewRecorder(), r, "nosite") {
+		t.Errorf("redirectSiteAlias(nosite) = true")
+	}
+
+	// Renaming back to an old name drops that alias.
+	site.Sitename = "a"
+	err = updateSite(db, site, "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := querySiteByAlias(db, "a"); s != nil {
+		t.Errorf("alias a of current sitename kept")
+	}
+	if s := querySiteByAlias(db, "c"); s == nil || s.Siteid != site.Siteid {
+		t.Errorf("querySiteByAlias(c) = %+v, want site a", s)
+	}
+
+	// A new site can reuse an old name.
+	other := &Site{Sitename: "b"}
+	_, err = createSite(db, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := querySiteByAlias(db, "b"); s != nil {
+		t.Errorf("alias b kept after new site b was created")
+	}
+
+	// Renaming to a name in use by another site is a form error.
+	tests := []struct {
+		sitename string
+		err      string
+	}{
+		{"a", "A site named &#39;a&#39; already exists."},
+		{"c", "Site name &#39;c&#39; is a previous name of site &#39;a&#39;."},
+	}
+	for _, test := range tests {
+		w := postForm(t, editsiteHandler(db), fmt.Sprintf("/editsite/?siteid=%d", other.Siteid), url.Values{"sitename": {test.sitename}})
+		if w.Code != 200 || !strings.Contains(w.Body.String(), test.err) {
+			t.Errorf("rename b to %s: %d, want form error %q", test.sitename, w.Code, test.err)
+		}
+	}
+	if s := querySiteById(db, other.Siteid); s.Sitename != "b" {
+		t.Errorf("site b renamed to %s", s.Sitename)
+	}
+	w = postForm(t, editsiteHandler(db), fmt.Sprintf("/editsite/?siteid=%d", site.Siteid), url.Values{"sitename": {"c"}})
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("rename a back to its previous name c: %d, want 303", w.Code)
+	}
+}
+
+// Sites mapped to a domain are served at the root of it, and path-based urls
+// for them redirect there.
+func TestSiteDomains(t *testing.T) {
+	db := openTestDB(t)
+	site := querySiteById(db, 1)
+	_, err := createPage(db, site, &Page{Title: "Other", Body: "Other page body"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(mainHost string) { _mainHost = mainHost }(_mainHost)
+	_mainHost = "example.com"
+	err = setSiteDomain(db, site.Siteid, "docs.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_siteDomains.Lock()
+		_siteDomains.bySitename = map[string]string{}
+		_siteDomains.byDomain = map[string]string{}
+		_siteDomains.Unlock()
+	})
+
+	hosts := []struct {
+		host     string
+		sitename string
+	}{
+		{"docs.example.com", "main"},
+		{"DOCS.example.com:8000", "main"},
+		{"other.example.com", ""},
+		{"example.com", ""},
+	}
+	for _, test := range hosts {
+		r := httptest.NewRequest("GET", "http://"+test.host+"/", nil)
+		if sitename := hostSitename(r); sitename != test.sitename {
+			t.Errorf("hostSitename(%s) = %q, want %q", test.host, sitename, test.sitename)
+		}
+	}
+
+	tests := []struct {
+		url      string
+		code     int
+		location string
+	}{
+		{"http://docs.example.com/Other", 200, ""},
+		{"http://example.com/main/Other?x=1", 301, "//docs.example.com/Other?x=1"},
+		{"http://example.com/main", 301, "//docs.example.com/"},
+		{"http://other.example.com/main/Other", 301, "//docs.example.com/Other"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.url, nil)
+		w := httptest.NewRecorder()
+		indexHandler(db)(w, r)
+		if w.Code != test.code || w.Header().Get("Location") != test.location {
+			t.Errorf("GET %s = %d %q, want %d %q", test.url, w.Code, w.Header().Get("Location"), test.code, test.location)
+		}
+		if test.code == 200 && !strings.Contains(w.Body.String(), "Other page body") {
+			t.Errorf("GET %s: page not shown", test.url)
+		}
+	}
+
+	site2 := &Site{Sitename: "nodomain"}
+	_, err = createSite(db, site2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "http://example.com/nodomain", nil)
+	if redirectSiteDomain(httptest.NewRecorder(), r, site2) {
+		t.Errorf("redirectSiteDomain(nodomain) = true, site has no domain")
+	}
+}
+
+// Titles in the page list of a tag or search page.
+func listedTitles(body string) []string {
+	i := strings.Index(body, `<ul class="list-none mb-4">`)
+	if i == -1 {
+		return nil
+	}
+	body = body[i:]
+	body = body[:strings.Index(body, "</ul>")]
+	var titles []string
+	for _, m := range regexp.MustCompile(`">([^<]+)</a>`).FindAllStringSubmatch(body, -1) {
+		titles = append(titles, m[1])
+	}
+	return titles
+}
+
+func TestTagsAndSearch(t *testing.T) {
+	db := openTestDB(t)
+	site := querySiteById(db, 1)
+	other := &Site{Sitename: "other"}
+	_, err := createSite(db, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages := []struct {
+		site  *Site
+		title string
+		body  string
+	}{
+		{site, "Apple", "---\ntags: Fruit, red\n---\nA red fruit."},
+		{site, "Banana", "---\ntags: fruit\n---\nYellow, 100% fruit."},
+		{site, "Carrot", "---\ntags: vegetable\n---\nAn orange root."},
+		{other, "Cherry", "---\ntags: fruit\n---\nAnother red fruit."},
+	}
+	for _, p := range pages {
+		_, err := createPage(db, p.site, &Page{Title: p.title, Body: p.body})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tags, err := querySiteTags(db, site.Siteid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TagCount{{"fruit", 2}, {"red", 1}, {"vegetable", 1}}
+	if !reflect.DeepEqual(tags, want) {
+		t.Errorf("querySiteTags = %v, want %v", tags, want)
+	}
+	_allTags.Lock()
+	_allTags.tags = nil
+	_allTags.Unlock()
+	tags, err = queryAllTags(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []TagCount{{"fruit", 3}, {"red", 1}, {"vegetable", 1}}
+	if !reflect.DeepEqual(tags, want) {
+		t.Errorf("queryAllTags = %v, want %v", tags, want)
+	}
+
+	searches := []struct {
+		q, tag string
+		titles []string
+	}{
+		{"", "fruit", []string{"Apple", "Banana"}},
+		{"red", "", []string{"Apple"}},
+		{"fruit", "red", []string{"Apple"}},
+		{"100%", "", []string{"Banana"}},
+		{"0_", "", nil},
+		{"", "nosuchtag", nil},
+	}
+	for _, test := range searches {
+		pp, err := searchPages(db, site.Siteid, test.q, test.tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var titles []string
+		for _, p := range pp {
+			titles = append(titles, p.Title)
+		}
+		if !reflect.DeepEqual(titles, test.titles) {
+			t.Errorf("searchPages(%q, %q) = %v, want %v", test.q, test.tag, titles, test.titles)
+		}
+	}
+
+	urls := []struct {
+		url    string
+		titles []string
+	}{
+		{"/main/~tag/Fruit", []string{"Apple", "Banana"}},
+		{"/~tag/fruit", []string{"Apple", "Banana", "Cherry"}},
+		{"/main/~search?q=yellow", []string{"Banana"}},
+		{"/~search?q=red&tag=fruit", []string{"Apple", "Cherry"}},
+	}
+	for _, test := range urls {
+		r := httptest.NewRequest("GET", test.url, nil)
+		w := httptest.NewRecorder()
+		indexHandler(db)(w, r)
+		if titles := listedTitles(w.Body.String()); w.Code != 200 || !reflect.DeepEqual(titles, test.titles) {
+			t.Errorf("GET %s = %d %v, want %v", test.url, w.Code, titles, test.titles)
+		}
+	}
+}
+
+func TestSetHeadingIds(t *testing.T) {
+	markup := "<h2>A</h2><h2>A</h2><h2>A-1</h2><h3><code>A</code> &amp; B</h3><h2> </h2>"
+	markup, headings := setHeadingIds(markup)
+	want := []Heading{{2, "a", "A"}, {2, "a-1", "A"}, {2, "a-1-1", "A-1"}, {3, "a-b", "A & B"}, {2, "section", ""}}
+	if !reflect.DeepEqual(headings, want) {
+		t.Errorf("setHeadingIds headings = %v, want %v", headings, want)
+	}
+	for _, h := range want {
+		if !strings.Contains(markup, fmt.Sprintf(`id="%s"><a class="anchor" href="#%s"`, h.Id, h.Id)) {
+			t.Errorf("heading id %s not set in %q", h.Id, markup)
+		}
+	}
+}
+
+func TestToc(t *testing.T) {
+	tests := []struct {
+		headings []Heading
+		toc      string
+	}{
+		{nil, ""},
+		{
+			[]Heading{{2, "one", "One"}, {3, "two", "Two"}, {2, "three", "Three"}},
+			"<ul>\n<li><a href=\"#one\">One</a><ul>\n<li><a href=\"#two\">Two</a></li>\n</ul>\n</li>\n<li><a href=\"#three\">Three</a></li>\n</ul>\n",
+		},
+		// Skipped levels are nested in empty items, and the first heading
+		// doesn't have to be the top level.
+		{
+			[]Heading{{3, "one", "One"}, {1, "two", "Two"}, {3, "three", "Three"}},
+			"<ul>\n<li><ul>\n<li><ul>\n<li><a href=\"#one\">One</a></li>\n</ul>\n</li>\n</ul>\n</li>\n<li><a href=\"#two\">Two</a><ul>\n<li><ul>\n<li><a href=\"#three\">Three</a></li>\n</ul>\n</li>\n</ul>\n</li>\n</ul>\n",
+		},
+	}
+	for _, test := range tests {
+		toc := tocHtml(test.headings)
+		if test.toc != "" {
+			test.toc = "<div class=\"toc\">\n" + test.toc + "</div>\n"
+		}
+		if toc != test.toc {
+			t.Errorf("tocHtml(%v) = %q, want %q", test.headings, toc, test.toc)
+		}
+	}
+
+	db := openTestDB(t)
+	site := querySiteById(db, 1)
+	markup := renderTestPage(t, db, site, "Toc", "{{toc}}\n\n## One\n\n### Two\n\n## Three\n\n`{{toc}}`")
+	if !strings.Contains(markup, tocHtml([]Heading{{2, "one", "One"}, {3, "two", "Two"}, {2, "three", "Three"}})) {
+		t.Errorf("{{toc}} not replaced with the headings: %q", markup)
+	}
+	if !strings.Contains(markup, "<code>{{toc}}</code>") {
+		t.Errorf("{{toc}} in code replaced: %q", markup)
+	}
+}
+
+func TestParseLineRanges(t *testing.T) {
+	tests := []struct {
+		s      string
+		ranges [][2]int
+	}{
+		{"2,5-7", [][2]int{{2, 2}, {5, 7}}},
+		{"3-3", [][2]int{{3, 3}}},
+		{"7-5,0,-2,4-,x,1-x", nil},
+		{"", nil},
+	}
+	for _, test := range tests {
+		if ranges := parseLineRanges(test.s); !reflect.DeepEqual(ranges, test.ranges) {
+			t.Errorf("parseLineRanges(%q) = %v, want %v", test.s, ranges, test.ranges)
+		}
+	}
+}
+
+func TestHighlightCode(t *testing.T) {
+	code := "a := 1\nb := 2\nc := 3"
+	if _, ok := highlightCode(code, "nosuchlang", ""); ok {
+		t.Errorf("highlightCode with unknown language = true")
+	}
+
+	tests := []struct {
+		opts    string
+		linenos bool
+		hl      int
+	}{
+		{"", false, 0},
+		{"linenos", true, 0},
+		{"hl=2", false, 1},
+		{"linenos hl=1-2,3", true, 3},
+		{"hl=3-1,x", false, 0},
+	}
+	for _, test := range tests {
+		markup, ok := highlightCode(code, "go", test.opts)
+		if !ok || !strings.HasPrefix(markup, `<div class="chroma"><pre>`) {
+			t.Fatalf("highlightCode(go, %q) = %q, %v", test.opts, markup, ok)
+		}
+		if linenos := strings.Contains(markup, `<span class="ln">`); linenos != test.linenos {
+			t.Errorf("highlightCode(go, %q) line numbers = %v, want %v", test.opts, linenos, test.linenos)
+		}
+		if hl := strings.Count(markup, `<span class="line hl">`); hl != test.hl {
+			t.Errorf("highlightCode(go, %q) highlighted %d lines, want %d", test.opts, hl, test.hl)
+		}
+	}
+
+	// Unknown languages are left to markdown as a plain code block.
+	db := openTestDB(t)
+	site := querySiteById(db, 1)
+	markup := renderTestPage(t, db, site, "Plain", "```nosuchlang linenos\nx < y\n```\n")
+	if strings.Contains(markup, "chroma") || !strings.Contains(markup, "<pre>x &lt; y\n</pre>") {
+		t.Errorf("unknown language not shown as plain code: %q", markup)
+	}
+	markup = renderTestPage(t, db, site, "Go", "```go linenos hl=2\n"+code+"\n```\n")
+	if !strings.Contains(markup, `<span class="line hl"><span class="ln">2</span>`) {
+		t.Errorf("highlighted code classes not kept after sanitizing: %q", markup)
+	}
+}
+
+func TestSanitizeHtml(t *testing.T) {
+	db := openTestDB(t)
+	site := querySiteById(db, 1)
+	site.Iframehosts = "www.youtube.com"
+	youtube := `<iframe src="https://www.youtube.com/embed/x" width="560" height="315" allowfullscreen></iframe>`
+
+	tests := []struct {
+		body    string
+		kept    string
+		dropped []string
+	}{
+		{"Text <script>alert(1)</script>", "Text", []string{"<script", "alert"}},
+		{`<img src="x.png" onerror="alert(2)">`, `<img src="x.png"`, []string{"onerror", "alert"}},
+		{`<a href="javascript:alert(3)">link</a>`, "link", []string{"javascript", "alert"}},
+		{`<p style="background: url(javascript:alert(4))">styled</p>`, "styled", []string{"style=", "javascript", "alert"}},
+		{"Video:\n\n" + youtube, `<iframe src="https://www.youtube.com/embed/x" width="560" height="315" allowfullscreen=""></iframe>`, nil},
+		{`<iframe src="https://evil.com/x"></iframe>`, "", []string{"<iframe", "evil.com"}},
+		{`<iframe src="https://www.youtube.com.evil.com/x"></iframe>`, "", []string{"<iframe", "evil.com"}},
+		{"`" + youtube + "`", "<code>&lt;iframe src=&#34;https://www.youtube.com/embed/x&#34;", []string{"<iframe"}},
+	}
+	for i, test := range tests {
+		markup := renderTestPage(t, db, site, fmt.Sprintf("Sanitize %d", i), test.body)
+		if !strings.Contains(markup, test.kept) {
+			t.Errorf("%q: %q not kept in %q", test.body, test.kept, markup)
+		}
+		for _, s := range test.dropped {
+			if strings.Contains(markup, s) {
+				t.Errorf("%q: %q not dropped from %q", test.body, s, markup)
+			}
+		}
+	}
+
+	// Iframes are only allowed from the site's listed hosts.
+	site.Iframehosts = ""
+	markup := renderTestPage(t, db, site, "No iframes", youtube)
+	if strings.Contains(markup, "<iframe") {
+		t.Errorf("iframe kept on site without iframe hosts: %q", markup)
+	}
+}
+
+func TestDetectContentType(t *testing.T) {
+	html := "<html><body><script>alert(1)</script></body></html>"
+	tests := []struct {
+		filename string
+		content  string
+		ctype    string
+	}{
+		{"x.png", html, "text/html; charset=utf-8"},
+		{"x.txt", html, "text/html; charset=utf-8"},
+		{"x.txt", "plain text", "text/plain; charset=utf-8"},
+		{"x.svg", `<svg xmlns="http://www.w3.org/2000/svg"></svg>`, "image/svg+xml"},
+		{"x", "plain text", "text/plain; charset=utf-8"},
+		{"x", "\x00\x01\x02", "application/octet-stream"},
+	}
+	for _, test := range tests {
+		if ctype := detectContentType(test.filename, []byte(test.content)); ctype != test.ctype {
+			t.Errorf("detectContentType(%s, %q) = %q, want %q", test.filename, test.content, ctype, test.ctype)
+		}
+	}
+}
+
+// Files that browsers could run script from are sandboxed, and downloaded
+// instead of shown unless they're images.
+func TestPrintFileHeaders(t *testing.T) {
+	db := openTestDB(t)
+	site := querySiteById(db, 1)
+	files := [][2]string{
+		{"x.png", "<html><body><script>alert(1)</script></body></html>"},
+		{"pic.svg", `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`},
+		{"notes.txt", "plain text"},
+		{"noext", "plain text"},
+	}
+	for _, f := range files {
+		_, err := saveFile(db, site, f[0], []byte(f[1]), "", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Files from before content types were stored have none.
+	_, err := db.Exec(fmt.Sprintf("UPDATE %s SET content_type = '' WHERE filename = 'noext'", filetblName(site.Siteid)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		filename    string
+		ctype       string
+		sandbox     bool
+		disposition string
+	}{
+		{"x.png", "text/html; charset=utf-8", true, "attachment; filename=x.png"},
+		{"pic.svg", "image/svg+xml", true, ""},
+		{"notes.txt", "text/plain; charset=utf-8", false, ""},
+		{"noext", "application/octet-stream", false, ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", fileUrl(site.Sitename, test.filename), nil)
+		w := httptest.NewRecorder()
+		printFile(db, w, r)
+		h := w.Header()
+		if w.Code != 200 {
+			t.Errorf("GET %s = %d", test.filename, w.Code)
+		}
+		if h.Get("Content-Type") != test.ctype {
+			t.Errorf("%s Content-Type = %q, want %q", test.filename, h.Get("Content-Type"), test.ctype)
+		}
+		if h.Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("%s X-Content-Type-Options = %q, want nosniff", test.filename, h.Get("X-Content-Type-Options"))
+		}
+		if sandbox := strings.HasPrefix(h.Get("Content-Security-Policy"), "sandbox;"); sandbox != test.sandbox {
+			t.Errorf("%s Content-Security-Policy = %q, want sandbox %v", test.filename, h.Get("Content-Security-Policy"), test.sandbox)
+		}
+		if h.Get("Content-Disposition") != test.disposition {
+			t.Errorf("%s Content-Disposition = %q, want %q", test.filename, h.Get("Content-Disposition"), test.disposition)
+		}
+	}
+}
+
+func TestMacroInclude(t *testing.T) {
+	db := openTestDB(t)
+	site := querySiteById(db, 1)
+
+	// A -> B -> A
+	_, err := createPage(db, site, &Page{Title: "B", Body: "Page B {{include: A}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	markup := renderTestPage(t, db, site, "A", "Page A {{include: B}}")
+	if !strings.Contains(markup, "Page B") || !strings.Contains(markup, "(include cycle: A)") {
+		t.Errorf("include cycle: %q", markup)
+	}
+	if strings.Count(markup, "Page A") != 1 {
+		t.Errorf("page A included in itself: %q", markup)
+	}
+
+	// The rendered page is the first level of nesting.
+	for i := 1; i <= _maxIncludeDepth+2; i++ {
+		_, err := createPage(db, site, &Page{Title: fmt.Sprintf("D%d", i), Body: fmt.Sprintf("Level %d {{include: D%d}}", i, i+1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	markup = renderTestPage(t, db, site, "D0", "Level 0 {{include: D1}}")
+	if n := strings.Count(markup, `<div class="include">`); n != _maxIncludeDepth-1 {
+		t.Errorf("nested includes = %d, want %d", n, _maxIncludeDepth-1)
+	}
+	if !strings.Contains(markup, fmt.Sprintf("(too many nested includes: D%d)", _maxIncludeDepth)) {
+		t.Errorf("no nested includes error: %q", markup)
+	}
+
+	_, err = createPage(db, site, &Page{Title: "Leaf", Body: "Leaf"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	markup = renderTestPage(t, db, site, "Many", strings.Repeat("{{include: Leaf}}\n\n", _maxIncludes+1))
+	if n := strings.Count(markup, `<div class="include">`); n != _maxIncludes {
+		t.Errorf("includes = %d, want %d", n, _maxIncludes)
+	}
+	if strings.Count(markup, "(too many includes: Leaf)") != 1 {
+		t.Errorf("no too many includes error: %q", markup)
+	}
+
+	// An included page lists the pages including it in its backlinks.
+	pp, err := queryLinkingPages(db, site.Siteid, "include", "B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pp) != 1 || pp[0].Title != "A" {
+		t.Errorf("pages including B = %v, want A", pp)
+	}
+	r := httptest.NewRequest("GET", pageUrl(site.Sitename, "B"), nil)
+	w := httptest.NewRecorder()
+	indexHandler(db)(w, r)
+	if !strings.Contains(w.Body.String(), "A (includes)") {
+		t.Errorf("page B backlinks don't show A including it")
+	}
+}
+
+func TestSaveFileConflicts(t *testing.T) {
+	db := openTestDB(t)
+	site := querySiteById(db, 1)
+	for _, filename := range []string{"a.png", "notes"} {
+		_, err := saveFile(db, site, filename, []byte("first"), "", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		filename   string
+		onconflict string
+		savedname  string
+		err        error
+		contents   string
+	}{
+		{"a.png", "skip", "a.png", errSkipped, "first"},
+		{"a.png", "", "a.png", errSkipped, "first"},
+		{"a.png", "replace", "a.png", nil, "replaced"},
+		{"a.png", "keepboth", "a-1.png", nil, "keepboth"},
+		{"a.png", "keepboth", "a-2.png", nil, "keepboth"},
+		{"notes", "keepboth", "notes-1", nil, "keepboth"},
+		{"new.png", "skip", "new.png", nil, "skip"},
+	}
+	for _, test := range tests {
+		bs := []byte(test.onconflict)
+		if test.onconflict == "replace" {
+			bs = []byte("replaced")
+		}
+		savedname, err := saveFile(db, site, test.filename, bs, test.onconflict, 1)
+		if savedname != test.savedname || err != test.err {
+			t.Errorf("saveFile(%s, %q) = %s, %v, want %s, %v", test.filename, test.onconflict, savedname, err, test.savedname, test.err)
+		}
+		if f := queryFileByFilename(db, site.Siteid, savedname); f == nil || string(f.Bytes) != test.contents {
+			t.Errorf("saveFile(%s, %q): %s = %+v, want contents %q", test.filename, test.onconflict, savedname, f, test.contents)
+		}
+	}
+}
+
+func TestFileVersions(t *testing.T) {
+	db := openTestDB(t)
+	site := querySiteById(db, 1)
+	for _, contents := range []string{"v1", "v2", "v3"} {
+		_, err := saveFile(db, site, "doc.txt", []byte(contents), "replace", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := saveFile(db, site, "other.txt", []byte("other"), "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := queryFileInfoByFilename(db, site.Siteid, "doc.txt")
+	other := queryFileInfoByFilename(db, site.Siteid, "other.txt")
+
+	// Replaced contents are kept as previous versions, newest first.
+	fvs, err := queryFileVersions(db, site.Siteid, file.Fileid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fvs) != 2 || fvs[0].Hash != hashBytes([]byte("v2")) || fvs[1].Hash != hashBytes([]byte("v1")) {
+		t.Fatalf("versions after replacing = %+v, want v2, v1", fvs)
+	}
+	v1 := fvs[1]
+
+	tests := []struct {
+		fileid    int64
+		filename  string
+		versionid int64
+		code      int
+		body      string
+	}{
+		{file.Fileid, "doc.txt", v1.Versionid, 200, "v1"},
+		{other.Fileid, "other.txt", v1.Versionid, 404, ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", fmt.Sprintf("%s?v=%d", fileUrl(site.Sitename, test.filename), test.versionid), nil)
+		w := httptest.NewRecorder()
+		printFile(db, w, r)
+		if w.Code != test.code || test.code == 200 && w.Body.String() != test.body {
+			t.Errorf("GET %s?v=%d = %d %q, want %d %q", test.filename, test.versionid, w.Code, w.Body.String(), test.code, test.body)
+		}
+	}
+
+	// Restoring a version keeps the current contents as another version.
+	err = restoreFileVersion(db, site.Siteid, file.Fileid, v1.Versionid, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := queryFileByFilename(db, site.Siteid, "doc.txt"); string(f.Bytes) != "v1" {
+		t.Errorf("contents after restoring v1 = %q", f.Bytes)
+	}
+	fvs, err = queryFileVersions(db, site.Siteid, file.Fileid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fvs) != 3 || fvs[0].Hash != hashBytes([]byte("v3")) {
+		t.Errorf("versions after restoring = %+v, want v3, v2, v1", fvs)
+	}
+}
+
+func TestThumbs(t *testing.T) {
+	widths := [][2]int{{1, 16}, {16, 16}, {17, 32}, {300, 400}, {1600, 1600}, {5000, 1600}}
+	for _, w := range widths {
+		if tw := thumbWidth(w[0]); tw != w[1] {
+			t.Errorf("thumbWidth(%d) = %d, want %d", w[0], tw, w[1])
+		}
+	}
+
+	db := openTestDB(t)
+	site := querySiteById(db, 1)
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1000, 10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = saveFile(db, site, "wide.png", buf.Bytes(), "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := queryFileInfoByFilename(db, site.Siteid, "wide.png")
+	numThumbs := func() int {
+		var n int
+		err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", thumbtblName(site.Siteid))).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	// Requested widths are snapped to a thumb width, and cached.
+	for _, qwidth := range []int{300, 400, 300} {
+		r := httptest.NewRequest("GET", fmt.Sprintf("%s?w=%d", fileUrl(site.Sitename, "wide.png"), qwidth), nil)
+		w := httptest.NewRecorder()
+		printFile(db, w, r)
+		if w.Code != 200 {
+			t.Fatalf("GET wide.png?w=%d = %d", qwidth, w.Code)
+		}
+		cfg, err := png.DecodeConfig(w.Body)
+		if err != nil || cfg.Width != 400 {
+			t.Errorf("GET wide.png?w=%d: width %d (%v), want 400", qwidth, cfg.Width, err)
+		}
+	}
+	if n := numThumbs(); n != 1 {
+		t.Errorf("cached thumbs = %d, want 1", n)
+	}
+
+	// Thumbs of files still in the trash are kept, purging the file
+	// deletes them.
+	err = trashFiles(db, site.Siteid, []int64{file.Fileid}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := numThumbs(); n != 1 {
+		t.Errorf("cached thumbs after trashing file = %d, want 1", n)
+	}
+	err = purgeFile(db, site.Siteid, file.Fileid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := numThumbs(); n != 0 {
+		t.Errorf("cached thumbs after purging file = %d, want 0", n)
+	}
+}
+
+func TestPrintFileInfo(t *testing.T) {
+	db := openTestDB(t)
+	site := querySiteById(db, 1)
+	_, err := saveFile(db, site, "notes.txt", []byte("notes"), "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = createPage(db, site, &Page{Title: "Uses Notes", Body: "See ![[notes.txt]]."})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actions := []string{"Edit Details", "Rename File", "File History"}
+	for _, loggedin := range []bool{false, true} {
+		r := httptest.NewRequest("GET", fileUrl(site.Sitename, "notes.txt")+"?info", nil)
+		if loggedin {
+			r.AddCookie(&http.Cookie{Name: "userid", Value: "1"})
+		}
+		w := httptest.NewRecorder()
+		printFile(db, w, r)
+		body := w.Body.String()
+		if w.Code != 200 || !strings.Contains(body, "Uses Notes") {
+			t.Errorf("GET notes.txt?info (logged in %v) = %d, page using it not shown", loggedin, w.Code)
+		}
+		for _, action := range actions {
+			if strings.Contains(body, action) != loggedin {
+				t.Errorf("GET notes.txt?info (logged in %v): action %q shown %v", loggedin, action, !loggedin)
+			}
+		}
+	}
+}
+
+func TestCloneSite(t *testing.T) {
+	db := openTestDB(t)
+	src := &Site{Sitename: "src", Theme: "dark", Nav: "Guide"}
+	_, err := createSite(db, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = createPage(db, src, &Page{Title: "Guide", Body: "---\ntags: howto\n---\nSee ![[pic.png]]."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, contents := range []string{"old pic", "pic"} {
+		_, err = saveFile(db, src, "pic.png", []byte(contents), "replace", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	site := &Site{Sitename: "copy"}
+	_, err = cloneSite(db, src, site)
+	if err != nil {
+		t.Fatal(err)
+	}
+	site = querySiteBySitename(db, "copy")
+	if site.Theme != "dark" || site.Nav != "Guide" {
+		t.Errorf("cloned site settings = %+v, want theme and nav of src", site)
+	}
+	if p := queryPageByTitle(db, site.Siteid, "Guide"); p == nil || p.Body != "---\ntags: howto\n---\nSee ![[pic.png]]." {
+		t.Errorf("cloned page Guide = %+v", p)
+	}
+	if f := queryFileByFilename(db, site.Siteid, "pic.png"); f == nil || string(f.Bytes) != "pic" {
+		t.Errorf("cloned file pic.png = %+v", f)
+	}
+	file := queryFileInfoByFilename(db, site.Siteid, "pic.png")
+	if fvs, err := queryFileVersions(db, site.Siteid, file.Fileid); err != nil || len(fvs) != 0 {
+		t.Errorf("cloned file versions = %v, %v, want none", fvs, err)
+	}
+	if pp, err := queryLinkingPages(db, site.Siteid, "file", "pic.png"); err != nil || len(pp) != 1 || pp[0].Title != "Guide" {
+		t.Errorf("pages using cloned pic.png = %v, %v, want Guide", pp, err)
+	}
+	if pp, err := searchPages(db, site.Siteid, "", "howto"); err != nil || len(pp) != 1 {
+		t.Errorf("cloned pages tagged howto = %v, %v, want Guide", pp, err)
+	}
+
+	// A clone whose files don't fit in its quota isn't created.
+	defer func(quota int64) { _defaultSiteQuota = quota }(_defaultSiteQuota)
+	_defaultSiteQuota = 2
+	_, err = cloneSite(db, src, &Site{Sitename: "toobig"})
+	if err != errQuotaExceeded {
+		t.Errorf("cloneSite over quota = %v, want errQuotaExceeded", err)
+	}
+	if querySiteBySitename(db, "toobig") != nil {
+		t.Errorf("site created over quota")
+	}
+}
+
+func TestSiteCss(t *testing.T) {
+	db := openTestDB(t)
+	site := querySiteById(db, 1)
+	if cssurls := siteCssUrls(nil); cssurls != nil {
+		t.Errorf("siteCssUrls(nil) = %v", cssurls)
+	}
+	if cssurls := siteCssUrls(site); cssurls != nil {
+		t.Errorf("siteCssUrls of site without theme or css = %v", cssurls)
+	}
+
+	site.Theme = "dark"
+	site.Css = "body { color: red; }"
+	err := updateSite(db, site, site.Sitename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cssurl := fmt.Sprintf("/sitecss/?siteid=%d&v=%s", site.Siteid, hashBytes([]byte(site.Css))[:12])
+	want := []string{"/static/themes/dark.css", cssurl}
+	if cssurls := siteCssUrls(site); !reflect.DeepEqual(cssurls, want) {
+		t.Errorf("siteCssUrls = %v, want %v", cssurls, want)
+	}
+
+	r := httptest.NewRequest("GET", pageUrl(site.Sitename, ""), nil)
+	w := httptest.NewRecorder()
+	indexHandler(db)(w, r)
+	for _, u := range want {
+		if !strings.Contains(w.Body.String(), html.EscapeString(u)) {
+			t.Errorf("site page doesn't link stylesheet %s", u)
+		}
+	}
+
+	r = httptest.NewRequest("GET", cssurl, nil)
+	w = httptest.NewRecorder()
+	sitecssHandler(db)(w, r)
+	if w.Body.String() != site.Css || w.Header().Get("Content-Type") != "text/css; charset=utf-8" || w.Header().Get("Cache-Control") != "max-age=31536000, immutable" {
+		t.Errorf("GET %s = %q %v", cssurl, w.Body.String(), w.Header())
+	}
+
+	// Preview shows the theme and css inline without saving them.
+	target := fmt.Sprintf("/editsite/?siteid=%d", site.Siteid)
+	w = postForm(t, editsiteHandler(db), target, url.Values{"sitename": {"main"}, "theme": {"sepia"}, "css": {"p { margin: 0; }"}, "preview": {"1"}})
+	datacss := "data:text/css;base64," + base64.StdEncoding.EncodeToString([]byte("p { margin: 0; }"))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "/static/themes/sepia.css") || !strings.Contains(w.Body.String(), datacss) {
+		t.Errorf("preview = %d, theme or css not shown inline", w.Code)
+	}
+	if s := querySiteById(db, site.Siteid); s.Theme != "dark" || s.Css != site.Css {
+		t.Errorf("preview saved theme %q css %q", s.Theme, s.Css)
+	}
+
+	w = postForm(t, editsiteHandler(db), target, url.Values{"sitename": {"main"}, "theme": {"nosuchtheme"}})
+	if !strings.Contains(w.Body.String(), "Please select a theme.") {
+		t.Errorf("unknown theme: %d, no form error", w.Code)
+	}
+}
+
+func TestParseSiteNav(t *testing.T) {
+	site := &Site{Sitename: "main", Nav: "Guide\n\n  Start Here | Getting Started \nSource | https://example.com/src\nMail|mailto:me@example.com\n| Untitled\nNo target |\n"}
+	want := []NavLink{
+		{"Guide", "/main/Guide"},
+		{"Start Here", "/main/Getting+Started"},
+		{"Source", "https://example.com/src"},
+		{"Mail", "mailto:me@example.com"},
+		{"Untitled", "/main/Untitled"},
+	}
+	if links := parseSiteNav(site); !reflect.DeepEqual(links, want) {
+		t.Errorf("parseSiteNav = %v, want %v", links, want)
+	}
+}
+
+func TestSiteHeaderFooterNav(t *testing.T) {
+	db := openTestDB(t)
+	site := querySiteById(db, 1)
+	for _, title := range []string{"Guide", "Unlisted"} {
+		_, err := createPage(db, site, &Page{Title: title, Body: title})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	getStart := func() string {
+		r := httptest.NewRequest("GET", pageUrl(site.Sitename, ""), nil)
+		w := httptest.NewRecorder()
+		indexHandler(db)(w, r)
+		return w.Body.String()
+	}
+	pagesMenu := `<p class="border-b mb-1">Pages</p>`
+	navMenu := `<p class="border-b mb-1">Navigation</p>`
+
+	body := getStart()
+	if !strings.Contains(body, "Made with") || !strings.Contains(body, pagesMenu) || strings.Contains(body, navMenu) {
+		t.Errorf("site without header, footer and nav doesn't show the defaults")
+	}
+
+	site.Header = "**Welcome**"
+	site.Footer = "Footer, see [[Guide]]"
+	site.Nav = "The Guide | Guide"
+	site.Navonly = true
+	err := updateSite(db, site, site.Sitename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body = getStart()
+	if !strings.Contains(body, "<strong>Welcome</strong>") {
+		t.Errorf("header not shown")
+	}
+	if !strings.Contains(body, "Footer, see <a") || strings.Contains(body, "Made with") {
+		t.Errorf("footer not shown in place of the default")
+	}
+	if !strings.Contains(body, navMenu) || !strings.Contains(body, "The Guide") {
+		t.Errorf("nav menu not shown")
+	}
+	if strings.Contains(body, pagesMenu) || strings.Contains(body, "Unlisted") {
+		t.Errorf("pages menu shown with nav only")
+	}
+}